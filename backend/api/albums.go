@@ -0,0 +1,454 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// albumDTO is an album with its image count and the thumbnail shown for it.
+// Without an explicit cover the first image stands in. Hidden images are
+// only counted and used as covers while the vault is unlocked.
+type albumDTO struct {
+	db.Album
+	ImageCount    int64   `json:"imageCount"`
+	CoverThumbURL *string `json:"coverThumbUrl"`
+}
+
+// albumRequest is the body of album create and update requests. On update,
+// omitted fields are left unchanged and a null coverImageId clears the cover.
+type albumRequest struct {
+	Name         *string        `json:"name"`
+	Description  *string        `json:"description"`
+	CoverImageID optional[uint] `json:"coverImageId"`
+}
+
+// albumImagesRequest lists images to add to or remove from an album.
+// Position inserts added images at that index instead of appending them.
+type albumImagesRequest struct {
+	IDs      []uint `json:"ids"`
+	Position *int   `json:"position"`
+}
+
+// loadAlbumDTOs returns albums with their counts and cover thumbnails.
+func loadAlbumDTOs(c *gin.Context, gdb *gorm.DB, q *gorm.DB) ([]albumDTO, error) {
+	var albums []db.Album
+	if err := q.Find(&albums).Error; err != nil {
+		return nil, err
+	}
+	out := make([]albumDTO, len(albums))
+	if len(albums) == 0 {
+		return out, nil
+	}
+	ids := make([]uint, len(albums))
+	for i, a := range albums {
+		ids[i] = a.ID
+		out[i].Album = a
+	}
+
+	visible := "images.deleted_at IS NULL"
+	if !vaultUnlocked(c) {
+		visible += " AND images.hidden = 0"
+	}
+	var counts []struct {
+		AlbumID uint
+		N       int64
+	}
+	if err := gdb.Table("album_images").
+		Select("album_images.album_id, COUNT(*) AS n").
+		Joins("JOIN images ON images.id = album_images.image_id").
+		Where("album_images.album_id IN ?", ids).Where(visible).
+		Group("album_images.album_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	// The explicit cover if visible, else the first visible image.
+	var covers []struct {
+		AlbumID uint
+		ID      uint
+		SHA256  string `gorm:"column:sha256"`
+		BlurID  string
+		Hidden  bool
+		NSFW    bool
+		Cover   bool
+	}
+	if err := gdb.Table("album_images").
+		Select("album_images.album_id, images.id, images.sha256, COALESCE(images.blur_id, '') AS blur_id, images.hidden, images.nsfw, images.id = albums.cover_image_id AS cover").
+		Joins("JOIN images ON images.id = album_images.image_id").
+		Joins("JOIN albums ON albums.id = album_images.album_id").
+		Where("album_images.album_id IN ?", ids).Where(visible).
+		Order("album_images.album_id, cover DESC, album_images.position, images.id").
+		Scan(&covers).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uint]*albumDTO, len(out))
+	for i := range out {
+		byID[out[i].ID] = &out[i]
+	}
+	for _, n := range counts {
+		byID[n.AlbumID].ImageCount = n.N
+	}
+	blur, err := blurMode(gdb)
+	if err != nil {
+		return nil, err
+	}
+	for _, cv := range covers {
+		if a := byID[cv.AlbumID]; a.CoverThumbURL == nil {
+			u := thumbURL(cv.ID, cv.SHA256, cv.BlurID, cv.Hidden, blur && cv.NSFW)
+			a.CoverThumbURL = &u
+		}
+	}
+	return out, nil
+}
+
+// respondAlbum writes the current state of an album.
+func respondAlbum(c *gin.Context, gdb *gorm.DB, id uint, status int) {
+	albums, err := loadAlbumDTOs(c, gdb, gdb.Where("id = ?", id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(albums) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(status, albums[0])
+}
+
+// findAlbum loads the album named by the id parameter, writing a 404 when it
+// does not exist.
+func findAlbum(c *gin.Context, gdb *gorm.DB) (db.Album, bool) {
+	var a db.Album
+	err := gdb.First(&a, c.Param("id")).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return a, false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return a, false
+	}
+	return a, true
+}
+
+// albumOrder returns the ids of an album's images in order.
+func albumOrder(tx *gorm.DB, albumID uint) ([]uint, error) {
+	var ids []uint
+	err := tx.Model(&db.AlbumImage{}).Where("album_id = ?", albumID).
+		Order("position, image_id").Pluck("image_id", &ids).Error
+	return ids, err
+}
+
+// writeAlbumOrder renumbers an album's images to match ids and marks the
+// album updated.
+func writeAlbumOrder(tx *gorm.DB, albumID uint, ids []uint) error {
+	for i, id := range ids {
+		if err := tx.Model(&db.AlbumImage{}).Where("album_id = ? AND image_id = ?", albumID, id).
+			Update("position", i).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&db.Album{}).Where("id = ?", albumID).Update("updated_at", time.Now()).Error
+}
+
+func listAlbums(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := gdb.Order("name, id")
+		if s := strings.TrimSpace(c.Query("q")); s != "" {
+			q = q.Where("name LIKE ?", "%"+s+"%")
+		}
+		items, err := loadAlbumDTOs(c, gdb, q)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+func getAlbum(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := findAlbum(c, gdb)
+		if !ok {
+			return
+		}
+		respondAlbum(c, gdb, a.ID, http.StatusOK)
+	}
+}
+
+// bindAlbum decodes an album request, writing a 400 response on failure.
+func bindAlbum(c *gin.Context) (albumRequest, bool) {
+	var req albumRequest
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if *req.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid album", "fields": fieldErrors{"name": "must not be empty"}})
+			return req, false
+		}
+	}
+	return req, true
+}
+
+func createAlbum(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindAlbum(c)
+		if !ok {
+			return
+		}
+		if req.Name == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid album", "fields": fieldErrors{"name": "is required"}})
+			return
+		}
+		if req.CoverImageID.Set {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid album", "fields": fieldErrors{"coverImageId": "add images before choosing a cover"}})
+			return
+		}
+		a := db.Album{Name: *req.Name}
+		if req.Description != nil {
+			a.Description = *req.Description
+		}
+		if err := gdb.Create(&a).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondAlbum(c, gdb, a.ID, http.StatusCreated)
+	}
+}
+
+// updateAlbum renames an album, edits its description or sets its cover.
+// The cover must be one of the album's images.
+func updateAlbum(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := findAlbum(c, gdb)
+		if !ok {
+			return
+		}
+		req, ok := bindAlbum(c)
+		if !ok {
+			return
+		}
+		updates := map[string]any{"updated_at": time.Now()}
+		if req.Name != nil {
+			updates["name"] = *req.Name
+		}
+		if req.Description != nil {
+			updates["description"] = *req.Description
+		}
+		if req.CoverImageID.Set {
+			if cover := req.CoverImageID.Value; cover != nil {
+				var n int64
+				if err := gdb.Model(&db.AlbumImage{}).Where("album_id = ? AND image_id = ?", a.ID, *cover).Count(&n).Error; err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if n == 0 {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid album", "fields": fieldErrors{"coverImageId": "image is not in the album"}})
+					return
+				}
+				updates["cover_image_id"] = *cover
+			} else {
+				updates["cover_image_id"] = nil
+			}
+		}
+		if err := gdb.Model(&db.Album{}).Where("id = ?", a.ID).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondAlbum(c, gdb, a.ID, http.StatusOK)
+	}
+}
+
+// deleteAlbum removes an album. Its images stay in the library and their
+// files are never touched.
+func deleteAlbum(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := gdb.Delete(&db.Album{}, c.Param("id"))
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// addAlbumImages adds images to an album, appended or inserted at position
+// in the order given. Images already in the album stay where they are and
+// unknown ids are reported as missing.
+func addAlbumImages(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := findAlbum(c, gdb)
+		if !ok {
+			return
+		}
+		var req albumImagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ids, missing, err := bulkTargets(c, gdb, req.IDs, nil)
+		if err != nil {
+			respondTargetsError(c, err)
+			return
+		}
+		added := 0
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			order, err := albumOrder(tx, a.ID)
+			if err != nil {
+				return err
+			}
+			present := make(map[uint]bool, len(order))
+			for _, id := range order {
+				present[id] = true
+			}
+			var fresh []uint
+			for _, id := range ids {
+				if !present[id] {
+					fresh = append(fresh, id)
+				}
+			}
+			if len(fresh) == 0 {
+				return nil
+			}
+			at := len(order)
+			if req.Position != nil && *req.Position >= 0 && *req.Position < at {
+				at = *req.Position
+			}
+			for _, id := range fresh {
+				if err := tx.Create(&db.AlbumImage{AlbumID: a.ID, ImageID: id}).Error; err != nil {
+					return err
+				}
+			}
+			added = len(fresh)
+			order = slices.Insert(order, at, fresh...)
+			return writeAlbumOrder(tx, a.ID, order)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"added": added, "missing": nonNil(missing)})
+	}
+}
+
+// removeAlbumImages takes images out of an album, clearing the cover if it
+// was one of them. The images themselves are left alone.
+func removeAlbumImages(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := findAlbum(c, gdb)
+		if !ok {
+			return
+		}
+		var req albumImagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.IDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+			return
+		}
+		var removed int64
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			res := tx.Where("album_id = ? AND image_id IN ?", a.ID, req.IDs).Delete(&db.AlbumImage{})
+			if res.Error != nil {
+				return res.Error
+			}
+			removed = res.RowsAffected
+			if err := tx.Model(&db.Album{}).Where("id = ? AND cover_image_id IN ?", a.ID, req.IDs).
+				Update("cover_image_id", nil).Error; err != nil {
+				return err
+			}
+			order, err := albumOrder(tx, a.ID)
+			if err != nil {
+				return err
+			}
+			return writeAlbumOrder(tx, a.ID, order)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"removed": removed})
+	}
+}
+
+// reorderAlbum moves the listed images to the front of the album in the
+// given order. Images not listed, such as hidden ones while the vault is
+// locked, follow in their current order.
+func reorderAlbum(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := findAlbum(c, gdb)
+		if !ok {
+			return
+		}
+		var req albumImagesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var notInAlbum []uint
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			current, err := albumOrder(tx, a.ID)
+			if err != nil {
+				return err
+			}
+			present := make(map[uint]bool, len(current))
+			for _, id := range current {
+				present[id] = true
+			}
+			listed := uniqueIDs(req.IDs)
+			moved := make(map[uint]bool, len(listed))
+			for _, id := range listed {
+				if !present[id] {
+					notInAlbum = append(notInAlbum, id)
+				}
+				moved[id] = true
+			}
+			if len(notInAlbum) > 0 {
+				return nil
+			}
+			order := append([]uint{}, listed...)
+			for _, id := range current {
+				if !moved[id] {
+					order = append(order, id)
+				}
+			}
+			return writeAlbumOrder(tx, a.ID, order)
+		})
+		switch {
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		case len(notInAlbum) > 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "images are not in the album", "ids": notInAlbum})
+		default:
+			respondAlbum(c, gdb, a.ID, http.StatusOK)
+		}
+	}
+}
+
+// nonNil returns ids, or an empty slice in place of nil so it encodes as [].
+func nonNil(ids []uint) []uint {
+	if ids == nil {
+		return []uint{}
+	}
+	return ids
+}
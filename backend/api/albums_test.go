@@ -0,0 +1,86 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestAlbums(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+
+	album := func(t *testing.T, body []byte) map[string]any {
+		t.Helper()
+		var a map[string]any
+		require.NoError(t, json.Unmarshal(body, &a))
+		return a
+	}
+
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/albums", `{"name":"  "}`).Code)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/albums", `{"title":"x"}`).Code)
+	w := doJSON(r, http.MethodPost, "/api/albums", `{"name":"Storyboard","description":"act one"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	a := album(t, w.Body.Bytes())
+	require.Equal(t, "Storyboard", a["name"])
+	require.EqualValues(t, 0, a["imageCount"])
+	require.Nil(t, a["coverThumbUrl"])
+
+	w = doJSON(r, http.MethodPost, "/api/albums/1/images", `{"ids":[3,1,99]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"added":2,"missing":[99]}`, w.Body.String())
+	// Inserting at a position; images already present are left in place.
+	w = doJSON(r, http.MethodPost, "/api/albums/1/images", `{"ids":[2,3],"position":1}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"added":1,"missing":[]}`, w.Body.String())
+
+	// An album listing follows the album's order.
+	require.Equal(t, []string{"sunflower", "dog", "cat"}, getFileNames(t, r, "/api/images?album=1&nsfw=show"))
+	require.Equal(t, []string{"cat", "dog", "sunflower"}, getFileNames(t, r, "/api/images?album=1&nsfw=show&order=desc"))
+	require.Equal(t, []string{"sunflower", "cat"}, getFileNames(t, r, "/api/images?album=1"))
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodGet, "/api/images?album=x", "").Code)
+
+	w = doJSON(r, http.MethodPut, "/api/albums/1/order", `{"ids":[1]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, []string{"cat", "sunflower", "dog"}, getFileNames(t, r, "/api/images?album=1&nsfw=show"))
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPut, "/api/albums/1/order", `{"ids":[4]}`).Code)
+
+	// The first image stands in until a cover is chosen.
+	a = album(t, doJSON(r, http.MethodGet, "/api/albums/1", "").Body.Bytes())
+	require.EqualValues(t, 3, a["imageCount"])
+	require.Equal(t, "/api/images/1/thumb?w=400", a["coverThumbUrl"])
+	w = doJSON(r, http.MethodPatch, "/api/albums/1", `{"coverImageId":4}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(r, http.MethodPatch, "/api/albums/1", `{"coverImageId":3,"name":"Board"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	a = album(t, w.Body.Bytes())
+	require.Equal(t, "Board", a["name"])
+	require.Equal(t, "act one", a["description"])
+	require.EqualValues(t, 3, a["coverImageId"])
+	require.Equal(t, "/api/images/3/thumb?w=400", a["coverThumbUrl"])
+
+	// Removing the cover image clears the cover.
+	w = doJSON(r, http.MethodDelete, "/api/albums/1/images", `{"ids":[3]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"removed":1}`, w.Body.String())
+	a = album(t, doJSON(r, http.MethodGet, "/api/albums/1", "").Body.Bytes())
+	require.Nil(t, a["coverImageId"])
+	require.EqualValues(t, 2, a["imageCount"])
+
+	w = doJSON(r, http.MethodGet, "/api/albums", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"Board"`)
+
+	// Deleting the album keeps its images.
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/albums/1", "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/albums/1", "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodGet, "/api/albums/1", "").Code)
+	var n int64
+	require.NoError(t, gdb.Model(&db.Image{}).Count(&n).Error)
+	require.EqualValues(t, 3, n)
+	require.NoError(t, gdb.Model(&db.AlbumImage{}).Count(&n).Error)
+	require.Zero(t, n)
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// Audit log actions.
+const (
+	auditTrash   = "image.trash"
+	auditRestore = "image.restore"
+	auditDelete  = "image.delete"
+	auditPurge   = "image.purge"
+	auditUpdate  = "image.update"
+	auditRevert  = "image.revert"
+)
+
+// auditSystemClient marks entries written by background jobs rather than
+// a request.
+const auditSystemClient = "system"
+
+// requestID returns the id the request middleware assigned, or the one the
+// client sent.
+func requestID(c *gin.Context) string {
+	if id := c.GetString("RequestID"); id != "" {
+		return id
+	}
+	return c.GetHeader("X-Request-ID")
+}
+
+// newAuditEntry starts an entry attributed to the request. c is nil for
+// background jobs.
+func newAuditEntry(c *gin.Context, action string, imageID uint) db.AuditEntry {
+	e := db.AuditEntry{Action: action, ImageID: &imageID, Client: auditSystemClient}
+	if c != nil {
+		e.RequestID = requestID(c)
+		e.Client = c.ClientIP()
+	}
+	return e
+}
+
+// auditHidden reports whether entries for an image belong behind the vault.
+// Once the image is deleted its earlier entries tell.
+func auditHidden(tx *gorm.DB, imageID uint) (bool, error) {
+	var hidden []bool
+	if err := tx.Model(&db.Image{}).Where("id = ?", imageID).Pluck("hidden", &hidden).Error; err != nil {
+		return false, err
+	}
+	if len(hidden) == 0 {
+		if err := tx.Model(&db.AuditEntry{}).Where("image_id = ?", imageID).Order("id DESC").Limit(1).Pluck("hidden", &hidden).Error; err != nil {
+			return false, err
+		}
+	}
+	return len(hidden) > 0 && hidden[0], nil
+}
+
+// recordAudit writes an audit entry in tx, so it commits or rolls back with
+// the action.
+func recordAudit(c *gin.Context, tx *gorm.DB, action string, imageID uint, detail any) error {
+	e := newAuditEntry(c, action, imageID)
+	hidden, err := auditHidden(tx, imageID)
+	if err != nil {
+		return err
+	}
+	e.Hidden = hidden
+	if detail != nil {
+		raw, err := json.Marshal(detail)
+		if err != nil {
+			return err
+		}
+		e.Detail = raw
+	}
+	return tx.Create(&e).Error
+}
+
+// listAudit returns audit entries, newest first, optionally narrowed by
+// action and imageId. Entries of hidden images need the vault.
+func listAudit(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+		pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+		if page < 1 {
+			page = 1
+		}
+		if pageSize < 1 || pageSize > 200 {
+			pageSize = 50
+		}
+		q := gdb.Model(&db.AuditEntry{})
+		if !vaultUnlocked(c) {
+			q = q.Where("hidden = ?", false)
+		}
+		if a := c.Query("action"); a != "" {
+			q = q.Where("action = ?", a)
+		}
+		if s := c.Query("imageId"); s != "" {
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid imageId"})
+				return
+			}
+			q = q.Where("image_id = ?", id)
+		}
+		var total int64
+		if err := q.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		items := []db.AuditEntry{}
+		if err := q.Order("id DESC").Limit(pageSize).Offset((page - 1) * pageSize).Find(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"page": page, "pageSize": pageSize, "total": total, "items": items})
+	}
+}
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// bulkRequest targets either explicit ids or every image matching filter,
+// a query string in the syntax accepted by listImages.
+type bulkRequest struct {
+	IDs     []uint      `json:"ids"`
+	Filter  *string     `json:"filter"`
+	Actions bulkActions `json:"actions"`
+	DryRun  bool        `json:"dryRun"`
+	Token   string      `json:"token"`
+}
+
+type bulkActions struct {
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+	Rating     *int     `json:"rating"`
+	Favorite   *bool    `json:"favorite"`
+	NSFW       *bool    `json:"nsfw"`
+	Hidden     *bool    `json:"hidden"`
+	// Move is a destination folder, relative to the library path unless
+	// absolute.
+	Move *string `json:"move"`
+	// Delete is "trash" or "hard"; it cannot be combined with other actions.
+	Delete string `json:"delete"`
+}
+
+type bulkItemResult struct {
+	ID     uint   `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// validate reports the first problem with the requested actions.
+func (a bulkActions) validate() error {
+	edits := len(a.AddTags) > 0 || len(a.RemoveTags) > 0 || a.Rating != nil ||
+		a.Favorite != nil || a.NSFW != nil || a.Hidden != nil || a.Move != nil
+	switch {
+	case a.Delete != "" && a.Delete != "trash" && a.Delete != "hard":
+		return errors.New("delete must be trash or hard")
+	case a.Delete != "" && edits:
+		return errors.New("delete cannot be combined with other actions")
+	case a.Delete == "" && !edits:
+		return errors.New("no actions given")
+	case a.Rating != nil && (*a.Rating < 0 || *a.Rating > 5):
+		return errors.New("rating must be between 0 and 5")
+	case a.Move != nil && strings.TrimSpace(*a.Move) == "":
+		return errors.New("move requires a destination folder")
+	}
+	return nil
+}
+
+// bulkTargets resolves the ids a bulk request applies to. Unknown and
+// trashed ids are returned separately so they can be reported per item, as
+// are hidden ids while the vault is locked. The filter may name a saved
+// search with search=<id>. A filter revealing hidden images fails with
+// errVaultLocked unless the vault is unlocked.
+func bulkTargets(c *gin.Context, gdb *gorm.DB, reqIDs []uint, filter *string) (ids, missing []uint, err error) {
+	if filter != nil {
+		if len(reqIDs) > 0 {
+			return nil, nil, errors.New("ids and filter are mutually exclusive")
+		}
+		values, err := url.ParseQuery(strings.TrimPrefix(*filter, "?"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		if values, err = expandSearch(gdb, values); err != nil {
+			return nil, nil, err
+		}
+		f, err := parseImageFilter(values)
+		if err != nil {
+			return nil, nil, err
+		}
+		if f.Hidden != "hide" && !vaultUnlocked(c) {
+			return nil, nil, errVaultLocked
+		}
+		q := gdb.Table("images").Joins("LEFT JOIN models ON images.model_id = models.id")
+		err = f.apply(gdb, q).Order("images.id").Pluck("images.id", &ids).Error
+		return ids, nil, err
+	}
+	if len(reqIDs) == 0 {
+		return nil, nil, errors.New("ids or filter is required")
+	}
+
+	var found []uint
+	q := gdb.Model(&db.Image{}).Where("id IN ? AND deleted_at IS NULL", reqIDs)
+	if !vaultUnlocked(c) {
+		q = q.Where("hidden = 0")
+	}
+	if err := q.Pluck("id", &found).Error; err != nil {
+		return nil, nil, err
+	}
+	exists := make(map[uint]bool, len(found))
+	for _, id := range found {
+		exists[id] = true
+	}
+	seen := make(map[uint]bool, len(reqIDs))
+	for _, id := range reqIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if exists[id] {
+			ids = append(ids, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return ids, missing, nil
+}
+
+// respondTargetsError writes the response for a bulkTargets error.
+func respondTargetsError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errVaultLocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, errSearchNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// bulkImages applies the same actions to many images in one transaction.
+// Each image runs in its own savepoint so a failing item is rolled back and
+// reported without aborting the rest. Hard deletes must echo the token
+// issued by a dry run, or by the 428 answer to a request without one, for
+// the same targets.
+func bulkImages(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req bulkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := req.Actions.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Actions.Hidden != nil && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+		ids, missing, err := bulkTargets(c, gdb, req.IDs, req.Filter)
+		if err != nil {
+			respondTargetsError(c, err)
+			return
+		}
+
+		preview := gin.H{"matched": len(ids), "ids": ids, "missing": missing}
+		scope := confirmScope(auditDelete, ids)
+		if req.DryRun {
+			preview["dryRun"] = true
+			if req.Actions.Delete == "hard" {
+				if preview, err = previewWithToken(preview, scope); err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			c.JSON(http.StatusOK, preview)
+			return
+		}
+		if req.Actions.Delete == "hard" && !confirmed(c, req.Token, scope, preview) {
+			return
+		}
+
+		results := make([]bulkItemResult, 0, len(ids)+len(missing))
+		var (
+			moved    []fileMove
+			removals []fileRemoval
+		)
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			b := bulkRun{c: c, tx: tx, actions: req.Actions}
+			if err := b.prepare(); err != nil {
+				return err
+			}
+			for _, id := range ids {
+				res := bulkItemResult{ID: id, Status: "ok"}
+				n, m := len(b.removals), len(b.moved)
+				if err := tx.Transaction(func(itx *gorm.DB) error { return b.apply(itx, id) }); err != nil {
+					res.Status, res.Error = "failed", err.Error()
+					b.removals = b.removals[:n]
+					undoMoves(b.moved[m:])
+					b.moved = b.moved[:m]
+				}
+				results = append(results, res)
+			}
+			moved, removals = b.moved, b.removals
+			return b.finish()
+		})
+		if err != nil {
+			// The database changes were rolled back; put moved files back
+			// where the rows still point.
+			undoMoves(moved)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, r := range removals {
+			r.run()
+		}
+		for _, id := range missing {
+			results = append(results, bulkItemResult{ID: id, Status: "failed", Error: "not found"})
+		}
+
+		succeeded := 0
+		for _, r := range results {
+			if r.Status == "ok" {
+				succeeded++
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"matched":   len(ids),
+			"succeeded": succeeded,
+			"failed":    len(results) - succeeded,
+			"results":   results,
+		})
+	}
+}
+
+// bulkRun holds the state shared by the items of one bulk request.
+type bulkRun struct {
+	c       *gin.Context
+	tx      *gorm.DB
+	actions bulkActions
+
+	addTags    []db.Tag
+	removeTags []uint
+	moveDir    string
+	// moved records file moves so they can be undone.
+	moved []fileMove
+	// removals are the files of hard-deleted images, removed after commit.
+	removals []fileRemoval
+}
+
+// prepare resolves tags and the move destination once for all items.
+func (b *bulkRun) prepare() error {
+	for _, name := range uniqueNames(b.actions.AddTags) {
+		t, err := db.ResolveTag(b.tx, name)
+		if err != nil {
+			return err
+		}
+		b.addTags = append(b.addTags, t)
+	}
+	for _, name := range uniqueNames(b.actions.RemoveTags) {
+		t, err := db.LookupTag(b.tx, name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b.removeTags = append(b.removeTags, t.ID)
+	}
+	if b.actions.Move != nil {
+		dir, err := imageAbsPath(b.tx, *b.actions.Move)
+		if err != nil {
+			return err
+		}
+		b.moveDir = dir
+	}
+	return nil
+}
+
+// apply runs the requested actions against a single image, recording the
+// changed fields in its history. Deletes are audited on their own.
+func (b *bulkRun) apply(tx *gorm.DB, id uint) error {
+	if b.actions.Delete != "" {
+		if err := bumpVersion(tx, id, ""); err != nil {
+			return err
+		}
+		return b.delete(tx, id)
+	}
+	return trackChanges(b.c, tx, auditUpdate, func() error {
+		if err := bumpVersion(tx, id, ""); err != nil {
+			return err
+		}
+		return b.edit(tx, id)
+	}, id)
+}
+
+// edit applies the field, tag and move actions to a single image.
+func (b *bulkRun) edit(tx *gorm.DB, id uint) error {
+	updates := map[string]any{}
+	if v := b.actions.Rating; v != nil {
+		updates["rating"] = *v
+	}
+	if v := b.actions.Favorite; v != nil {
+		updates["favorite"] = *v
+	}
+	if v := b.actions.NSFW; v != nil {
+		updates["nsfw"] = *v
+		updates["nsfw_manual"] = gorm.Expr("nsfw_manual OR nsfw <> ?", *v)
+	}
+	if v := b.actions.Hidden; v != nil {
+		updates["hidden"] = *v
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(&db.Image{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+
+	for _, t := range b.addTags {
+		rel := db.ImageTag{ImageID: id, TagID: t.ID}
+		if err := tx.FirstOrCreate(&rel, rel).Error; err != nil {
+			return err
+		}
+	}
+	if len(b.removeTags) > 0 {
+		if err := tx.Where("image_id = ? AND tag_id IN ?", id, b.removeTags).Delete(&db.ImageTag{}).Error; err != nil {
+			return err
+		}
+	}
+
+	if b.actions.Move != nil {
+		return b.move(tx, id)
+	}
+	return nil
+}
+
+// move relocates an image's file into the destination folder and updates its
+// stored path. The file is moved last so a database error leaves it alone.
+func (b *bulkRun) move(tx *gorm.DB, id uint) error {
+	var img db.Image
+	if err := tx.Select("id, path").First(&img, id).Error; err != nil {
+		return err
+	}
+	src, err := imageAbsPath(tx, img.Path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(b.moveDir, filepath.Base(src))
+	if dst == src {
+		return nil
+	}
+	if err := checkPathAllowed(b.c, tx, src, "bulk_move"); err != nil {
+		return err
+	}
+	if err := checkPathAllowed(b.c, tx, dst, "bulk_move"); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return errors.New("destination already exists")
+	}
+
+	stored := dst
+	if root, err := settingValue(tx, "library_path"); err == nil && root != "" {
+		if absRoot, err := filepath.Abs(root); err == nil && withinRoot(dst, absRoot) {
+			rel, _ := filepath.Rel(absRoot, dst)
+			stored = filepath.ToSlash(rel)
+		}
+	}
+	if err := tx.Model(&db.Image{}).Where("id = ?", id).
+		Updates(map[string]any{"path": stored, "file_name": filepath.Base(dst)}).Error; err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(b.moveDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	b.moved = append(b.moved, fileMove{src: src, dst: dst})
+	return nil
+}
+
+// delete removes an image like deleteImage does, either to the trash or
+// permanently.
+func (b *bulkRun) delete(tx *gorm.DB, id uint) error {
+	var img db.Image
+	if err := tx.Select("id, path, sha256, blur_id, deleted_at").First(&img, id).Error; err != nil {
+		return err
+	}
+	abs, err := imageAbsPath(tx, img.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkPathAllowed(b.c, tx, abs, "bulk_delete_"+b.actions.Delete); err != nil {
+		return err
+	}
+	if b.actions.Delete == "trash" {
+		move, err := trashImage(b.c, tx, img, abs)
+		if err != nil {
+			return err
+		}
+		b.moved = append(b.moved, move)
+		return nil
+	}
+	removal, err := hardDeleteImage(b.c, tx, img, abs)
+	if err != nil {
+		return err
+	}
+	b.removals = append(b.removals, removal)
+	return nil
+}
+
+// finish drops tags left without images or children by the removal.
+func (b *bulkRun) finish() error {
+	if len(b.removeTags) == 0 {
+		return nil
+	}
+	return b.tx.Where("id IN ? AND "+orphanTagSQL, b.removeTags).Delete(&db.Tag{}).Error
+}
+
+// uniqueNames trims names and drops blanks and duplicates, keeping order.
+func uniqueNames(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+type bulkResponse struct {
+	DryRun    bool   `json:"dryRun"`
+	Matched   int    `json:"matched"`
+	IDs       []uint `json:"ids"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Results   []struct {
+		ID     uint   `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+func postBulk(t *testing.T, r *gin.Engine, body string) bulkResponse {
+	t.Helper()
+	w := doJSON(r, http.MethodPost, "/api/images/bulk", body)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp bulkResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestBulkImages(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+
+	t.Run("validation", func(t *testing.T) {
+		for _, body := range []string{
+			`{"ids":[1]}`,
+			`{"ids":[1],"actions":{"rating":9}}`,
+			`{"ids":[1],"actions":{"delete":"trash","rating":1}}`,
+			`{"actions":{"rating":1}}`,
+			`{"ids":[1],"filter":"tags=cat","actions":{"rating":1}}`,
+			`{"filter":"stepsMin=many","actions":{"rating":1}}`,
+		} {
+			require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/images/bulk", body).Code, body)
+		}
+	})
+
+	t.Run("dry run with filter", func(t *testing.T) {
+		resp := postBulk(t, r, `{"filter":"tags=animal&nsfw=show","actions":{"rating":5},"dryRun":true}`)
+		require.True(t, resp.DryRun)
+		require.Equal(t, 2, resp.Matched)
+		require.Equal(t, []uint{1, 2}, resp.IDs)
+
+		var n int64
+		require.NoError(t, gdb.Model(&db.Image{}).Where("rating = 5").Count(&n).Error)
+		require.Zero(t, n)
+	})
+
+	t.Run("edit by ids", func(t *testing.T) {
+		body := `{"ids":[1,3,99],"actions":{"addTags":["picked"," picked "],"removeTags":["cat"],"rating":4,"hidden":true,"favorite":false}}`
+		require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodPost, "/api/images/bulk", body).Code)
+		w := doVault(r, http.MethodPost, "/api/images/bulk", body, unlockTestVault(t, r))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp bulkResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 2, resp.Matched)
+		require.Equal(t, 2, resp.Succeeded)
+		require.Equal(t, 1, resp.Failed)
+		require.Equal(t, uint(99), resp.Results[2].ID)
+		require.Equal(t, "not found", resp.Results[2].Error)
+
+		for _, id := range []uint{1, 3} {
+			var img db.Image
+			require.NoError(t, gdb.Preload("Tags").First(&img, id).Error)
+			require.Equal(t, 4, img.Rating)
+			require.True(t, img.Hidden)
+			require.False(t, img.Favorite)
+			require.Equal(t, 2, img.Version)
+			var names []string
+			for _, tag := range img.Tags {
+				names = append(names, tag.Name)
+			}
+			require.Contains(t, names, "picked")
+			require.NotContains(t, names, "cat")
+		}
+		// The removed tag had no other images and is dropped.
+		require.ErrorIs(t, gdb.Where("name = ?", "cat").First(&db.Tag{}).Error, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("filter targets", func(t *testing.T) {
+		resp := postBulk(t, r, `{"filter":"nsfw=only","actions":{"nsfw":false}}`)
+		require.Equal(t, 1, resp.Succeeded)
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 2).Error)
+		require.False(t, img.NSFW)
+	})
+}
+
+func TestBulkMoveAndDelete(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(name), 0o644))
+		require.NoError(t, gdb.Create(&db.Image{Path: name, FileName: name, Ext: "png", SizeBytes: 5, SHA256: name}).Error)
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "sorted"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "sorted", "b.png"), []byte("taken"), 0o644))
+	r := newRouter(gdb)
+
+	resp := postBulk(t, r, `{"ids":[1,2],"actions":{"move":"sorted","rating":3}}`)
+	require.Equal(t, 1, resp.Succeeded)
+	require.Equal(t, "destination already exists", resp.Results[1].Error)
+
+	var a, b db.Image
+	require.NoError(t, gdb.First(&a, 1).Error)
+	require.NoError(t, gdb.First(&b, 2).Error)
+	require.Equal(t, "sorted/a.png", a.Path)
+	require.Equal(t, 3, a.Rating)
+	require.FileExists(t, filepath.Join(root, "sorted", "a.png"))
+	require.NoFileExists(t, filepath.Join(root, "a.png"))
+	// The failed item is rolled back entirely.
+	require.Equal(t, "b.png", b.Path)
+	require.Equal(t, 0, b.Rating)
+	require.FileExists(t, filepath.Join(root, "b.png"))
+
+	resp = postBulk(t, r, `{"ids":[2],"actions":{"move":"`+outside+`"}}`)
+	require.Equal(t, 1, resp.Failed)
+	require.FileExists(t, filepath.Join(root, "b.png"))
+
+	w := doJSON(r, http.MethodPost, "/api/images/bulk", `{"ids":[2,3],"actions":{"delete":"hard"},"token":"2"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(r, http.MethodPost, "/api/images/bulk", `{"ids":[2,3],"actions":{"delete":"hard"},"dryRun":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	resp = postBulk(t, r, `{"ids":[2,3],"actions":{"delete":"hard"},"token":"`+confirmToken(t, w)+`"}`)
+	require.Equal(t, 2, resp.Succeeded)
+	require.NoFileExists(t, filepath.Join(root, "b.png"))
+	require.NoFileExists(t, filepath.Join(root, "c.png"))
+	var n int64
+	require.NoError(t, gdb.Model(&db.Image{}).Count(&n).Error)
+	require.EqualValues(t, 1, n)
+}
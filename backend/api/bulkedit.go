@@ -0,0 +1,325 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// bulkEditRequest rewrites metadata across many images: replace rules run
+// find/replace on prompt text and set is a metadata patch, as accepted by
+// updateMetadata, applied to every target.
+type bulkEditRequest struct {
+	IDs           []uint          `json:"ids"`
+	Filter        *string         `json:"filter"`
+	Replace       []replaceRule   `json:"replace"`
+	Set           json.RawMessage `json:"set"`
+	RecomputeNSFW bool            `json:"recomputeNsfw"`
+	DryRun        bool            `json:"dryRun"`
+}
+
+type replaceRule struct {
+	// Field is "prompt" or "negativePrompt".
+	Field      string `json:"field"`
+	Find       string `json:"find"`
+	Replace    string `json:"replace"`
+	Regex      bool   `json:"regex"`
+	IgnoreCase bool   `json:"ignoreCase"`
+}
+
+// compiledRule is a replace rule ready to run. Literal rules are compiled to
+// quoted patterns and replace without expanding $ references.
+type compiledRule struct {
+	field   string
+	re      *regexp.Regexp
+	replace string
+	literal bool
+}
+
+func (r compiledRule) apply(s string) string {
+	if r.literal {
+		return r.re.ReplaceAllLiteralString(s, r.replace)
+	}
+	return r.re.ReplaceAllString(s, r.replace)
+}
+
+// fieldChange is one entry of a preview diff, holding JSON values as the
+// image API returns them.
+type fieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+type bulkEditItem struct {
+	ID      uint          `json:"id"`
+	Status  string        `json:"status,omitempty"`
+	Error   string        `json:"error,omitempty"`
+	Changes []fieldChange `json:"changes"`
+}
+
+// compileReplaceRules validates replace rules, keyed by their position in
+// the request for error reporting.
+func compileReplaceRules(rules []replaceRule) ([]compiledRule, fieldErrors) {
+	errs := fieldErrors{}
+	out := make([]compiledRule, 0, len(rules))
+	for i, r := range rules {
+		key := fmt.Sprintf("replace[%d]", i)
+		if r.Field != "prompt" && r.Field != "negativePrompt" {
+			errs[key] = "field must be prompt or negativePrompt"
+			continue
+		}
+		if r.Find == "" {
+			errs[key] = "find is required"
+			continue
+		}
+		pattern := r.Find
+		if !r.Regex {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		if r.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs[key] = "invalid regular expression"
+			continue
+		}
+		out = append(out, compiledRule{field: r.Field, re: re, replace: r.Replace, literal: !r.Regex})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return out, nil
+}
+
+// planBulkEdit computes the patch for one image and the fields it would
+// change. An empty change list means the image is left untouched.
+func planBulkEdit(gdb *gorm.DB, id uint, rules []compiledRule, set metadataPatch) (metadataPatch, []fieldChange, error) {
+	img, err := loadImage(gdb, id)
+	if err != nil {
+		return set, nil, err
+	}
+	patch := set
+	for _, r := range rules {
+		target := &patch.Prompt
+		current := img.Prompt
+		if r.field == "negativePrompt" {
+			target, current = &patch.NegativePrompt, img.NegativePrompt
+		}
+		if target.Set {
+			current = target.Value
+		}
+		if current == nil {
+			continue
+		}
+		next := r.apply(*current)
+		*target = optional[string]{Set: true, Value: &next}
+	}
+
+	raw, err := json.Marshal(img)
+	if err != nil {
+		return patch, nil, err
+	}
+	var old map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &old); err != nil {
+		return patch, nil, err
+	}
+	var changes []fieldChange
+	for key, f := range patch.fields() {
+		if !f.value.present() {
+			continue
+		}
+		prev := old[key]
+		if prev == nil {
+			prev = json.RawMessage("null")
+		}
+		var next json.RawMessage
+		switch key {
+		case "fields":
+			next, err = mergeFieldValues(old[key], *patch.Fields.Value)
+		case "loras":
+			if prev, err = json.Marshal(imageLoras(img.Loras)); err != nil {
+				return patch, nil, err
+			}
+			var loras []loraPatch
+			if loras, err = plannedLoras(gdb, patch.Loras.Value); err == nil {
+				next, err = json.Marshal(loras)
+			}
+		default:
+			next, err = json.Marshal(f.value.value())
+		}
+		if err != nil {
+			return patch, nil, err
+		}
+		if !bytes.Equal(prev, next) {
+			changes = append(changes, fieldChange{Field: key, Old: prev, New: next})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return patch, changes, nil
+}
+
+// plannedLoras resolves the LoRAs of a patch the way applyMetadataPatch
+// will, by name and then by hash, without creating any. The result is in
+// the form of imageLoras so unchanged LoRAs compare equal.
+func plannedLoras(tx *gorm.DB, patch *[]loraPatch) ([]loraPatch, error) {
+	if patch == nil {
+		return imageLoras(nil), nil
+	}
+	var ls []*db.Lora
+	seen := map[string]bool{}
+	for _, lp := range *patch {
+		var found []db.Lora
+		if lp.Name != "" {
+			if err := tx.Where("name = ?", lp.Name).Limit(1).Find(&found).Error; err != nil {
+				return nil, err
+			}
+		}
+		if len(found) == 0 && lp.Hash != "" {
+			if err := tx.Where("hash = ?", lp.Hash).Limit(1).Find(&found).Error; err != nil {
+				return nil, err
+			}
+		}
+		l := db.Lora{Name: lp.Name}
+		if len(found) > 0 {
+			l = found[0]
+		}
+		if lp.Hash != "" && (l.Hash == nil || *l.Hash == "") {
+			l.Hash = &lp.Hash
+		}
+		if seen[l.Name] {
+			continue
+		}
+		seen[l.Name] = true
+		l.Weight = lp.Weight
+		ls = append(ls, &l)
+	}
+	return imageLoras(ls), nil
+}
+
+// bulkEditImages applies find/replace rules and field edits to a set of
+// images. A dry run returns the per-image diff without writing. Otherwise
+// every changed image is written through applyMetadataPatch in its own
+// savepoint, bumping its version, so the FTS triggers and If-Match checks
+// see the same edits as single image updates.
+func bulkEditImages(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req bulkEditRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rules, ferrs := compileReplaceRules(req.Replace)
+		if ferrs != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ferrs.Error(), "fields": ferrs})
+			return
+		}
+		var set metadataPatch
+		if len(req.Set) > 0 && string(req.Set) != "null" {
+			var err error
+			set, err = decodeMetadataPatch(req.Set)
+			if errors.As(err, &ferrs) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": ferrs.Error(), "fields": ferrs})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if len(rules) == 0 && len(set.columns()) == 0 && !set.ModelName.Set && !set.ModelHash.Set && !set.Loras.Set && !set.Fields.Set {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no edits given"})
+			return
+		}
+		if set.Hidden.Set && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+		ids, missing, err := bulkTargets(c, gdb, req.IDs, req.Filter)
+		if err != nil {
+			respondTargetsError(c, err)
+			return
+		}
+
+		if req.DryRun {
+			items := make([]bulkEditItem, 0)
+			for _, id := range ids {
+				_, changes, err := planBulkEdit(gdb, id, rules, set)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if len(changes) > 0 {
+					items = append(items, bulkEditItem{ID: id, Changes: changes})
+				}
+			}
+			c.JSON(http.StatusOK, gin.H{"dryRun": true, "matched": len(ids), "changed": len(items), "items": items, "missing": missing})
+			return
+		}
+
+		results := make([]bulkEditItem, 0, len(ids))
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			for _, id := range ids {
+				item := bulkEditItem{ID: id, Status: "ok"}
+				err := tx.Transaction(func(itx *gorm.DB) error {
+					patch, changes, err := planBulkEdit(itx, id, rules, set)
+					if err != nil {
+						return err
+					}
+					item.Changes = changes
+					if len(changes) == 0 {
+						item.Status = "unchanged"
+						return nil
+					}
+					return trackChanges(c, itx, auditUpdate, func() error {
+						if err := bumpVersion(itx, id, ""); err != nil {
+							return err
+						}
+						return applyMetadataPatch(itx, id, patch, req.RecomputeNSFW)
+					}, id)
+				})
+				if err != nil {
+					item.Status, item.Error = "failed", err.Error()
+					if errors.As(err, &ferrs) {
+						fields := make([]string, 0, len(ferrs))
+						for field := range ferrs {
+							fields = append(fields, field)
+						}
+						sort.Strings(fields)
+						item.Error = fields[0] + ": " + ferrs[fields[0]]
+					}
+				}
+				results = append(results, item)
+			}
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, id := range missing {
+			results = append(results, bulkEditItem{ID: id, Status: "failed", Error: "not found"})
+		}
+
+		counts := map[string]int{}
+		for _, r := range results {
+			counts[r.Status]++
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"matched":   len(ids),
+			"succeeded": counts["ok"],
+			"unchanged": counts["unchanged"],
+			"failed":    counts["failed"],
+			"results":   results,
+		})
+	}
+}
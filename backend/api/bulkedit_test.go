@@ -0,0 +1,140 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestBulkEditImages(t *testing.T) {
+	gdb := newTestDB(t)
+	str := func(s string) *string { return &s }
+	require.NoError(t, gdb.Create(&db.Image{Path: "1.png", FileName: "1", Ext: "png", SizeBytes: 1, SHA256: "1",
+		Prompt: str("castle, LEAK_TOKEN, 512px"), NegativePrompt: str("blurry, leak_token"), Sampler: str("Euler")}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "2.png", FileName: "2", Ext: "png", SizeBytes: 1, SHA256: "2",
+		Prompt: str("forest at dusk"), Sampler: str("DPM++")}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "3.png", FileName: "3", Ext: "png", SizeBytes: 1, SHA256: "3",
+		Prompt: str("leak_token"), NSFW: true}).Error)
+	r := newRouter(gdb)
+
+	body := `{"ids":[1,2],"replace":[
+		{"field":"prompt","find":"leak_token, ","replace":"","ignoreCase":true},
+		{"field":"negativePrompt","find":", leak_token","replace":""},
+		{"field":"prompt","find":"(\\d+)px","replace":"${1} pixels","regex":true}
+	],"set":{"sourceApp":"ComfyUI","modelName":"sdxl-fixed","sampler":null}`
+
+	t.Run("validation", func(t *testing.T) {
+		for _, b := range []string{
+			`{"ids":[1]}`,
+			`{"ids":[1],"replace":[{"field":"seed","find":"a"}]}`,
+			`{"ids":[1],"replace":[{"field":"prompt","find":"(","regex":true}]}`,
+			`{"ids":[1],"set":{"steps":-1}}`,
+		} {
+			require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/images/bulk/edit", b).Code, b)
+		}
+	})
+
+	t.Run("preview", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/images/bulk/edit", body+`,"dryRun":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Changed int `json:"changed"`
+			Items   []struct {
+				ID      uint `json:"id"`
+				Changes []struct {
+					Field string          `json:"field"`
+					Old   json.RawMessage `json:"old"`
+					New   json.RawMessage `json:"new"`
+				} `json:"changes"`
+			} `json:"items"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 2, resp.Changed)
+		diff := map[string][2]string{}
+		for _, c := range resp.Items[0].Changes {
+			diff[c.Field] = [2]string{string(c.Old), string(c.New)}
+		}
+		require.Equal(t, map[string][2]string{
+			"modelName":      {`null`, `"sdxl-fixed"`},
+			"negativePrompt": {`"blurry, leak_token"`, `"blurry"`},
+			"prompt":         {`"castle, LEAK_TOKEN, 512px"`, `"castle, 512 pixels"`},
+			"sampler":        {`"Euler"`, `null`},
+			"sourceApp":      {`null`, `"ComfyUI"`},
+		}, diff)
+
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 1).Error)
+		require.Equal(t, "castle, LEAK_TOKEN, 512px", *img.Prompt)
+		require.Equal(t, 1, img.Version)
+	})
+
+	t.Run("apply", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/images/bulk/edit", body+`}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Succeeded int `json:"succeeded"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 2, resp.Succeeded)
+
+		var img db.Image
+		require.NoError(t, gdb.Preload("Model").First(&img, 1).Error)
+		require.Equal(t, "castle, 512 pixels", *img.Prompt)
+		require.Equal(t, "blurry", *img.NegativePrompt)
+		require.Nil(t, img.Sampler)
+		require.Equal(t, "ComfyUI", *img.SourceApp)
+		require.Equal(t, "sdxl-fixed", img.Model.Name)
+		require.Equal(t, 2, img.Version)
+
+		// Running the same edit again changes nothing.
+		w = doJSON(r, http.MethodPost, "/api/images/bulk/edit", body+`}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		var again struct {
+			Unchanged int `json:"unchanged"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &again))
+		require.Equal(t, 2, again.Unchanged)
+		require.NoError(t, gdb.First(&img, 1).Error)
+		require.Equal(t, 2, img.Version)
+	})
+
+	t.Run("filter with nsfw recompute", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/images/bulk/edit",
+			`{"filter":"nsfw=only","replace":[{"field":"prompt","find":"leak_token","replace":"harbor"}],"recomputeNsfw":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 3).Error)
+		require.Equal(t, "harbor", *img.Prompt)
+		require.False(t, img.NSFW)
+	})
+
+	t.Run("loras", func(t *testing.T) {
+		set := `{"ids":[1,2],"set":{"loras":[{"name":"detail","weight":0.5},{"name":"style","hash":"abc"}]}}`
+		w := doJSON(r, http.MethodPost, "/api/images/bulk/edit", set)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Succeeded int `json:"succeeded"`
+			Unchanged int `json:"unchanged"`
+			Results   []struct {
+				Error string `json:"error"`
+			} `json:"results"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 2, resp.Succeeded)
+
+		// The same LoRAs again, in another order, are not a change.
+		w = doJSON(r, http.MethodPost, "/api/images/bulk/edit", `{"ids":[1,2],"dryRun":true,"set":{"loras":[{"hash":"abc"},{"name":"detail","weight":0.5}]}}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Contains(t, w.Body.String(), `"changed":0`)
+
+		// Of several invalid fields, the first by name is reported.
+		w = doJSON(r, http.MethodPost, "/api/images/bulk/edit", `{"ids":[1],"set":{"fields":{"zeta":1,"alpha":2}}}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, "fields.alpha: unknown field", resp.Results[0].Error)
+	})
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/classify"
+	"gen-library/backend/jobs"
+	"gen-library/backend/logger"
+)
+
+// trainSignal wakes StartClassifierTrainer. It holds at most one pending
+// request, so a burst of edits is caught up with a single refresh.
+var trainSignal = make(chan struct{}, 1)
+
+// scheduleTraining is middleware that asks the background trainer to catch
+// up after every successful write. Reads only ever predict.
+func scheduleTraining() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if c.Writer.Status() < http.StatusMultipleChoices {
+			select {
+			case trainSignal <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// StartClassifierTrainer refreshes the classifier at startup, after writes
+// and on every tick, which catches up with background jobs and the watcher,
+// until ctx is done.
+func StartClassifierTrainer(ctx context.Context, gdb *gorm.DB, interval time.Duration) {
+	refresh := func() {
+		if err := classify.Refresh(gdb); err != nil {
+			log := logger.With().Str("component", "classify").Str("event", "refresh").Logger()
+			log.Warn().Err(err).Msg("")
+		}
+	}
+	refresh()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trainSignal:
+			refresh()
+		case <-t.C:
+			refresh()
+		}
+	}
+}
+
+// trainClassifier catches the classifier up with the library in a
+// classifier_train job. Rebuild discards the model and retrains from
+// scratch. Training also happens in the background after edits and before
+// imports, so this is only needed to do the work up front.
+func trainClassifier(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req struct {
+			Rebuild bool `json:"rebuild"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if jobs.Running("classifier_train") {
+			c.JSON(http.StatusConflict, gin.H{"error": "classifier training already running"})
+			return
+		}
+		j := jobs.Start("classifier_train", func(ctx context.Context, p *jobs.Progress) error {
+			if req.Rebuild {
+				if err := classify.Reset(gdb); err != nil {
+					return err
+				}
+			}
+			stats, err := classify.Sync(gdb)
+			p.SetResult(stats)
+			return err
+		})
+		c.JSON(http.StatusAccepted, j)
+	}
+}
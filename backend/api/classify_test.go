@@ -0,0 +1,130 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+func TestClassifierPredictions(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	prompts := map[uint]string{1: "orange cat sleeping on a sofa", 2: "dog running in a park", 3: "sunflower field at noon"}
+	for id, p := range prompts {
+		require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", id).Update("prompt", p).Error)
+	}
+	add := func(name, prompt string, tags ...string) uint {
+		img := db.Image{Path: name + ".png", FileName: name, Ext: "png", SizeBytes: 1, SHA256: name, Prompt: &prompt}
+		require.NoError(t, gdb.Create(&img).Error)
+		if len(tags) > 0 {
+			body, _ := json.Marshal(map[string]any{"tags": tags})
+			w := doJSON(r, http.MethodPost, fmt.Sprintf("/api/images/%d/tags", img.ID), string(body))
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		}
+		return img.ID
+	}
+	add("c2", "cat with orange fur, whiskers", "cat")
+	add("c3", "grey cat on a windowsill, whiskers", "cat")
+	add("d2", "dog with a ball, park", "dog")
+	add("d3", "dog swimming in a lake", "dog")
+	for _, n := range []string{"n1", "n2", "n3"} {
+		id := add(n, "nude figure study, boudoir lighting")
+		w := doJSON(r, http.MethodPut, fmt.Sprintf("/api/images/%d/metadata", id), `{"nsfw":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	// Sending an unchanged flag does not make it hand-set, so mark the
+	// safe examples directly.
+	s := add("s1", "mountain lake at dawn")
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id IN ?", []uint{1, 3, s}).Update("nsfw_manual", true).Error)
+
+	predict := func(id uint) (map[string]float64, *float64) {
+		w := doJSON(r, http.MethodGet, fmt.Sprintf("/api/images/%d", id), "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			FileName        string   `json:"fileName"`
+			NSFWProbability *float64 `json:"nsfwProbability"`
+			SuggestedTags   []struct {
+				Tag        string  `json:"tag"`
+				Confidence float64 `json:"confidence"`
+			} `json:"suggestedTags"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotEmpty(t, resp.FileName)
+		tags := map[string]float64{}
+		for _, s := range resp.SuggestedTags {
+			tags[s.Tag] = s.Confidence
+		}
+		return tags, resp.NSFWProbability
+	}
+
+	train := func() {
+		w := doJSON(r, http.MethodPost, "/api/classifier/train", "")
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		require.Equal(t, "done", waitJob(t, r, w.Body.Bytes())["status"])
+	}
+
+	// Reading an image predicts from the model as trained; it never trains.
+	id := add("q1", "fluffy cat with whiskers")
+	tags, _ := predict(id)
+	require.Empty(t, tags)
+	var docs int64
+	require.NoError(t, gdb.Model(&db.ClassifierDoc{}).Count(&docs).Error)
+	require.Zero(t, docs)
+
+	train()
+	tags, p := predict(id)
+	require.Contains(t, tags, "cat")
+	require.Greater(t, tags["cat"], 0.5)
+	require.NotContains(t, tags, "dog")
+	require.NotNil(t, p)
+	require.Less(t, *p, 0.5)
+
+	// Tags the image already has are not suggested.
+	tags, _ = predict(1)
+	require.NotContains(t, tags, "cat")
+
+	id = add("q2", "nude study in boudoir lighting")
+	train()
+	_, p = predict(id)
+	require.NotNil(t, p)
+	require.Greater(t, *p, 0.9)
+
+	// Reclassifying uses the classifier like an import does, not only the
+	// policy's words.
+	q3 := add("q3", "figure study, boudoir lighting")
+	w := doJSON(r, http.MethodPost, "/api/nsfw/reclassify", `{"dryRun":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), fmt.Sprintf(`{"id":%d,"nsfw":true}`, q3))
+
+	// A rebuild retrains every image from scratch.
+	w = doJSON(r, http.MethodPost, "/api/classifier/train", `{"rebuild":true}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	j := waitJob(t, r, w.Body.Bytes())
+	require.Equal(t, "done", j["status"])
+	require.Equal(t, map[string]any{"trained": float64(14), "forgotten": float64(0)}, j["result"])
+
+	// Training is incremental: only changed images are revisited.
+	require.NoError(t, gdb.Delete(&db.Image{}, id).Error)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 3).Updates(map[string]any{
+		"nsfw": true, "version": gorm.Expr("version + 1"),
+	}).Error)
+	w = doJSON(r, http.MethodPost, "/api/classifier/train", "")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	j = waitJob(t, r, w.Body.Bytes())
+	require.Equal(t, map[string]any{"trained": float64(1), "forgotten": float64(1)}, j["result"])
+}
+
+func TestClassifierNeedsExamples(t *testing.T) {
+	r, _, _ := setupRouterDB(t)
+	w := doJSON(r, http.MethodGet, "/api/images/1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Nil(t, resp["nsfwProbability"])
+	require.Equal(t, []any{}, resp["suggestedTags"])
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// errVersionConflict reports that an If-Match precondition did not match the
+// image's current version.
+var errVersionConflict = errors.New("image was modified")
+
+// imageETag formats an image version as a strong entity tag.
+func imageETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parseIfMatch returns the versions listed in an If-Match header and whether
+// it is the "*" wildcard. Weak tags never match, as If-Match requires strong
+// comparison.
+func parseIfMatch(h string) (versions []int, wildcard bool) {
+	for _, tag := range strings.Split(h, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil, true
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if v, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return versions, false
+}
+
+// bumpVersion increments an image's version as the first write of a
+// mutating transaction, so the If-Match check and the edit it guards commit
+// atomically. ifMatch is the request's If-Match header, empty when absent.
+// It returns gorm.ErrRecordNotFound for a missing image and
+// errVersionConflict when ifMatch does not match.
+func bumpVersion(tx *gorm.DB, id any, ifMatch string) error {
+	q := tx.Model(&db.Image{}).Where("id = ?", id)
+	if ifMatch != "" {
+		if versions, wildcard := parseIfMatch(ifMatch); !wildcard {
+			if len(versions) == 0 {
+				versions = []int{-1}
+			}
+			q = q.Where("version IN ?", versions)
+		}
+	}
+	res := q.UpdateColumn("version", gorm.Expr("version + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+	var n int64
+	if err := tx.Model(&db.Image{}).Where("id = ?", id).Count(&n).Error; err != nil {
+		return err
+	}
+	if n == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return errVersionConflict
+}
+
+// respondVersionConflict answers a failed If-Match with 412 and the image's
+// current state so the client can merge and retry. The state of a hidden
+// image is left out while the vault is locked.
+func respondVersionConflict(c *gin.Context, gdb *gorm.DB, id any) {
+	m, err := loadImage(gdb, id)
+	if err != nil || (m.Hidden && !vaultUnlocked(c)) {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": errVersionConflict.Error()})
+		return
+	}
+	c.Header("ETag", imageETag(m.Version))
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": errVersionConflict.Error(), "current": m})
+}
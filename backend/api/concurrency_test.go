@@ -0,0 +1,77 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestImageOptimisticConcurrency(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+
+	send := func(method, url, body, ifMatch string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodGet, "/api/images/1", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	first := w.Header().Get("ETag")
+	require.Equal(t, `"1"`, first)
+
+	// Browser A saves a rating against the version it loaded.
+	w = send(http.MethodPut, "/api/images/1/metadata", `{"rating":3}`, first)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	second := w.Header().Get("ETag")
+	require.Equal(t, `"2"`, second)
+
+	// Browser B still holds the first version and is rejected with the
+	// current state.
+	for _, tc := range []struct{ method, url, body string }{
+		{http.MethodPut, "/api/images/1/metadata", `{"rating":5}`},
+		{http.MethodPost, "/api/images/1/tags", `{"tags":["stale"]}`},
+		{http.MethodDelete, "/api/images/1/tags", `{"tags":["cat"]}`},
+		{http.MethodDelete, "/api/images/1", ``},
+	} {
+		w = send(tc.method, tc.url, tc.body, first)
+		require.Equal(t, http.StatusPreconditionFailed, w.Code, tc.method+" "+tc.url)
+		require.Equal(t, second, w.Header().Get("ETag"))
+		var resp struct {
+			Current db.Image `json:"current"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, 3, resp.Current.Rating)
+		require.Equal(t, 2, resp.Current.Version)
+	}
+
+	var img db.Image
+	require.NoError(t, gdb.Preload("Tags").First(&img, 1).Error)
+	require.Equal(t, 3, img.Rating)
+	require.Len(t, img.Tags, 2)
+
+	// Tag edits increment the version too.
+	w = send(http.MethodPost, "/api/images/1/tags", `{"tags":["fresh"]}`, second)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"3"`, w.Header().Get("ETag"))
+	w = send(http.MethodDelete, "/api/images/1/tags", `{"tags":["fresh"]}`, `"7", "3"`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"4"`, w.Header().Get("ETag"))
+
+	// Weak tags never satisfy If-Match; "*" and a missing header always do.
+	require.Equal(t, http.StatusPreconditionFailed, send(http.MethodPut, "/api/images/1/metadata", `{"rating":1}`, `W/"4"`).Code)
+	require.Equal(t, http.StatusOK, send(http.MethodPut, "/api/images/1/metadata", `{"rating":1}`, `*`).Code)
+	require.Equal(t, http.StatusOK, send(http.MethodPut, "/api/images/1/metadata", `{"rating":2}`, "").Code)
+	require.Equal(t, http.StatusNotFound, send(http.MethodPut, "/api/images/99/metadata", `{"rating":2}`, `"1"`).Code)
+}
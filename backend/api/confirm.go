@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// confirmTTL is how long a confirmation token stays valid.
+const confirmTTL = 5 * time.Minute
+
+// confirmations holds the outstanding tokens, keyed by token, with the scope
+// they were issued for and their expiry.
+var confirmations = struct {
+	sync.Mutex
+	tokens map[string]confirmation
+}{tokens: map[string]confirmation{}}
+
+type confirmation struct {
+	scope   string
+	expires time.Time
+}
+
+// confirmScope identifies a destructive operation by its action and target
+// ids, so a token only confirms the exact set it was previewed with.
+func confirmScope(action string, ids []uint) string {
+	sorted := slices.Clone(ids)
+	slices.Sort(sorted)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%v", action, sorted)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// issueConfirmation returns a new single-use token for scope.
+func issueConfirmation(scope string) (string, time.Time, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(raw)
+	exp := time.Now().Add(confirmTTL)
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	for t, cf := range confirmations.tokens {
+		if time.Now().After(cf.expires) {
+			delete(confirmations.tokens, t)
+		}
+	}
+	confirmations.tokens[token] = confirmation{scope: scope, expires: exp}
+	return token, exp, nil
+}
+
+// consumeConfirmation reports whether token was issued for scope and is
+// still valid. A token is spent by any attempt to use it.
+func consumeConfirmation(token, scope string) bool {
+	confirmations.Lock()
+	defer confirmations.Unlock()
+	cf, ok := confirmations.tokens[token]
+	delete(confirmations.tokens, token)
+	return ok && cf.scope == scope && time.Now().Before(cf.expires)
+}
+
+// previewWithToken adds a fresh token for scope to a preview response.
+func previewWithToken(preview gin.H, scope string) (gin.H, error) {
+	token, exp, err := issueConfirmation(scope)
+	if err != nil {
+		return nil, err
+	}
+	preview["token"] = token
+	preview["expiresAt"] = exp
+	return preview, nil
+}
+
+// confirmed checks the token sent with a destructive request. Without a
+// token it answers 428 with the preview and a token to confirm it; a wrong,
+// spent or expired token is refused with 400. It reports whether the
+// operation may proceed.
+func confirmed(c *gin.Context, token, scope string, preview gin.H) bool {
+	if token == "" {
+		resp, err := previewWithToken(preview, scope)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		resp["error"] = "confirmation required"
+		c.JSON(http.StatusPreconditionRequired, resp)
+		return false
+	}
+	if !consumeConfirmation(token, scope) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return false
+	}
+	return true
+}
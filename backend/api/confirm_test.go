@@ -0,0 +1,90 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/api"
+	"gen-library/backend/db"
+)
+
+// confirmToken returns the confirmation token of a preview response.
+func confirmToken(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	require.Contains(t, []int{http.StatusOK, http.StatusPreconditionRequired}, w.Code, w.Body.String())
+	var resp struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotEmpty(t, resp.Token)
+	return resp.Token
+}
+
+func TestConfirmHardDelete(t *testing.T) {
+	root := t.TempDir()
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	api.SetTrashDir(t.TempDir())
+	t.Cleanup(func() { api.SetTrashDir("") })
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(name), 0o644))
+		require.NoError(t, gdb.Create(&db.Image{Path: name, FileName: name, Ext: "png", SizeBytes: 5, SHA256: name}).Error)
+	}
+	r := newRouter(gdb)
+
+	// Without a token the image is only previewed.
+	w := doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", "")
+	require.Equal(t, http.StatusPreconditionRequired, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"fileName":"a.png"`)
+	token := confirmToken(t, w)
+	require.FileExists(t, filepath.Join(root, "a.png"))
+
+	// The id is not a token, and a token only confirms what it previewed.
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", `{"token":"1"}`).Code)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodDelete, "/api/images/2?mode=hard", `{"token":"`+token+`"}`).Code)
+	// A token is spent by any attempt, so the one above is gone.
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", `{"token":"`+token+`"}`).Code)
+
+	token = confirmToken(t, doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", ""))
+	w = doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", `{"token":"`+token+`"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoFileExists(t, filepath.Join(root, "a.png"))
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/images/1?mode=hard", `{"token":"`+token+`"}`).Code)
+
+	// A bulk token is bound to the matched ids.
+	w = doJSON(r, http.MethodPost, "/api/images/bulk", `{"ids":[2],"actions":{"delete":"hard"}}`)
+	require.Equal(t, http.StatusPreconditionRequired, w.Code, w.Body.String())
+	token = confirmToken(t, w)
+	w = doJSON(r, http.MethodPost, "/api/images/bulk", `{"ids":[2,3],"actions":{"delete":"hard"},"token":"`+token+`"}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Trashing needs no confirmation but is audited like deletes.
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/images/2", "").Code)
+
+	w = doJSON(r, http.MethodGet, "/api/audit", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var log struct {
+		Total int `json:"total"`
+		Items []struct {
+			Action  string         `json:"action"`
+			ImageID uint           `json:"imageId"`
+			Detail  map[string]any `json:"detail"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &log))
+	require.Equal(t, 2, log.Total)
+	require.Equal(t, "image.trash", log.Items[0].Action)
+	require.EqualValues(t, 2, log.Items[0].ImageID)
+	require.Equal(t, "image.delete", log.Items[1].Action)
+	require.Equal(t, "a.png", log.Items[1].Detail["path"])
+
+	w = doJSON(r, http.MethodGet, "/api/audit?action=image.delete&imageId=1", "")
+	require.Contains(t, w.Body.String(), `"total":1`)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodGet, "/api/audit?imageId=x", "").Code)
+}
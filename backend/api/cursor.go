@@ -0,0 +1,204 @@
+package api
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// listCursor is the decoded form of the opaque cursor returned by listImages.
+// It records the sort it was issued for together with the sort key value and
+// id of the last row on the page.
+type listCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Seed  int64  `json:"r,omitempty"`
+	Type  string `json:"t"` // null|int|float|string|time
+	Value string `json:"v,omitempty"`
+	ID    uint   `json:"id"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func encodeCursor(cur listCursor) string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses an opaque cursor and checks that it was issued for the
+// requested sort. A random sort whose seed was generated continues with the
+// cursor's seed.
+func decodeCursor(s string, sort *imageSort) (listCursor, error) {
+	var cur listCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, errInvalidCursor
+	}
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return cur, errInvalidCursor
+	}
+	if sort.generated && cur.Sort == sort.Key {
+		sort.Seed = cur.Seed
+	}
+	if cur.Sort != sort.Key || cur.Order != sort.Order || cur.Seed != sort.Seed {
+		return cur, fmt.Errorf("cursor does not match sort")
+	}
+	return cur, nil
+}
+
+// cursorFor builds the cursor pointing just past the image with the given
+// id, whose sort key v was selected along with the page.
+func cursorFor(sort imageSort, id uint, v any) (string, error) {
+	cur := listCursor{Sort: sort.Key, Order: sort.Order, Seed: sort.Seed, ID: id}
+	switch val := v.(type) {
+	case nil:
+		cur.Type = "null"
+	case int64:
+		cur.Type, cur.Value = "int", fmt.Sprint(val)
+	case float64:
+		cur.Type, cur.Value = "float", fmt.Sprint(val)
+	case time.Time:
+		cur.Type, cur.Value = "time", val.Format(time.RFC3339Nano)
+	case []byte:
+		cur.Type, cur.Value = "string", string(val)
+	case string:
+		cur.Type, cur.Value = "string", val
+	default:
+		return "", fmt.Errorf("unsupported sort value %T", v)
+	}
+	return encodeCursor(cur), nil
+}
+
+// sortKey holds the raw sort value of a listed row as the driver returns it.
+type sortKey struct{ v any }
+
+func (k *sortKey) Scan(src any) error {
+	k.v = src
+	return nil
+}
+
+func (k sortKey) Value() (driver.Value, error) { return k.v, nil }
+
+// value converts the cursor's sort key back into a query argument.
+func (cur listCursor) value() (any, error) {
+	var (
+		v   any
+		err error
+	)
+	switch cur.Type {
+	case "null":
+		return nil, nil
+	case "int":
+		var n int64
+		_, err = fmt.Sscan(cur.Value, &n)
+		v = n
+	case "float":
+		var f float64
+		_, err = fmt.Sscan(cur.Value, &f)
+		v = f
+	case "time":
+		v, err = time.Parse(time.RFC3339Nano, cur.Value)
+	case "string":
+		v = cur.Value
+	default:
+		err = errInvalidCursor
+	}
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return v, nil
+}
+
+// after restricts img to rows strictly after the cursor in sort order.
+// SQLite sorts NULLs first ascending and last descending, which the
+// conditions below mirror so nullable sort keys page correctly.
+func (cur listCursor) after(img *gorm.DB, sort imageSort) (*gorm.DB, error) {
+	v, err := cur.value()
+	if err != nil {
+		return nil, err
+	}
+	expr := sort.expr()
+	desc := sort.Order == "desc"
+	switch {
+	case v == nil && desc:
+		return img.Where(expr+" IS NULL AND images.id < ?", cur.ID), nil
+	case v == nil:
+		return img.Where("(("+expr+" IS NULL AND images.id > ?) OR "+expr+" IS NOT NULL)", cur.ID), nil
+	case desc:
+		return img.Where("(("+expr+" < ?) OR ("+expr+" = ? AND images.id < ?) OR "+expr+" IS NULL)", v, v, cur.ID), nil
+	default:
+		return img.Where("(("+expr+" > ?) OR ("+expr+" = ? AND images.id > ?))", v, v, cur.ID), nil
+	}
+}
+
+// approxCounts caches listing totals for count=approx so infinite scroll does
+// not pay for a COUNT(*) on every page. Expired entries are dropped on
+// write and the cache holds at most maxApproxCounts filters.
+var approxCounts = struct {
+	sync.Mutex
+	entries map[string]approxCount
+}{entries: map[string]approxCount{}}
+
+type approxCount struct {
+	total int64
+	at    time.Time
+}
+
+const (
+	approxCountTTL  = 30 * time.Second
+	maxApproxCounts = 256
+)
+
+// countApprox returns a cached total for key, running count when the cached
+// value is missing or stale.
+func countApprox(key string, count func() (int64, error)) (int64, error) {
+	approxCounts.Lock()
+	e, ok := approxCounts.entries[key]
+	approxCounts.Unlock()
+	if ok && time.Since(e.at) < approxCountTTL {
+		return e.total, nil
+	}
+	total, err := count()
+	if err != nil {
+		return 0, err
+	}
+	approxCounts.Lock()
+	defer approxCounts.Unlock()
+	now := time.Now()
+	var oldest string
+	for k, e := range approxCounts.entries {
+		if now.Sub(e.at) >= approxCountTTL {
+			delete(approxCounts.entries, k)
+		} else if oldest == "" || e.at.Before(approxCounts.entries[oldest].at) {
+			oldest = k
+		}
+	}
+	if _, ok := approxCounts.entries[key]; !ok && len(approxCounts.entries) >= maxApproxCounts {
+		delete(approxCounts.entries, oldest)
+	}
+	approxCounts.entries[key] = approxCount{total: total, at: now}
+	return total, nil
+}
+
+// countKey normalizes the filter parameters of a listing request so requests
+// for different pages share the same cached count.
+func countKey(q map[string][]string) string {
+	var parts []string
+	for k, vs := range q {
+		switch k {
+		case "page", "pageSize", "cursor", "count", "sort", "order", "seed":
+			continue
+		}
+		parts = append(parts, k+"="+strings.Join(vs, ","))
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, "&")
+}
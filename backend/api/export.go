@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// exportBatch is how many images are loaded at a time while exporting.
+const exportBatch = 500
+
+// exportRow is the exported metadata of one image.
+type exportRow struct {
+	ID             uint           `json:"id"`
+	Path           string         `json:"path"`
+	FileName       string         `json:"fileName"`
+	Width          *int           `json:"width"`
+	Height         *int           `json:"height"`
+	Model          *string        `json:"model"`
+	Prompt         *string        `json:"prompt"`
+	NegativePrompt *string        `json:"negativePrompt"`
+	Sampler        *string        `json:"sampler"`
+	Steps          *int           `json:"steps"`
+	CFGScale       *float64       `json:"cfgScale"`
+	Seed           *string        `json:"seed"`
+	Rating         int            `json:"rating"`
+	Favorite       bool           `json:"favorite"`
+	NSFW           bool           `json:"nsfw"`
+	Tags           []string       `json:"tags"`
+	Loras          []string       `json:"loras"`
+	Notes          *string        `json:"notes"`
+	Fields         map[string]any `json:"fields"`
+}
+
+var exportColumns = []string{
+	"id", "path", "fileName", "width", "height", "model", "prompt", "negativePrompt",
+	"sampler", "steps", "cfgScale", "seed", "rating", "favorite", "nsfw", "tags", "loras", "notes",
+}
+
+// newExportRow builds the row of an image and its custom field values.
+func newExportRow(m db.Image, fields map[string]any) exportRow {
+	r := exportRow{
+		ID: m.ID, Path: m.Path, FileName: m.FileName, Width: m.Width, Height: m.Height,
+		Prompt: m.Prompt, NegativePrompt: m.NegativePrompt, Sampler: m.Sampler, Steps: m.Steps,
+		CFGScale: m.CFGScale, Seed: m.Seed, Rating: m.Rating, Favorite: m.Favorite, NSFW: m.NSFW,
+		Tags: []string{}, Loras: []string{}, Notes: m.Notes, Fields: fields,
+	}
+	if r.Fields == nil {
+		r.Fields = map[string]any{}
+	}
+	if m.Model != nil {
+		r.Model = &m.Model.Name
+	}
+	for _, t := range m.Tags {
+		r.Tags = append(r.Tags, t.Name)
+	}
+	for _, l := range m.Loras {
+		r.Loras = append(r.Loras, l.Name)
+	}
+	return r
+}
+
+// record formats the row for CSV, leaving missing values empty and joining
+// lists with commas. Custom field values follow in the order of fields.
+func (r exportRow) record(fields []string) []string {
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	num := func(n *int) string {
+		if n == nil {
+			return ""
+		}
+		return strconv.Itoa(*n)
+	}
+	cfg := ""
+	if r.CFGScale != nil {
+		cfg = strconv.FormatFloat(*r.CFGScale, 'f', -1, 64)
+	}
+	rec := []string{
+		strconv.FormatUint(uint64(r.ID), 10), r.Path, r.FileName, num(r.Width), num(r.Height),
+		str(r.Model), str(r.Prompt), str(r.NegativePrompt), str(r.Sampler), num(r.Steps), cfg,
+		str(r.Seed), strconv.Itoa(r.Rating), strconv.FormatBool(r.Favorite), strconv.FormatBool(r.NSFW),
+		strings.Join(r.Tags, ", "), strings.Join(r.Loras, ", "), str(r.Notes),
+	}
+	for _, name := range fields {
+		rec = append(rec, formatFieldValue(r.Fields[name]))
+	}
+	return rec
+}
+
+// exportImages streams the metadata of the images matching the listImages
+// filters, or a saved search, in listing order. format is json (default) or
+// csv; CSV has a field.<name> column per custom field.
+func exportImages(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, ok := listQuery(c, gdb)
+		if !ok {
+			return
+		}
+		filter, err := parseImageFilter(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkHiddenFilter(c, filter) {
+			return
+		}
+		format := strings.ToLower(c.DefaultQuery("format", "json"))
+		if format != "json" && format != "csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid format"})
+			return
+		}
+		sort := parseImageSort(query)
+		var ids []uint
+		img := gdb.Table("images").Joins("LEFT JOIN models ON images.model_id = models.id")
+		if err := filter.apply(gdb, img).Order(sort.orderClause()).Pluck("images.id", &ids).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var fields []string
+		if format == "csv" {
+			if err := gdb.Model(&db.CustomField{}).Order("name").Pluck("name", &fields).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.Header("Content-Disposition", `attachment; filename="images.`+format+`"`)
+		var (
+			cw    *csv.Writer
+			enc   *json.Encoder
+			first = true
+		)
+		if format == "csv" {
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			cw = csv.NewWriter(c.Writer)
+			header := slices.Clone(exportColumns)
+			for _, name := range fields {
+				header = append(header, "field."+name)
+			}
+			_ = cw.Write(header)
+		} else {
+			c.Header("Content-Type", "application/json; charset=utf-8")
+			enc = json.NewEncoder(c.Writer)
+			_, _ = c.Writer.WriteString("[")
+		}
+		c.Status(http.StatusOK)
+		// Headers are sent by now, so a failure can only cut the export short.
+		for start := 0; start < len(ids); start += exportBatch {
+			batch := ids[start:min(start+exportBatch, len(ids))]
+			var images []db.Image
+			if err := gdb.Preload("Tags").Preload("Model").Preload("Loras").Where("id IN ?", batch).Find(&images).Error; err != nil {
+				_ = c.Error(err)
+				return
+			}
+			values, err := loadFieldValues(gdb, batch)
+			if err != nil {
+				_ = c.Error(err)
+				return
+			}
+			byID := make(map[uint]db.Image, len(images))
+			for _, m := range images {
+				byID[m.ID] = m
+			}
+			for _, id := range batch {
+				m, ok := byID[id]
+				if !ok {
+					continue
+				}
+				row := newExportRow(m, values[id])
+				if cw != nil {
+					_ = cw.Write(row.record(fields))
+					continue
+				}
+				if !first {
+					_, _ = c.Writer.WriteString(",")
+				}
+				first = false
+				_ = enc.Encode(row)
+			}
+			if cw != nil {
+				cw.Flush()
+			}
+		}
+		if enc != nil {
+			_, _ = c.Writer.WriteString("]\n")
+		}
+	}
+}
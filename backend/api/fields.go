@@ -0,0 +1,365 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// fieldNamePattern keeps custom field names usable as JSON keys and in
+// field.<name> filter parameters.
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+var fieldTypes = []string{db.FieldText, db.FieldNumber, db.FieldDate, db.FieldSelect}
+
+// fieldRequest is the body of custom field create and update requests. The
+// type is fixed once a field is created; on update, omitted fields are left
+// unchanged.
+type fieldRequest struct {
+	Name    *string   `json:"name"`
+	Type    *string   `json:"type"`
+	Options *[]string `json:"options"`
+}
+
+// bindField decodes and validates a custom field request, writing a 400
+// response on failure.
+func bindField(c *gin.Context) (fieldRequest, bool) {
+	var req fieldRequest
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	fields := fieldErrors{}
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if !fieldNamePattern.MatchString(*req.Name) {
+			fields["name"] = "must start with a letter and contain only letters, digits and underscores"
+		}
+	}
+	if req.Type != nil && !inSet(*req.Type, fieldTypes) {
+		fields["type"] = "must be one of " + strings.Join(fieldTypes, ", ")
+	}
+	if req.Options != nil {
+		seen := map[string]bool{}
+		opts := make([]string, 0, len(*req.Options))
+		for _, o := range *req.Options {
+			o = strings.TrimSpace(o)
+			if o == "" {
+				fields["options"] = "must not contain empty values"
+				break
+			}
+			if !seen[o] {
+				seen[o] = true
+				opts = append(opts, o)
+			}
+		}
+		*req.Options = opts
+	}
+	if len(fields) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid field", "fields": fields})
+		return req, false
+	}
+	return req, true
+}
+
+// fieldNameTaken reports whether another custom field already uses name,
+// writing a 409 response if so.
+func fieldNameTaken(c *gin.Context, gdb *gorm.DB, name string, id uint) bool {
+	var n int64
+	if err := gdb.Model(&db.CustomField{}).Where("name = ? AND id <> ?", name, id).Count(&n).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a field with that name exists"})
+		return true
+	}
+	return false
+}
+
+// listFields returns the custom field definitions ordered by name.
+func listFields(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		items := []db.CustomField{}
+		if err := gdb.Order("name").Find(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+func createField(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindField(c)
+		if !ok {
+			return
+		}
+		fields := fieldErrors{}
+		if req.Name == nil {
+			fields["name"] = "is required"
+		}
+		if req.Type == nil {
+			fields["type"] = "is required"
+		} else if *req.Type == db.FieldSelect && (req.Options == nil || len(*req.Options) == 0) {
+			fields["options"] = "is required for select fields"
+		} else if *req.Type != db.FieldSelect && req.Options != nil && len(*req.Options) > 0 {
+			fields["options"] = "only select fields have options"
+		}
+		if len(fields) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid field", "fields": fields})
+			return
+		}
+		if fieldNameTaken(c, gdb, *req.Name, 0) {
+			return
+		}
+		f := db.CustomField{Name: *req.Name, Type: *req.Type, Options: []string{}}
+		if req.Options != nil {
+			f.Options = *req.Options
+		}
+		if err := gdb.Create(&f).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, f)
+	}
+}
+
+// updateField renames a custom field or replaces the options of a select
+// field. Options still used by an image cannot be removed.
+func updateField(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var f db.CustomField
+		if err := gdb.First(&f, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		req, ok := bindField(c)
+		if !ok {
+			return
+		}
+		fields := fieldErrors{}
+		if req.Type != nil && *req.Type != f.Type {
+			fields["type"] = "cannot be changed"
+		}
+		if req.Options != nil && f.Type != db.FieldSelect {
+			fields["options"] = "only select fields have options"
+		} else if req.Options != nil && len(*req.Options) == 0 {
+			fields["options"] = "is required for select fields"
+		}
+		if len(fields) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid field", "fields": fields})
+			return
+		}
+		if req.Name != nil {
+			if fieldNameTaken(c, gdb, *req.Name, f.ID) {
+				return
+			}
+			f.Name = *req.Name
+		}
+		if req.Options != nil {
+			var used []string
+			if err := gdb.Table("image_field_values").Where("field_id = ? AND value NOT IN ?", f.ID, *req.Options).
+				Distinct().Order("value").Pluck("value", &used).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if len(used) > 0 {
+				c.JSON(http.StatusConflict, gin.H{"error": "options are still in use", "options": used})
+				return
+			}
+			f.Options = *req.Options
+		}
+		if err := gdb.Save(&f).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, f)
+	}
+}
+
+// deleteField removes a custom field along with its value on every image.
+func deleteField(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := gdb.Delete(&db.CustomField{}, c.Param("id"))
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// loadFieldValues returns the custom field values of the given images,
+// keyed by image id and field name. Numbers come back as float64 and the
+// other types as strings.
+func loadFieldValues(tx *gorm.DB, ids []uint) (map[uint]map[string]any, error) {
+	out := map[uint]map[string]any{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	rows, err := tx.Raw(`SELECT v.image_id, f.name, v.value FROM image_field_values v
+		JOIN custom_fields f ON f.id = v.field_id WHERE v.image_id IN ?`, ids).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    uint
+			name  string
+			value any
+		)
+		if err := rows.Scan(&id, &name, &value); err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case []byte:
+			value = string(v)
+		case int64:
+			value = float64(v)
+		}
+		if out[id] == nil {
+			out[id] = map[string]any{}
+		}
+		out[id][name] = value
+	}
+	return out, rows.Err()
+}
+
+// fieldValue checks a JSON value against a field's type and returns it as
+// stored.
+func fieldValue(f db.CustomField, raw json.RawMessage) (any, error) {
+	switch f.Type {
+	case db.FieldNumber:
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return n, nil
+	case db.FieldDate:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, errors.New("must be a YYYY-MM-DD date")
+		}
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			return nil, errors.New("must be a YYYY-MM-DD date")
+		}
+		return s, nil
+	case db.FieldSelect:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || !slices.Contains(f.Options, s) {
+			return nil, errors.New("must be one of the field's options")
+		}
+		return s, nil
+	default:
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		return s, nil
+	}
+}
+
+// applyFieldValues sets custom field values on an image, keyed by field
+// name. A null value clears the field. Unknown fields and invalid values
+// are reported as fields.<name> errors.
+func applyFieldValues(tx *gorm.DB, id uint, values map[string]json.RawMessage) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	var defs []db.CustomField
+	if err := tx.Where("name IN ?", names).Find(&defs).Error; err != nil {
+		return err
+	}
+	byName := make(map[string]db.CustomField, len(defs))
+	for _, f := range defs {
+		byName[f.Name] = f
+	}
+	errs := fieldErrors{}
+	for _, name := range names {
+		key := "fields." + name
+		f, ok := byName[name]
+		if !ok {
+			errs[key] = "unknown field"
+			continue
+		}
+		raw := values[name]
+		if raw == nil || string(raw) == "null" {
+			if err := tx.Exec(`DELETE FROM image_field_values WHERE image_id = ? AND field_id = ?`, id, f.ID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := fieldValue(f, raw)
+		if err != nil {
+			errs[key] = err.Error()
+			continue
+		}
+		if err := tx.Exec(`INSERT INTO image_field_values (image_id, field_id, value) VALUES (?, ?, ?)
+			ON CONFLICT(image_id, field_id) DO UPDATE SET value = excluded.value`, id, f.ID, v).Error; err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// mergeFieldValues returns the custom field values of an image, as JSON,
+// after values are applied over current.
+func mergeFieldValues(current json.RawMessage, values map[string]json.RawMessage) (json.RawMessage, error) {
+	merged := map[string]json.RawMessage{}
+	if current != nil {
+		if err := json.Unmarshal(current, &merged); err != nil {
+			return nil, err
+		}
+	}
+	for name, v := range values {
+		if v == nil || string(v) == "null" {
+			delete(merged, name)
+		} else {
+			merged[name] = v
+		}
+	}
+	if len(merged) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	return json.Marshal(merged)
+}
+
+// formatFieldValue renders a custom field value for CSV export.
+func formatFieldValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,131 @@
+package api_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCustomFields(t *testing.T) {
+	r, _, hasFTS := setupRouterDB(t)
+
+	for _, body := range []string{
+		`{"name":"has space","type":"text"}`,
+		`{"name":"x","type":"color"}`,
+		`{"name":"x","type":"select"}`,
+		`{"name":"x","type":"text","options":["a"]}`,
+		`{"type":"text"}`,
+	} {
+		require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/fields", body).Code, body)
+	}
+	for _, body := range []string{
+		`{"name":"project","type":"select","options":["alpha","beta"]}`,
+		`{"name":"delivered","type":"date"}`,
+		`{"name":"license","type":"text"}`,
+		`{"name":"budget","type":"number"}`,
+	} {
+		w := doJSON(r, http.MethodPost, "/api/fields", body)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	}
+	require.Equal(t, http.StatusConflict, doJSON(r, http.MethodPost, "/api/fields", `{"name":"budget","type":"text"}`).Code)
+
+	w := doJSON(r, http.MethodPut, "/api/images/1/metadata", `{"fields":{"project":"gamma","delivered":"June","budget":"a lot","nope":"x"}}`)
+	require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+	var ferrs struct {
+		Fields map[string]string `json:"fields"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ferrs))
+	require.Equal(t, "must be one of the field's options", ferrs.Fields["fields.project"])
+	require.Equal(t, "must be a YYYY-MM-DD date", ferrs.Fields["fields.delivered"])
+	require.Equal(t, "must be a number", ferrs.Fields["fields.budget"])
+	require.Equal(t, "unknown field", ferrs.Fields["fields.nope"])
+
+	w = doJSON(r, http.MethodPut, "/api/images/1/metadata",
+		`{"notes":"client picked this one","fields":{"project":"alpha","delivered":"2026-06-01","license":"CC-BY zebra","budget":250}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var img struct {
+		Notes  *string        `json:"notes"`
+		Fields map[string]any `json:"fields"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	require.Equal(t, "client picked this one", *img.Notes)
+	require.Equal(t, map[string]any{"project": "alpha", "delivered": "2026-06-01", "license": "CC-BY zebra", "budget": 250.0}, img.Fields)
+
+	// Fields left out keep their value; null clears one.
+	w = doJSON(r, http.MethodPut, "/api/images/2/metadata", `{"nsfw":false,"fields":{"project":"beta","budget":90,"delivered":"2026-07-15"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doJSON(r, http.MethodPut, "/api/images/2/metadata", `{"fields":{"delivered":null}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	img.Fields = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	require.Equal(t, map[string]any{"project": "beta", "budget": 90.0}, img.Fields)
+
+	require.Equal(t, []string{"cat"}, getFileNames(t, r, "/api/images?field.project=ALPHA"))
+	require.Equal(t, []string{"dog", "cat"}, getFileNames(t, r, "/api/images?field.project=alpha,beta"))
+	require.Equal(t, []string{"cat"}, getFileNames(t, r, "/api/images?field.budget.min=100"))
+	require.Equal(t, []string{"dog"}, getFileNames(t, r, "/api/images?field.budget=90"))
+	require.Equal(t, []string{"cat"}, getFileNames(t, r, "/api/images?field.delivered.max=2026-06-30"))
+	require.Empty(t, getFileNames(t, r, "/api/images?field.project=alpha&field.budget.max=100"))
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodGet, "/api/images?field.budget.avg=1", "").Code)
+	if hasFTS {
+		require.Equal(t, []string{"cat"}, getFileNames(t, r, "/api/images?q=zebra"))
+		require.Equal(t, []string{"cat"}, getFileNames(t, r, "/api/images?q=picked"))
+		require.Equal(t, []string{"dog"}, getFileNames(t, r, "/api/images?q=beta"))
+	}
+
+	t.Run("export", func(t *testing.T) {
+		w := doJSON(r, http.MethodGet, "/api/images/export?field.project=alpha", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var rows []struct {
+			Notes  string         `json:"notes"`
+			Fields map[string]any `json:"fields"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		require.Len(t, rows, 1)
+		require.Equal(t, "client picked this one", rows[0].Notes)
+		require.Equal(t, "alpha", rows[0].Fields["project"])
+
+		w = doJSON(r, http.MethodGet, "/api/images/export?format=csv&field.project=alpha", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		header := records[0]
+		require.Equal(t, []string{"notes", "field.budget", "field.delivered", "field.license", "field.project"}, header[len(header)-5:])
+		require.Equal(t, []string{"client picked this one", "250", "2026-06-01", "CC-BY zebra", "alpha"}, records[1][len(header)-5:])
+	})
+
+	// Options in use cannot be dropped; renaming keeps the values.
+	w = doJSON(r, http.MethodPatch, "/api/fields/1", `{"options":["alpha"]}`)
+	require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"options":["beta"]`)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPatch, "/api/fields/1", `{"type":"text"}`).Code)
+	w = doJSON(r, http.MethodPatch, "/api/fields/1", `{"name":"client","options":["alpha","beta","gamma"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, []string{"dog"}, getFileNames(t, r, "/api/images?field.client=beta"))
+
+	// Reverting restores the exact set of values.
+	w = doJSON(r, http.MethodPost, "/api/images/2/revert", `{"version":1}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NotContains(t, w.Body.String(), `"fields"`)
+
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/fields/3", "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/fields/3", "").Code)
+	if hasFTS {
+		require.Empty(t, getFileNames(t, r, "/api/images?q=zebra"))
+	}
+	w = doJSON(r, http.MethodGet, "/api/fields", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Items []struct {
+			Name string `json:"name"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Items, 3)
+	require.Equal(t, "budget", list.Items[0].Name)
+}
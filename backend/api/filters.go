@@ -0,0 +1,519 @@
+package api
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// imageFilter describes the structured filters accepted by listImages. It is
+// parsed from query parameters so the same filter can be reused by any
+// endpoint that operates on a filtered set of images.
+type imageFilter struct {
+	NSFW     string // hide|show|blur|only; blur shows NSFW rows with blurred thumbnails
+	Hidden   string // hide|show|only; show and only need an unlocked vault
+	Query    string
+	Favorite bool
+	Album    *uint
+
+	Rating    *int
+	RatingMin *int
+	RatingMax *int
+
+	Tags        []string
+	TagMode     string // all|any
+	ExcludeTags []string
+
+	Models        []string
+	Loras         []string
+	LoraWeightMin *float64
+	LoraWeightMax *float64
+	Embeddings    []string
+	Samplers      []string
+	Schedulers    []string
+	SourceApps    []string
+
+	StepsMin  *int
+	StepsMax  *int
+	CFGMin    *float64
+	CFGMax    *float64
+	WidthMin  *int
+	WidthMax  *int
+	HeightMin *int
+	HeightMax *int
+	AspectMin *float64
+	AspectMax *float64
+	SizeMin   *int64
+	SizeMax   *int64
+
+	CreatedFrom  *time.Time
+	CreatedTo    *time.Time
+	ImportedFrom *time.Time
+	ImportedTo   *time.Time
+
+	Fields []fieldFilter
+}
+
+// fieldFilter matches images by a custom field value, given as
+// field.<name>=a,b for any of the values (case-insensitive) and
+// field.<name>.min or .max for a number or date range.
+type fieldFilter struct {
+	Name   string
+	Values []string
+	Min    string
+	Max    string
+}
+
+// imageSort describes the ordering of a listing. Album is set for the
+// position sort, which orders an album's images as arranged.
+type imageSort struct {
+	Key   string
+	Order string
+	Seed  int64
+	Album uint
+	// generated is set when a random sort had no seed and got a fresh one.
+	generated bool
+}
+
+// sortColumns maps the accepted sort keys to their column on images.
+var sortColumns = map[string]string{
+	"created_time": "images.created_time",
+	"imported_at":  "images.imported_at",
+	"file_name":    "images.file_name",
+	"rating":       "images.rating",
+	"size":         "images.size_bytes",
+	"steps":        "images.steps",
+	"cfg":          "images.cfg_scale",
+}
+
+// parseImageFilter reads filter parameters from the query string. Malformed
+// numeric or date values are reported as errors naming the parameter.
+func parseImageFilter(v url.Values) (imageFilter, error) {
+	f := imageFilter{
+		NSFW:    strings.ToLower(v.Get("nsfw")),
+		Hidden:  strings.ToLower(v.Get("hidden")),
+		Query:   strings.TrimSpace(v.Get("q")),
+		TagMode: strings.ToLower(v.Get("tagMode")),
+	}
+	if !inSet(f.NSFW, []string{"hide", "show", "blur", "only"}) {
+		f.NSFW = "hide"
+	}
+	if !inSet(f.Hidden, []string{"hide", "show", "only"}) {
+		f.Hidden = "hide"
+	}
+	if f.TagMode != "any" {
+		f.TagMode = "all"
+	}
+	if fav := v.Get("favorite"); fav == "1" || strings.ToLower(fav) == "true" {
+		f.Favorite = true
+	}
+	if s := v.Get("album"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid album")
+		}
+		album := uint(id)
+		f.Album = &album
+	}
+	// An invalid exact rating has always been ignored rather than rejected.
+	if r, err := strconv.Atoi(v.Get("rating")); err == nil {
+		f.Rating = &r
+	}
+
+	f.Tags = canonicalTagNames(splitNonEmpty(v.Get("tags"), ","))
+	f.ExcludeTags = canonicalTagNames(splitNonEmpty(v.Get("excludeTags"), ","))
+	f.Models = splitNonEmpty(v.Get("model"), ",")
+	f.Loras = splitNonEmpty(v.Get("lora"), ",")
+	f.Embeddings = splitNonEmpty(v.Get("embedding"), ",")
+	f.Samplers = splitNonEmpty(v.Get("sampler"), ",")
+	f.Schedulers = splitNonEmpty(v.Get("scheduler"), ",")
+	f.SourceApps = splitNonEmpty(v.Get("sourceApp"), ",")
+
+	ints := map[string]**int{
+		"ratingMin": &f.RatingMin,
+		"ratingMax": &f.RatingMax,
+		"stepsMin":  &f.StepsMin,
+		"stepsMax":  &f.StepsMax,
+		"widthMin":  &f.WidthMin,
+		"widthMax":  &f.WidthMax,
+		"heightMin": &f.HeightMin,
+		"heightMax": &f.HeightMax,
+	}
+	for name, dst := range ints {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", name)
+		}
+		*dst = &n
+	}
+
+	floats := map[string]**float64{
+		"loraWeightMin": &f.LoraWeightMin,
+		"loraWeightMax": &f.LoraWeightMax,
+		"cfgMin":        &f.CFGMin,
+		"cfgMax":        &f.CFGMax,
+		"aspectMin":     &f.AspectMin,
+		"aspectMax":     &f.AspectMax,
+	}
+	for name, dst := range floats {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", name)
+		}
+		*dst = &n
+	}
+
+	sizes := map[string]**int64{
+		"sizeMin": &f.SizeMin,
+		"sizeMax": &f.SizeMax,
+	}
+	for name, dst := range sizes {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", name)
+		}
+		*dst = &n
+	}
+
+	dates := map[string]**time.Time{
+		"createdFrom":  &f.CreatedFrom,
+		"createdTo":    &f.CreatedTo,
+		"importedFrom": &f.ImportedFrom,
+		"importedTo":   &f.ImportedTo,
+	}
+	for name, dst := range dates {
+		s := v.Get(name)
+		if s == "" {
+			continue
+		}
+		t, err := parseDateParam(s, strings.HasSuffix(name, "To"))
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", name)
+		}
+		*dst = &t
+	}
+
+	byName := map[string]*fieldFilter{}
+	for key, vals := range v {
+		name, ok := strings.CutPrefix(key, "field.")
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		bound := ""
+		if n, b, ok := strings.Cut(name, "."); ok {
+			name, bound = n, b
+		}
+		if !fieldNamePattern.MatchString(name) || (bound != "" && bound != "min" && bound != "max") {
+			return f, fmt.Errorf("invalid %s", key)
+		}
+		ff := byName[name]
+		if ff == nil {
+			ff = &fieldFilter{Name: name}
+			byName[name] = ff
+		}
+		switch bound {
+		case "min":
+			ff.Min = vals[0]
+		case "max":
+			ff.Max = vals[0]
+		default:
+			ff.Values = splitNonEmpty(vals[0], ",")
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f.Fields = append(f.Fields, *byName[name])
+	}
+
+	return f, nil
+}
+
+// parseImageSort reads sort, order and seed from the query string, falling
+// back to the defaults for unknown values. An album listing defaults to the
+// album's own order. A random sort without a seed gets a generated one.
+func parseImageSort(v url.Values) imageSort {
+	s := imageSort{
+		Key:   v.Get("sort"),
+		Order: strings.ToLower(v.Get("order")),
+	}
+	album, _ := strconv.ParseUint(v.Get("album"), 10, 64)
+	if s.Key == "" {
+		s.Key = "imported_at"
+		if album > 0 {
+			s.Key = "position"
+		}
+	}
+	switch _, ok := sortColumns[s.Key]; {
+	case s.Key == "position" && album > 0:
+		s.Album = uint(album)
+	case !ok && s.Key != "random":
+		s.Key = "created_time"
+	}
+	if !inSet(s.Order, []string{"asc", "desc"}) {
+		s.Order = "desc"
+		if s.Key == "position" {
+			s.Order = "asc"
+		}
+	}
+	if seed, err := strconv.ParseInt(v.Get("seed"), 10, 64); err == nil {
+		// Keep the seed within 31 bits so the hash in expr cannot
+		// overflow SQLite's 64-bit integers.
+		s.Seed = seed & (1<<31 - 1)
+	} else if s.Key == "random" {
+		s.Seed, s.generated = rand.Int64N(1<<31), true
+	}
+	return s
+}
+
+// parseDateParam accepts RFC3339 timestamps or plain YYYY-MM-DD dates. A plain
+// date used as an upper bound covers the whole day.
+func parseDateParam(s string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if upper {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// apply adds the filter conditions to a query over the images table.
+// Trashed images never match.
+func (f imageFilter) apply(gdb, img *gorm.DB) *gorm.DB {
+	img = img.Where("images.deleted_at IS NULL")
+	switch f.NSFW {
+	case "hide":
+		img = img.Where("images.nsfw = 0")
+	case "only":
+		img = img.Where("images.nsfw = 1")
+	}
+	switch f.Hidden {
+	case "hide":
+		img = img.Where("images.hidden = 0")
+	case "only":
+		img = img.Where("images.hidden = 1")
+	}
+
+	// FTS join if q
+	if f.Query != "" {
+		// Allow partial keyword matches by adding a wildcard
+		terms := strings.Fields(f.Query)
+		for i, t := range terms {
+			if !strings.HasSuffix(t, "*") {
+				terms[i] = t + "*"
+			}
+		}
+		img = img.Joins("JOIN images_fts ON images_fts.rowid = images.id").Where("images_fts MATCH ?", strings.Join(terms, " "))
+	}
+
+	if f.Rating != nil {
+		img = img.Where("images.rating = ?", *f.Rating)
+	}
+	if f.RatingMin != nil {
+		img = img.Where("images.rating >= ?", *f.RatingMin)
+	}
+	if f.RatingMax != nil {
+		img = img.Where("images.rating <= ?", *f.RatingMax)
+	}
+	if f.Favorite {
+		img = img.Where("images.favorite = 1")
+	}
+	if f.Album != nil {
+		img = img.Where("images.id IN (SELECT image_id FROM album_images WHERE album_id = ?)", *f.Album)
+	}
+
+	// A tag matches images carrying it, one of its aliases or any of its
+	// descendant tags.
+	const taggedSQL = "images.id IN (SELECT image_id FROM image_tags WHERE tag_id IN (" + tagSubtreeSQL + "))"
+	if len(f.Tags) > 0 {
+		if f.TagMode == "all" {
+			for _, t := range f.Tags {
+				img = img.Where(taggedSQL, []string{t}, []string{t})
+			}
+		} else {
+			img = img.Where(taggedSQL, f.Tags, f.Tags)
+		}
+	}
+	if len(f.ExcludeTags) > 0 {
+		img = img.Not(taggedSQL, f.ExcludeTags, f.ExcludeTags)
+	}
+
+	if len(f.Models) > 0 {
+		sub := gdb.Table("models").Select("id").Where("name IN ?", f.Models)
+		img = img.Where("images.model_id IN (?)", sub)
+	}
+	// Every listed LoRA must be present; the weight range applies to each.
+	for _, name := range f.Loras {
+		sub := gdb.Table("image_loras il").
+			Select("il.image_id").
+			Joins("JOIN loras l ON l.id = il.lora_id").
+			Where("l.name = ?", name)
+		if f.LoraWeightMin != nil {
+			sub = sub.Where("il.weight >= ?", *f.LoraWeightMin)
+		}
+		if f.LoraWeightMax != nil {
+			sub = sub.Where("il.weight <= ?", *f.LoraWeightMax)
+		}
+		img = img.Where("images.id IN (?)", sub)
+	}
+	for _, name := range f.Embeddings {
+		sub := gdb.Table("image_embeddings ie").
+			Select("ie.image_id").
+			Joins("JOIN embeddings e ON e.id = ie.embedding_id").
+			Where("e.name = ?", name)
+		img = img.Where("images.id IN (?)", sub)
+	}
+	if len(f.Samplers) > 0 {
+		img = img.Where("LOWER(images.sampler) IN ?", lowerAll(f.Samplers))
+	}
+	if len(f.Schedulers) > 0 {
+		img = img.Where("LOWER(images.scheduler) IN ?", lowerAll(f.Schedulers))
+	}
+	if len(f.SourceApps) > 0 {
+		img = img.Where("LOWER(images.source_app) IN ?", lowerAll(f.SourceApps))
+	}
+
+	if f.StepsMin != nil {
+		img = img.Where("images.steps >= ?", *f.StepsMin)
+	}
+	if f.StepsMax != nil {
+		img = img.Where("images.steps <= ?", *f.StepsMax)
+	}
+	if f.CFGMin != nil {
+		img = img.Where("images.cfg_scale >= ?", *f.CFGMin)
+	}
+	if f.CFGMax != nil {
+		img = img.Where("images.cfg_scale <= ?", *f.CFGMax)
+	}
+	if f.WidthMin != nil {
+		img = img.Where("images.width >= ?", *f.WidthMin)
+	}
+	if f.WidthMax != nil {
+		img = img.Where("images.width <= ?", *f.WidthMax)
+	}
+	if f.HeightMin != nil {
+		img = img.Where("images.height >= ?", *f.HeightMin)
+	}
+	if f.HeightMax != nil {
+		img = img.Where("images.height <= ?", *f.HeightMax)
+	}
+	if f.AspectMin != nil {
+		img = img.Where("images.height > 0 AND CAST(images.width AS REAL) / images.height >= ?", *f.AspectMin)
+	}
+	if f.AspectMax != nil {
+		img = img.Where("images.height > 0 AND CAST(images.width AS REAL) / images.height <= ?", *f.AspectMax)
+	}
+	if f.SizeMin != nil {
+		img = img.Where("images.size_bytes >= ?", *f.SizeMin)
+	}
+	if f.SizeMax != nil {
+		img = img.Where("images.size_bytes <= ?", *f.SizeMax)
+	}
+
+	if f.CreatedFrom != nil {
+		img = img.Where("images.created_time >= ?", *f.CreatedFrom)
+	}
+	if f.CreatedTo != nil {
+		img = img.Where("images.created_time <= ?", *f.CreatedTo)
+	}
+	if f.ImportedFrom != nil {
+		img = img.Where("images.imported_at >= ?", *f.ImportedFrom)
+	}
+	if f.ImportedTo != nil {
+		img = img.Where("images.imported_at <= ?", *f.ImportedTo)
+	}
+
+	// Number values are stored as numbers, so filter values that parse as
+	// numbers also match them numerically.
+	for _, ff := range f.Fields {
+		sub := gdb.Table("image_field_values v").
+			Select("v.image_id").
+			Joins("JOIN custom_fields cf ON cf.id = v.field_id").
+			Where("cf.name = ?", ff.Name)
+		if len(ff.Values) > 0 {
+			var nums []float64
+			for _, s := range ff.Values {
+				if n, err := strconv.ParseFloat(s, 64); err == nil {
+					nums = append(nums, n)
+				}
+			}
+			if len(nums) > 0 {
+				sub = sub.Where("(v.value COLLATE NOCASE IN ? OR v.value IN ?)", ff.Values, nums)
+			} else {
+				sub = sub.Where("v.value COLLATE NOCASE IN ?", ff.Values)
+			}
+		}
+		if ff.Min != "" {
+			sub = sub.Where("v.value >= ?", fieldBound(ff.Min))
+		}
+		if ff.Max != "" {
+			sub = sub.Where("v.value <= ?", fieldBound(ff.Max))
+		}
+		img = img.Where("images.id IN (?)", sub)
+	}
+	return img
+}
+
+// fieldBound returns a range bound as a number when it parses as one, so
+// it compares numerically with number values and as text with dates.
+func fieldBound(s string) any {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n
+	}
+	return s
+}
+
+// expr returns the SQL expression the listing is sorted by.
+func (s imageSort) expr() string {
+	if s.Key == "random" {
+		// SQLite has no seeded RANDOM(), so scramble the id with a
+		// multiplicative hash mixed with the seed instead. The sum is
+		// kept to 31 bits so the product fits in 63.
+		return fmt.Sprintf("((((images.id + %d) %% 2147483648) * 2654435761) %% 4294967296)", s.Seed)
+	}
+	if s.Key == "position" {
+		return fmt.Sprintf("(SELECT position FROM album_images WHERE album_id = %d AND image_id = images.id)", s.Album)
+	}
+	return sortColumns[s.Key]
+}
+
+// orderClause returns the ORDER BY expression for the sort. The image id is
+// always used as a tie-breaker so paging is deterministic.
+func (s imageSort) orderClause() string {
+	dir := strings.ToUpper(s.Order)
+	return s.expr() + " " + dir + ", images.id " + dir
+}
+
+func lowerAll(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToLower(s)
+	}
+	return out
+}
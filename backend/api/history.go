@@ -0,0 +1,325 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+var errInvalidVersion = errors.New("version must be an earlier version of the image")
+
+// imageLoras returns the LoRAs of an image as patch entries sorted by name,
+// the form history and bulk edit previews compare.
+func imageLoras(ls []*db.Lora) []loraPatch {
+	loras := make([]loraPatch, 0, len(ls))
+	for _, l := range ls {
+		lp := loraPatch{Name: l.Name, Weight: l.Weight}
+		if l.Hash != nil {
+			lp.Hash = *l.Hash
+		}
+		loras = append(loras, lp)
+	}
+	slices.SortFunc(loras, func(a, b loraPatch) int { return strings.Compare(a.Name, b.Name) })
+	return loras
+}
+
+// imageState returns the fields image history tracks, keyed by their JSON
+// name: everything the metadata API edits, plus tag names. LoRAs and tags
+// are sorted so equal states compare equal.
+func imageState(tx *gorm.DB, id any) (uint, int, map[string]json.RawMessage, error) {
+	m, err := loadImage(tx, id)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return 0, 0, nil, err
+	}
+	state := map[string]json.RawMessage{}
+	for key := range (&metadataPatch{}).fields() {
+		if v := all[key]; v != nil {
+			state[key] = v
+		} else {
+			state[key] = json.RawMessage("null")
+		}
+	}
+
+	loras := imageLoras(m.Loras)
+	tags := make([]string, 0, len(m.Tags))
+	for _, t := range m.Tags {
+		tags = append(tags, t.Name)
+	}
+	slices.Sort(tags)
+	for key, v := range map[string]any{"loras": loras, "tags": tags} {
+		if state[key], err = json.Marshal(v); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return m.ID, m.Version, state, nil
+}
+
+// trackChanges runs fn, which edits the given images inside tx, and records
+// every tracked field it changed in the image history.
+func trackChanges(c *gin.Context, tx *gorm.DB, action string, fn func() error, ids ...any) error {
+	before := make([]map[string]json.RawMessage, len(ids))
+	for i, id := range ids {
+		_, _, s, err := imageState(tx, id)
+		if err != nil {
+			return err
+		}
+		before[i] = s
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	for i, id := range ids {
+		imageID, version, after, err := imageState(tx, id)
+		if err != nil {
+			return err
+		}
+		fields := make([]string, 0, len(after))
+		for f := range after {
+			fields = append(fields, f)
+		}
+		slices.Sort(fields)
+		hidden := string(after["hidden"]) == "true"
+		for _, f := range fields {
+			if bytes.Equal(before[i][f], after[f]) {
+				continue
+			}
+			e := newAuditEntry(c, action, imageID)
+			e.Field, e.OldValue, e.NewValue, e.Version = f, []byte(before[i][f]), []byte(after[f]), &version
+			e.Hidden = hidden
+			if err := tx.Create(&e).Error; err != nil {
+				return err
+			}
+		}
+		// Hiding or unhiding an image moves its whole history with it.
+		if !bytes.Equal(before[i]["hidden"], after["hidden"]) {
+			if err := tx.Model(&db.AuditEntry{}).Where("image_id = ?", imageID).Update("hidden", hidden).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RuleChangeTracker returns a rules.Track hook that records the changes
+// rules make in the image history. Rules run in jobs and during imports, so
+// the changes are attributed to the system.
+func RuleChangeTracker() func(tx *gorm.DB, id uint, write func() error) error {
+	return func(tx *gorm.DB, id uint, write func() error) error {
+		return trackChanges(nil, tx, auditUpdate, write, id)
+	}
+}
+
+// imageHistory lists an image's recorded changes and deletions, newest
+// first. The history outlives the image.
+func imageHistory(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		var img db.Image
+		res := gdb.Select("id, hidden").Limit(1).Find(&img, id)
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected > 0 && img.Hidden && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+		items := []db.AuditEntry{}
+		if err := gdb.Where("image_id = ?", id).Order("id DESC").Find(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if res.RowsAffected == 0 && len(items) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		// A purged hidden image has no row left; its entries still say.
+		if len(items) > 0 && items[0].Hidden && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+// revertImage puts the tracked fields of an image back to how they were at
+// an earlier version. Each field changed since then takes the old value of
+// its first change after that version; the revert is itself recorded.
+func revertImage(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		var body struct {
+			Version int `json:"version"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			var img db.Image
+			if err := tx.Select("id, version").First(&img, id).Error; err != nil {
+				return err
+			}
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
+			}
+			if body.Version < 1 || body.Version >= img.Version {
+				return errInvalidVersion
+			}
+			var entries []db.AuditEntry
+			if err := tx.Where("image_id = ? AND field <> '' AND version > ?", id, body.Version).
+				Order("id").Find(&entries).Error; err != nil {
+				return err
+			}
+			old := map[string]json.RawMessage{}
+			for _, e := range entries {
+				if _, ok := old[e.Field]; !ok {
+					old[e.Field] = json.RawMessage(e.OldValue)
+				}
+			}
+			if len(old) == 0 {
+				return nil
+			}
+			if _, ok := old["hidden"]; ok && !vaultUnlocked(c) {
+				return errVaultLocked
+			}
+			tags, revertTags := old["tags"]
+			delete(old, "tags")
+			if values, ok := old["fields"]; ok {
+				if old["fields"], err = revertFieldValues(tx, id, values); err != nil {
+					return err
+				}
+			}
+			raw, err := json.Marshal(old)
+			if err != nil {
+				return err
+			}
+			patch, err := decodeMetadataPatch(raw)
+			if err != nil {
+				return err
+			}
+			var names []string
+			if revertTags {
+				if err := json.Unmarshal(tags, &names); err != nil {
+					return err
+				}
+			}
+			return trackChanges(c, tx, auditRevert, func() error {
+				if err := bumpVersion(tx, id, c.GetHeader("If-Match")); err != nil {
+					return err
+				}
+				if err := applyMetadataPatch(tx, uint(id), patch, false); err != nil {
+					return err
+				}
+				if revertTags {
+					return setImageTags(tx, uint(id), names)
+				}
+				return nil
+			}, id)
+		})
+		var ferrs fieldErrors
+		switch {
+		case errors.Is(err, errVersionConflict):
+			respondVersionConflict(c, gdb, id)
+			return
+		case errors.Is(err, errVaultLocked):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, errInvalidVersion):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.As(err, &ferrs):
+			c.JSON(http.StatusConflict, gin.H{"error": "cannot restore some fields", "fields": ferrs})
+			return
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondImage(c, gdb)
+	}
+}
+
+// setImageTags makes names the image's exact tag set, recreating tags that
+// were deleted since and dropping tags left without images.
+func setImageTags(tx *gorm.DB, id uint, names []string) error {
+	var current []db.Tag
+	if err := tx.Joins("JOIN image_tags ON image_tags.tag_id = tags.id").
+		Where("image_tags.image_id = ?", id).Find(&current).Error; err != nil {
+		return err
+	}
+	keep := map[uint]bool{}
+	for _, name := range names {
+		t, err := db.ResolveTag(tx, name)
+		if err != nil {
+			return err
+		}
+		keep[t.ID] = true
+		rel := db.ImageTag{ImageID: id, TagID: t.ID}
+		if err := tx.FirstOrCreate(&rel, rel).Error; err != nil {
+			return err
+		}
+	}
+	for _, t := range current {
+		if keep[t.ID] {
+			continue
+		}
+		if err := tx.Where("image_id = ? AND tag_id = ?", id, t.ID).Delete(&db.ImageTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ? AND "+orphanTagSQL, t.ID).Delete(&db.Tag{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revertFieldValues turns a recorded set of custom field values into a
+// patch that restores exactly that set, clearing fields set since.
+func revertFieldValues(tx *gorm.DB, id uint64, recorded json.RawMessage) (json.RawMessage, error) {
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(recorded, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = map[string]json.RawMessage{}
+	}
+	current, err := loadFieldValues(tx, []uint{uint(id)})
+	if err != nil {
+		return nil, err
+	}
+	for name := range current[uint(id)] {
+		if _, ok := values[name]; !ok {
+			values[name] = json.RawMessage("null")
+		}
+	}
+	return json.Marshal(values)
+}
@@ -0,0 +1,150 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/api"
+	"gen-library/backend/db"
+	"gen-library/backend/rules"
+)
+
+type historyEntry struct {
+	Action    string          `json:"action"`
+	Field     string          `json:"field"`
+	OldValue  json.RawMessage `json:"oldValue"`
+	NewValue  json.RawMessage `json:"newValue"`
+	Version   int             `json:"version"`
+	RequestID string          `json:"requestId"`
+	Client    string          `json:"client"`
+}
+
+func getHistory(t *testing.T, r *gin.Engine, id string) []historyEntry {
+	t.Helper()
+	w := doJSON(r, http.MethodGet, "/api/images/"+id+"/history", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Items []historyEntry `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Items
+}
+
+func TestImageHistory(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/images/1/metadata", strings.NewReader(`{"rating":4,"prompt":"a cat"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "req-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	h := getHistory(t, r, "1")
+	require.Len(t, h, 2)
+	require.Equal(t, "rating", h[0].Field)
+	require.JSONEq(t, `0`, string(h[0].OldValue))
+	require.JSONEq(t, `4`, string(h[0].NewValue))
+	require.Equal(t, 2, h[0].Version)
+	require.Equal(t, "req-1", h[0].RequestID)
+	require.Equal(t, "prompt", h[1].Field)
+
+	// Unchanged values and no-op tag edits are not recorded.
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodPut, "/api/images/1/metadata", `{"rating":4}`).Code)
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodPost, "/api/images/1/tags", `{"tags":["cat"]}`).Code)
+	require.Len(t, getHistory(t, r, "1"), 2)
+
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodPost, "/api/images/1/tags", `{"tags":["pet"]}`).Code)
+	require.Equal(t, http.StatusOK, postBulkStatus(r, `{"ids":[1],"actions":{"rating":1,"favorite":false}}`))
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/tags/2", "").Code)
+	h = getHistory(t, r, "1")
+	require.Equal(t, []string{"tags", "rating", "favorite", "tags", "rating", "prompt"}, historyFields(h))
+	require.JSONEq(t, `["animal","cat","pet"]`, string(h[0].OldValue))
+	require.JSONEq(t, `["animal","pet"]`, string(h[0].NewValue))
+
+	// Reverting to version 2 brings back the rating, favorite and tags.
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/images/1/revert", `{"version":99}`).Code)
+	w = doJSON(r, http.MethodPost, "/api/images/1/revert", `{"version":2}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var img struct {
+		Rating   int     `json:"rating"`
+		Favorite bool    `json:"favorite"`
+		Prompt   *string `json:"prompt"`
+		Tags     []struct {
+			Name string `json:"name"`
+		} `json:"tags"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	require.Equal(t, 4, img.Rating)
+	require.True(t, img.Favorite)
+	require.Equal(t, "a cat", *img.Prompt)
+	names := []string{}
+	for _, tg := range img.Tags {
+		names = append(names, tg.Name)
+	}
+	require.ElementsMatch(t, []string{"animal", "cat"}, names)
+	h = getHistory(t, r, "1")
+	require.Equal(t, "image.revert", h[0].Action)
+
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodGet, "/api/images/99/history", "").Code)
+	// Hidden images keep their history behind the vault.
+	token := unlockTestVault(t, r)
+	require.Equal(t, http.StatusOK, doVault(r, http.MethodPut, "/api/images/3/metadata", `{"hidden":true}`, token).Code)
+	require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, "/api/images/3/history", "").Code)
+	require.Equal(t, http.StatusOK, doVault(r, http.MethodGet, "/api/images/3/history", "", token).Code)
+	require.Contains(t, doJSON(r, http.MethodGet, "/api/audit?imageId=3", "").Body.String(), `"total":0`)
+	require.Contains(t, doVault(r, http.MethodGet, "/api/audit?imageId=3", "", token).Body.String(), `"total":1`)
+	// The history stays locked once the image is gone.
+	require.NoError(t, gdb.Delete(&db.Image{}, 3).Error)
+	require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, "/api/images/3/history", "").Code)
+	require.Equal(t, http.StatusOK, doVault(r, http.MethodGet, "/api/images/3/history", "", token).Code)
+}
+
+func TestTagAndRuleHistory(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	rules.Track = api.RuleChangeTracker()
+	t.Cleanup(func() { rules.Track = nil })
+
+	w := doJSON(r, http.MethodPatch, "/api/tags/2", `{"name":"feline"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	h := getHistory(t, r, "1")
+	require.Equal(t, []string{"tags"}, historyFields(h))
+	require.JSONEq(t, `["animal","cat"]`, string(h[0].OldValue))
+	require.JSONEq(t, `["animal","feline"]`, string(h[0].NewValue))
+
+	w = doJSON(r, http.MethodPost, "/api/tags/merge", `{"sources":["dog"],"target":"canine"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	h = getHistory(t, r, "2")
+	require.Equal(t, []string{"tags"}, historyFields(h))
+	require.JSONEq(t, `["animal","canine"]`, string(h[0].NewValue))
+	require.Empty(t, getHistory(t, r, "3"))
+
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 3).Update("prompt", "sunflower field").Error)
+	w = doJSON(r, http.MethodPost, "/api/rules", `{"name":"sun","conditions":{"prompt":"sun"},"actions":{"rating":3}}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	w = doJSON(r, http.MethodPost, "/api/rules/apply", `{}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	require.Equal(t, "done", waitJob(t, r, w.Body.Bytes())["status"])
+	h = getHistory(t, r, "3")
+	require.Equal(t, []string{"rating"}, historyFields(h))
+	require.JSONEq(t, `3`, string(h[0].NewValue))
+	require.Equal(t, 2, h[0].Version)
+}
+
+func postBulkStatus(r *gin.Engine, body string) int {
+	return doJSON(r, http.MethodPost, "/api/images/bulk", body).Code
+}
+
+func historyFields(h []historyEntry) []string {
+	out := make([]string, len(h))
+	for i, e := range h {
+		out[i] = e.Field
+	}
+	return out
+}
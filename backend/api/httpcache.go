@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/util"
+)
+
+// Cache-Control policies. Content addressed URLs never change, while id based
+// URLs may start serving new bytes after a rescan and must be revalidated
+// against their ETag. Content gated by the vault or blur mode is private and
+// revalidated, so neither shared caches nor the browser serve it once the
+// gate closes.
+const (
+	cacheImmutable  = "public, max-age=31536000, immutable"
+	cacheRevalidate = "no-cache"
+	cachePrivate    = "private, no-cache"
+)
+
+// thumbFileRe matches the thumbnail names under /thumbs: the sha or, for
+// the blurred variant marked by b, the blur id, then the width.
+var thumbFileRe = regexp.MustCompile(`^([0-9a-zA-Z]+)_[0-9]+(b?)\.(jpg|webp)$`)
+
+// serveFileCached sends a file with the given strong ETag and cache policy.
+// http.ServeContent takes care of If-None-Match, If-Modified-Since and Range
+// requests. Missing files are reported as 404.
+func serveFileCached(c *gin.Context, p, etag, cacheControl string) {
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return
+	}
+	c.Header("ETag", `"`+etag+`"`)
+	c.Header("Cache-Control", cacheControl)
+	http.ServeContent(c.Writer, c.Request, fi.Name(), fi.ModTime(), f)
+}
+
+// serveThumbFile serves content addressed thumbnails from the cache with
+// long lived immutable caching. Thumbnails of hidden images need an unlocked
+// vault, and in blur mode NSFW images only have their blurred variant served;
+// those and unblurred NSFW thumbnails are sent as private. Blurred variants
+// are only served for a known blur id.
+func serveThumbFile(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := path.Base(c.Param("filepath"))
+		m := thumbFileRe.FindStringSubmatch(name)
+		if m == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		blurred := m[2] == "b"
+		col := "sha256"
+		if blurred {
+			col = "blur_id"
+		}
+		var img struct {
+			Hidden bool
+			NSFW   bool
+		}
+		res := gdb.Table("images").Select("hidden, nsfw").Where(col+" = ?", m[1]).Limit(1).Scan(&img)
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if blurred && res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		if img.Hidden && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+		if img.NSFW && !blurred {
+			if on, err := blurMode(gdb); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			} else if on {
+				c.JSON(http.StatusForbidden, gin.H{"error": "nsfw thumbnails are blurred"})
+				return
+			}
+		}
+		policy := cacheImmutable
+		if img.Hidden || (img.NSFW && !blurred) {
+			policy = cachePrivate
+		}
+		util.CountThumbLookup(util.ThumbFileCached(name))
+		serveFileCached(c, filepath.Join(util.ThumbDir, name), name, policy)
+	}
+}
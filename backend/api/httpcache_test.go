@@ -0,0 +1,80 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestServeImageCaching(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a.png"), []byte("0123456789"), 0o644))
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "a.png", FileName: "a.png", Ext: "png", SizeBytes: 10, SHA256: "abc123"}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "gone.png", FileName: "gone.png", Ext: "png", SizeBytes: 10, SHA256: "def456"}).Error)
+	r := newRouter(gdb)
+
+	do := func(u string, hdr map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("/api/images/1/file", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"abc123"`, w.Header().Get("ETag"))
+	require.Equal(t, "no-cache", w.Header().Get("Cache-Control"))
+	require.Equal(t, "0123456789", w.Body.String())
+
+	w = do("/api/images/1/file", map[string]string{"If-None-Match": `"abc123"`})
+	require.Equal(t, http.StatusNotModified, w.Code)
+
+	w = do("/api/images/1/file", map[string]string{"Range": "bytes=2-4"})
+	require.Equal(t, http.StatusPartialContent, w.Code)
+	require.Equal(t, "234", w.Body.String())
+
+	require.Equal(t, http.StatusNotFound, do("/api/images/99/file", nil).Code)
+	require.Equal(t, http.StatusNotFound, do("/api/images/2/file", nil).Code)
+
+	t.Run("content addressed thumbnails are immutable", func(t *testing.T) {
+		require.NoError(t, os.MkdirAll(".cache/thumbs", 0o755))
+		require.NoError(t, os.WriteFile(".cache/thumbs/abc123_400.jpg", []byte("jpg"), 0o644))
+
+		w := do("/thumbs/abc123_400.jpg", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "public, max-age=31536000, immutable", w.Header().Get("Cache-Control"))
+		etag := w.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		require.Equal(t, http.StatusNotModified, do("/thumbs/abc123_400.jpg", map[string]string{"If-None-Match": etag}).Code)
+		require.Equal(t, http.StatusNotFound, do("/thumbs/../library.db", nil).Code)
+		require.Equal(t, http.StatusNotFound, do("/thumbs/", nil).Code)
+	})
+
+	t.Run("gated thumbnails are private", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(".cache/thumbs/def456_400.jpg", []byte("jpg"), 0o644))
+		require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 2).Update("nsfw", true).Error)
+		w := do("/thumbs/def456_400.jpg", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+
+		token := unlockTestVault(t, r)
+		require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 1).Update("hidden", true).Error)
+		w = doVault(r, http.MethodGet, "/thumbs/abc123_400.jpg", "", token)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+	})
+}
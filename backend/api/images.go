@@ -5,23 +5,16 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
-	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
-	"time"
-	"unicode"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
+	"gen-library/backend/classify"
 	"gen-library/backend/db"
-	"gen-library/backend/logger"
 	"gen-library/backend/scan"
-	"gen-library/backend/util"
 )
 
 type imageDTO struct {
@@ -36,7 +29,13 @@ type imageDTO struct {
 	Rating    int     `json:"rating"`
 	NSFW      bool    `json:"nsfw"`
 	Favorite  bool    `json:"favorite"`
+	Hidden    bool    `json:"hidden"`
 	ThumbURL  string  `json:"thumbUrl"`
+	BlurHash  *string `json:"blurHash"`
+	SHA256    string  `gorm:"column:sha256" json:"-"`
+	BlurID    string  `json:"-"`
+	// SortKey is the value the listing is sorted by, for the next cursor.
+	SortKey sortKey `gorm:"column:sort_key;type:any" json:"-"`
 }
 
 func listImages(gdb *gorm.DB) gin.HandlerFunc {
@@ -50,351 +49,198 @@ func listImages(gdb *gorm.DB) gin.HandlerFunc {
 			pageSize = 50
 		}
 
-		nsfwMode := strings.ToLower(c.DefaultQuery("nsfw", "hide")) // hide|show|only
-		q := c.Query("q")
-		csvTags := c.Query("tags")
-		var tags []string
-		if csvTags != "" {
-			tags = splitNonEmpty(csvTags, ",")
+		query, ok := listQuery(c, gdb)
+		if !ok {
+			return
 		}
-
-		sort := c.DefaultQuery("sort", "imported_at")
-		order := c.DefaultQuery("order", "desc")
-		if !inSet(sort, []string{"created_time", "imported_at", "file_name"}) {
-			sort = "created_time"
+		filter, err := parseImageFilter(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-		if !inSet(strings.ToLower(order), []string{"asc", "desc"}) {
-			order = "desc"
+		if !checkHiddenFilter(c, filter) {
+			return
 		}
+		sort := parseImageSort(query)
 
 		// Base query
 		img := gdb.Table("images").Joins("LEFT JOIN models ON images.model_id = models.id")
-		// NSFW filter
-		switch nsfwMode {
-		case "hide":
-			img = img.Where("images.nsfw = 0")
-		case "only":
-			img = img.Where("images.nsfw = 1")
-		}
-
-		// FTS join if q
-		if strings.TrimSpace(q) != "" {
-			q = strings.TrimSpace(q)
-			// Allow partial keyword matches by adding a wildcard
-			terms := strings.Fields(q)
-			for i, t := range terms {
-				if !strings.HasSuffix(t, "*") {
-					terms[i] = t + "*"
-				}
-			}
-			q = strings.Join(terms, " ")
-			img = img.Joins("JOIN images_fts ON images_fts.rowid = images.id").Where("images_fts MATCH ?", q)
-		}
+		img = filter.apply(gdb, img)
 
-		// Rating filter
-		if rStr := c.Query("rating"); rStr != "" {
-			if r, err := strconv.Atoi(rStr); err == nil {
-				img = img.Where("images.rating = ?", r)
+		// Count total. count=approx serves a briefly cached total and
+		// count=none skips counting, which suits infinite scroll.
+		var total int64
+		countMode := strings.ToLower(c.DefaultQuery("count", "exact"))
+		switch countMode {
+		case "none":
+			total = -1
+		case "approx":
+			n, err := countApprox(countKey(query), func() (int64, error) {
+				var n int64
+				err := img.Count(&n).Error
+				return n, err
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			total = n
+		default:
+			countMode = "exact"
+			if err := img.Count(&total).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
 			}
 		}
 
-		if fav := c.Query("favorite"); fav == "1" || strings.ToLower(fav) == "true" {
-			img = img.Where("images.favorite = 1")
+		// Keyset pagination when a cursor (possibly empty for the first
+		// page) is supplied; OFFSET paging otherwise.
+		cursor, keyset := c.GetQuery("cursor")
+		if keyset && cursor != "" {
+			cur, err := decodeCursor(cursor, &sort)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if img, err = cur.after(img, sort); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
 		}
 
-		// Tag filter: require ALL tags
-		if len(tags) > 0 {
-			sub := gdb.Table("image_tags it").
-				Select("it.image_id").
-				Joins("JOIN tags t ON t.id = it.tag_id").
-				Where("t.name IN ?", tags).
-				Group("it.image_id").
-				Having("COUNT(DISTINCT t.name) = ?", len(tags))
-			img = img.Where("images.id IN (?)", sub)
+		// Select page
+		rows := []imageDTO{}
+		qimg := img.Order(sort.orderClause()).
+			Select("images.id, images.path, images.file_name, images.ext, images.width, images.height, models.name AS model_name, images.prompt, images.rating, images.nsfw, images.favorite, images.hidden, images.sha256, COALESCE(images.blur_id, '') AS blur_id, images.blur_hash, " + sort.expr() + " AS sort_key")
+		if keyset {
+			qimg = qimg.Limit(pageSize + 1)
+		} else {
+			qimg = qimg.Limit(pageSize).Offset((page - 1) * pageSize)
 		}
 
-		// Count total
-		var total int64
-		if err := img.Count(&total).Error; err != nil {
+		if err := qimg.Scan(&rows).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Select page
-		rows := []imageDTO{}
-		qimg := img.Order("images." + sort + " " + strings.ToUpper(order)).
-			Select("images.id, images.path, images.file_name, images.ext, images.width, images.height, models.name AS model_name, images.prompt, images.rating, images.nsfw, images.favorite").
-			Limit(pageSize).Offset((page - 1) * pageSize)
+		var nextCursor string
+		if keyset && len(rows) > pageSize {
+			rows = rows[:pageSize]
+			last := rows[len(rows)-1]
+			next, err := cursorFor(sort, last.ID, last.SortKey.v)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			nextCursor = next
+		}
 
-		if err := qimg.Scan(&rows).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		blurNSFW := filter.NSFW == "blur"
+		if !blurNSFW {
+			if blurNSFW, err = blurMode(gdb); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
 		}
-		var root string
-		gdb.Table("settings").Select("value").Where("key=?", "library_path").Scan(&root)
 		for i := range rows {
-			var sha string
-			if err := gdb.Table("images").Select("sha256").Where("id=?", rows[i].ID).Scan(&sha).Error; err == nil && sha != "" {
-				src := rows[i].Path
-				if root != "" && !filepath.IsAbs(src) {
-					src = filepath.Join(root, src)
-				}
-				_, _ = util.EnsureThumb(sha, src, 400)
-				rows[i].ThumbURL = "/thumbs/" + sha + "_400.jpg"
+			if rows[i].SHA256 != "" {
+				blur := blurNSFW && rows[i].NSFW
+				rows[i].ThumbURL = thumbURL(rows[i].ID, rows[i].SHA256, rows[i].BlurID, rows[i].Hidden, blur)
 			}
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"page":     page,
-			"pageSize": pageSize,
-			"total":    total,
-			"items":    rows,
-		})
-	}
-}
-
-func getImage(gdb *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var m db.Image
-		if err := gdb.Preload("Tags").Preload("Embeddings").Preload("Model").First(&m, c.Param("id")).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
+		resp := gin.H{
+			"pageSize":  pageSize,
+			"total":     total,
+			"countMode": countMode,
+			"items":     rows,
 		}
-		var loras []*db.Lora
-		if err := gdb.Table("loras").
-			Joins("JOIN image_loras ON image_loras.lora_id = loras.id").
-			Select("loras.*, image_loras.weight").
-			Where("image_loras.image_id = ?", m.ID).
-			Find(&loras).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
+		if keyset {
+			resp["nextCursor"] = nextCursor
+		} else {
+			resp["page"] = page
 		}
-		m.Loras = loras
-		if m.Model != nil {
-			m.ModelName = &m.Model.Name
-			m.ModelHash = m.Model.Hash
+		if sort.Key == "random" {
+			resp["seed"] = sort.Seed
 		}
-		c.JSON(http.StatusOK, m)
+		c.JSON(http.StatusOK, resp)
 	}
 }
 
-func serveImage(gdb *gorm.DB) gin.HandlerFunc {
+// getImage returns one image. Hidden images need an unlocked vault.
+func getImage(gdb *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var img db.Image
-		if err := gdb.First(&img, c.Param("id")).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
-		}
-		var root string
-		gdb.Table("settings").Select("value").Where("key=?", "library_path").Scan(&root)
-		path := img.Path
-		if root != "" && !filepath.IsAbs(path) {
-			path = filepath.Join(root, path)
-		}
-		c.File(path)
+		respondImage(c, gdb)
 	}
 }
 
-func updateMetadata(gdb *gorm.DB) gin.HandlerFunc {
-        return func(c *gin.Context) {
-                id := c.Param("id")
-                var payload map[string]any
-                if err := c.BindJSON(&payload); err != nil {
-                        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-                        return
-                }
-
-               // Normalize NSFW value to a proper boolean if present
-               if v, ok := payload["nsfw"]; ok {
-                       switch val := v.(type) {
-                       case float64:
-                               payload["nsfw"] = val != 0
-                       case string:
-                               b, err := strconv.ParseBool(val)
-                               if err == nil {
-                                       payload["nsfw"] = b
-                               } else {
-                                       delete(payload, "nsfw")
-                               }
-                       case bool:
-                               // already correct type
-                       default:
-                               delete(payload, "nsfw")
-                       }
-               }
-
-                var (
-                        loras        []*db.Lora
-                        lorasPresent bool
-                        modelID      *uint
-                )
-		if raw, ok := payload["loras"]; ok {
-			lorasPresent = true
-			delete(payload, "loras")
-			if arr, ok := raw.([]any); ok {
-				for _, r := range arr {
-					obj, ok := r.(map[string]any)
-					if !ok {
-						continue
-					}
-					name, _ := obj["name"].(string)
-					hash, _ := obj["hash"].(string)
-					var l db.Lora
-					if err := gdb.Where("name = ?", name).First(&l).Error; err != nil {
-						if errors.Is(err, gorm.ErrRecordNotFound) {
-							if hash != "" {
-								var existing db.Lora
-								if err := gdb.Where("hash = ?", hash).First(&existing).Error; err == nil {
-									logger.Warn().Str("lora", name).Str("existing", existing.Name).Msg("hash conflict for lora; using existing")
-									l = existing
-								} else if errors.Is(err, gorm.ErrRecordNotFound) {
-									l = db.Lora{Name: name}
-									if hash != "" {
-										l.Hash = &hash
-									}
-									if err := gdb.Create(&l).Error; err != nil {
-										c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-										return
-									}
-								} else {
-									c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-									return
-								}
-							} else {
-								l = db.Lora{Name: name}
-								if err := gdb.Create(&l).Error; err != nil {
-									c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-									return
-								}
-							}
-						} else {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-							return
-						}
-					}
-					if hash != "" {
-						if l.Hash == nil {
-							l.Hash = &hash
-							if err := gdb.Save(&l).Error; err != nil {
-								c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-								return
-							}
-						} else if *l.Hash != hash {
-							var existing db.Lora
-							if err := gdb.Where("hash = ?", hash).First(&existing).Error; err == nil && existing.ID != l.ID {
-								logger.Warn().Str("lora", name).Str("existing", existing.Name).Msg("hash conflict for lora; using existing")
-								l = existing
-							} else if errors.Is(err, gorm.ErrRecordNotFound) {
-								l.Hash = &hash
-								if err := gdb.Save(&l).Error; err != nil {
-									c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-									return
-								}
-							} else if err != nil {
-								c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-								return
-							}
-						}
-					}
-					loras = append(loras, &l)
-				}
-			}
-		}
-		if _, ok := payload["modelName"]; ok || (func() bool { _, ok := payload["modelHash"]; return ok })() {
-			var name string
-			if v, ok := payload["modelName"].(string); ok {
-				name = v
-			}
-			var hash string
-			if v, ok := payload["modelHash"].(string); ok {
-				hash = v
-			}
-			delete(payload, "modelName")
-			delete(payload, "modelHash")
-			var m db.Model
-			if name != "" {
-				if err := gdb.Where("name = ?", name).First(&m).Error; err == nil {
-					modelID = &m.ID
-				} else if errors.Is(err, gorm.ErrRecordNotFound) {
-					m = db.Model{Name: name}
-					if err := gdb.Create(&m).Error; err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-						return
-					}
-					modelID = &m.ID
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
-			if modelID == nil && hash != "" {
-				if err := gdb.Where("hash = ?", hash).First(&m).Error; err == nil {
-					modelID = &m.ID
-				} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
-			if modelID != nil && hash != "" {
-				if m.ID == *modelID {
-					if m.Hash == nil {
-						m.Hash = &hash
-						if err := gdb.Save(&m).Error; err != nil {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-							return
-						}
-					} else if *m.Hash != hash {
-						var existing db.Model
-						if err := gdb.Where("hash = ?", hash).First(&existing).Error; err == nil && existing.ID != m.ID {
-							modelID = &existing.ID
-						} else if errors.Is(err, gorm.ErrRecordNotFound) {
-							m.Hash = &hash
-							if err := gdb.Save(&m).Error; err != nil {
-								c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-								return
-							}
-						} else {
-							c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-							return
-						}
-					}
-				}
-			}
-		}
+// respondImage writes the image named by the id parameter along with the
+// classifier's predictions. Hidden images need an unlocked vault, also when
+// an edit echoes back the image it changed.
+func respondImage(c *gin.Context, gdb *gorm.DB) {
+	m, err := loadImage(gdb, c.Param("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if m.Hidden && !vaultUnlocked(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+		return
+	}
+	// Predictions are advisory; an untrained or failing model only leaves
+	// them empty. Training happens in the background, never on a read.
+	pred := classify.Prediction{Tags: []classify.Suggestion{}}
+	if p, err := classify.Predict(gdb, m.ID); err == nil {
+		pred = p
+	}
+	c.Header("ETag", imageETag(m.Version))
+	c.JSON(http.StatusOK, struct {
+		db.Image
+		classify.Prediction
+	}{m, pred})
+}
 
-		updates := make(map[string]any, len(payload))
-		for k, v := range payload {
-			updates[camelToSnake(k)] = v
-		}
-		if modelID != nil {
-			updates["model_id"] = *modelID
-		}
+// loadImage fetches an image with its tags, embeddings, model and weighted
+// LoRAs as returned by getImage.
+func loadImage(gdb *gorm.DB, id any) (db.Image, error) {
+	var m db.Image
+	if err := gdb.Preload("Tags").Preload("Embeddings").Preload("Model").First(&m, id).Error; err != nil {
+		return m, err
+	}
+	var loras []*db.Lora
+	if err := gdb.Table("loras").
+		Joins("JOIN image_loras ON image_loras.lora_id = loras.id").
+		Select("loras.*, image_loras.weight").
+		Where("image_loras.image_id = ?", m.ID).
+		Find(&loras).Error; err != nil {
+		return m, err
+	}
+	m.Loras = loras
+	values, err := loadFieldValues(gdb, []uint{m.ID})
+	if err != nil {
+		return m, err
+	}
+	m.Fields = values[m.ID]
+	if m.Model != nil {
+		m.ModelName = &m.Model.Name
+		m.ModelHash = m.Model.Hash
+	}
+	return m, nil
+}
 
-		if err := gdb.Model(&db.Image{}).Where("id=?", id).Updates(updates).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// serveImage sends the original file using its SHA256 as a strong ETag so
+// clients can revalidate cheaply and resume or seek with byte ranges.
+func serveImage(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		img, err := lookupImageFile(c, gdb, c.Param("id"), "serve")
+		if err != nil {
+			respondImageFileError(c, err)
 			return
 		}
-
-		if lorasPresent {
-			uid, err := strconv.ParseUint(id, 10, 64)
-			if err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				return
-			}
-			img := db.Image{ID: uint(uid)}
-			if err := gdb.Model(&img).Association("Loras").Clear(); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			if len(loras) > 0 {
-				if err := gdb.Model(&img).Association("Loras").Append(loras); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
-		}
-
-		getImage(gdb)(c)
+		serveFileCached(c, img.AbsPath, img.SHA256, cacheRevalidate)
 	}
 }
 
@@ -408,48 +254,49 @@ func addTags(gdb *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		var image db.Image
-		if err := gdb.First(&image, id).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
-		}
 
-		seen := make(map[string]struct{})
-		for _, name := range body.Tags {
-			name = strings.TrimSpace(name)
-			if name == "" {
-				continue
-			}
-			if _, ok := seen[name]; ok {
-				continue
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
 			}
-			seen[name] = struct{}{}
+			return trackChanges(c, tx, auditUpdate, func() error {
+				if err := bumpVersion(tx, id, c.GetHeader("If-Match")); err != nil {
+					return err
+				}
+				var image db.Image
+				if err := tx.Select("id").First(&image, id).Error; err != nil {
+					return err
+				}
 
-			var t db.Tag
-			if err := gdb.Where("name = ?", name).First(&t).Error; err != nil {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					if err := gdb.Create(&db.Tag{Name: name}).Error; err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-						return
+				seen := make(map[string]struct{})
+				for _, name := range body.Tags {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						continue
 					}
-					if err := gdb.Where("name = ?", name).First(&t).Error; err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-						return
+					if _, ok := seen[name]; ok {
+						continue
 					}
-				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
-				}
-			}
+					seen[name] = struct{}{}
 
-			rel := db.ImageTag{ImageID: image.ID, TagID: t.ID}
-			if err := gdb.FirstOrCreate(&rel, rel).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+					t, err := db.ResolveTag(tx, name)
+					if err != nil {
+						return err
+					}
+
+					rel := db.ImageTag{ImageID: image.ID, TagID: t.ID}
+					if err := tx.FirstOrCreate(&rel, rel).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			}, id)
+		})
+		if !respondTagError(c, gdb, id, err) {
+			return
 		}
 
-		getImage(gdb)(c)
+		respondImage(c, gdb)
 	}
 }
 
@@ -463,79 +310,132 @@ func removeTags(gdb *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		var image db.Image
-		if err := gdb.Select("id").First(&image, id).Error; err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			return
-		}
 
-		seen := make(map[string]struct{})
-		for _, name := range body.Tags {
-			name = strings.TrimSpace(name)
-			if name == "" {
-				continue
-			}
-			if _, ok := seen[name]; ok {
-				continue
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
 			}
-			seen[name] = struct{}{}
-
-			var t db.Tag
-			if err := gdb.Where("name = ?", name).First(&t).Error; err != nil {
-				if errors.Is(err, gorm.ErrRecordNotFound) {
-					continue
+			return trackChanges(c, tx, auditUpdate, func() error {
+				if err := bumpVersion(tx, id, c.GetHeader("If-Match")); err != nil {
+					return err
+				}
+				var image db.Image
+				if err := tx.Select("id").First(&image, id).Error; err != nil {
+					return err
 				}
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
 
-			if err := gdb.Where("image_id = ? AND tag_id = ?", image.ID, t.ID).Delete(&db.ImageTag{}).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
+				seen := make(map[string]struct{})
+				for _, name := range body.Tags {
+					name = strings.TrimSpace(name)
+					if name == "" {
+						continue
+					}
+					if _, ok := seen[name]; ok {
+						continue
+					}
+					seen[name] = struct{}{}
 
-			var count int64
-			if err := gdb.Model(&db.ImageTag{}).Where("tag_id = ?", t.ID).Count(&count).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			if count == 0 {
-				if err := gdb.Delete(&db.Tag{}, t.ID).Error; err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-					return
+					t, err := db.LookupTag(tx, name)
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						continue
+					} else if err != nil {
+						return err
+					}
+
+					if err := tx.Where("image_id = ? AND tag_id = ?", image.ID, t.ID).Delete(&db.ImageTag{}).Error; err != nil {
+						return err
+					}
+
+					if err := tx.Where("id = ? AND "+orphanTagSQL, t.ID).Delete(&db.Tag{}).Error; err != nil {
+						return err
+					}
 				}
-			}
+				return nil
+			}, id)
+		})
+		if !respondTagError(c, gdb, id, err) {
+			return
 		}
 
-		getImage(gdb)(c)
+		respondImage(c, gdb)
+	}
+}
+
+// respondTagError writes the response for a failed tag edit and reports
+// whether the handler should continue.
+func respondTagError(c *gin.Context, gdb *gorm.DB, id string, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	case errors.Is(err, errVersionConflict):
+		respondVersionConflict(c, gdb, id)
+	case errors.Is(err, errVaultLocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, db.ErrEmptyTagName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 	}
+	return false
 }
 
+// deleteImage moves an image to the trash, or with mode=hard deletes it for
+// good. A hard delete is confirmed in two steps: without a token it answers
+// with a preview and a token to send back.
 func deleteImage(gdb *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
 		mode := strings.ToLower(c.DefaultQuery("mode", "trash"))
 
-		var token string
 		if mode == "hard" {
 			var body struct {
 				Token string `json:"token"`
 			}
-			if err := c.ShouldBindJSON(&body); err != nil {
+			if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			token = body.Token
+			var img db.Image
+			if err := gdb.Select("id, path, file_name, hidden, deleted_at").First(&img, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if img.Hidden && !vaultUnlocked(c) {
+				c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+				return
+			}
+			if img.DeletedAt != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": errInTrash.Error()})
+				return
+			}
+			preview := gin.H{"id": img.ID, "path": img.Path, "fileName": img.FileName}
+			if !confirmed(c, body.Token, confirmScope(auditDelete, []uint{img.ID}), preview) {
+				return
+			}
 		}
 
+		var (
+			removal fileRemoval
+			move    fileMove
+		)
 		err := gdb.Transaction(func(tx *gorm.DB) error {
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
+			}
+			if err := bumpVersion(tx, id, c.GetHeader("If-Match")); err != nil {
+				return err
+			}
 			var img db.Image
 			if err := tx.First(&img, id).Error; err != nil {
 				return err
 			}
-
-			if err := tx.Delete(&db.Image{}, id).Error; err != nil {
-				return err
+			if img.DeletedAt != nil {
+				return errInTrash
 			}
 
 			// Resolve the file path against the configured library
@@ -557,36 +457,35 @@ func deleteImage(gdb *gorm.DB) gin.HandlerFunc {
 			if err != nil {
 				return err
 			}
+			if err := checkPathAllowed(c, tx, absPath, "delete_"+mode); err != nil {
+				return err
+			}
 
 			switch mode {
 			case "trash":
-				if err := moveToTrash(absPath); err != nil {
-					return err
-				}
+				var err error
+				move, err = trashImage(c, tx, img, absPath)
+				return err
 			case "hard":
-				expected := fmt.Sprintf("%d", img.ID)
-				if token != expected {
-					return fmt.Errorf("invalid token")
-				}
-				if err := os.Remove(absPath); err != nil {
-					return err
-				}
+				var err error
+				removal, err = hardDeleteImage(c, tx, img, absPath)
+				return err
 			default:
 				return fmt.Errorf("unknown mode")
 			}
-
-			if err := util.DeleteThumbs(img.SHA256); err != nil {
-				return err
-			}
-			return nil
 		})
 
 		if err != nil {
+			move.undo()
 			switch {
 			case errors.Is(err, gorm.ErrRecordNotFound):
 				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
-			case strings.Contains(err.Error(), "invalid token"):
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, errVersionConflict):
+				respondVersionConflict(c, gdb, id)
+			case errors.Is(err, errOutsideRoots), errors.Is(err, errVaultLocked):
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			case errors.Is(err, errInTrash), errors.Is(err, errDestExists):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			case strings.Contains(err.Error(), "unknown mode"):
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			default:
@@ -595,60 +494,11 @@ func deleteImage(gdb *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		removal.run()
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	}
 }
 
-func moveToTrash(path string) error {
-	switch runtime.GOOS {
-	case "windows":
-		cmd := exec.Command("powershell", "-NoProfile", "-Command",
-			fmt.Sprintf(`Add-Type -AssemblyName Microsoft.VisualBasic; [Microsoft.VisualBasic.FileIO.FileSystem]::DeleteFile(%q, [Microsoft.VisualBasic.FileIO.UIOption]::OnlyErrorDialogs, [Microsoft.VisualBasic.FileIO.RecycleOption]::SendToRecycleBin)`, path))
-		// Capture stdout/stderr so any PowerShell errors are surfaced to the caller.
-		if out, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("powershell recycle failed: %v: %s", err, strings.TrimSpace(string(out)))
-		}
-		return nil
-	case "darwin":
-		script := fmt.Sprintf(`tell application \"Finder\" to delete POSIX file %q`, path)
-		cmd := exec.Command("osascript", "-e", script)
-		return cmd.Run()
-	default: // freedesktop trash spec
-		abs, err := filepath.Abs(path)
-		if err != nil {
-			return err
-		}
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return err
-		}
-		filesDir := filepath.Join(home, ".local/share/Trash/files")
-		infoDir := filepath.Join(home, ".local/share/Trash/info")
-		if err := os.MkdirAll(filesDir, 0o755); err != nil {
-			return err
-		}
-		if err := os.MkdirAll(infoDir, 0o755); err != nil {
-			return err
-		}
-		base := filepath.Base(abs)
-		dest := filepath.Join(filesDir, base)
-		for i := 1; ; i++ {
-			if _, err := os.Stat(dest); os.IsNotExist(err) {
-				break
-			}
-			dest = filepath.Join(filesDir, fmt.Sprintf("%s.%d", base, i))
-		}
-		if err := os.Rename(abs, dest); err != nil {
-			return err
-		}
-		infoPath := filepath.Join(infoDir, filepath.Base(dest)+".trashinfo")
-		u := url.PathEscape(abs)
-		ts := time.Now().Format("2006-01-02T15:04:05")
-		content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", u, ts)
-		return os.WriteFile(infoPath, []byte(content), 0o644)
-	}
-}
-
 func scanFolder(gdb *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var body struct {
@@ -675,6 +525,14 @@ func scanFolder(gdb *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "no root provided"})
 			return
 		}
+		if err := checkPathAllowed(c, gdb, root, "scan"); err != nil {
+			if errors.Is(err, errOutsideRoots) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
 		n, err := scan.ScanFolder(gdb, root)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -703,18 +561,3 @@ func splitNonEmpty(s, sep string) []string {
 	}
 	return res
 }
-
-func camelToSnake(s string) string {
-	var b strings.Builder
-	for i, r := range s {
-		if unicode.IsUpper(r) {
-			if i > 0 {
-				b.WriteByte('_')
-			}
-			b.WriteRune(unicode.ToLower(r))
-		} else {
-			b.WriteRune(r)
-		}
-	}
-	return b.String()
-}
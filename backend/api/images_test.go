@@ -2,8 +2,10 @@ package api_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -15,13 +17,36 @@ import (
 	"gen-library/backend/db"
 )
 
-// setupRouter initializes an in-memory database, seeds test data and returns a gin.Engine.
-func setupRouter(t *testing.T) (*gin.Engine, bool) {
-	gdb, err := gorm.Open(sqlite.Open("file::memory:?cache=shared&_busy_timeout=5000"), &gorm.Config{})
+// newTestDB opens a migrated in-memory database private to the test.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared&_busy_timeout=5000&_foreign_keys=1", url.PathEscape(t.Name()))
+	gdb, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	require.NoError(t, err)
 	sqlDB, _ := gdb.DB()
 	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
 	require.NoError(t, db.ApplyMigrations(gdb))
+	return gdb
+}
+
+// newRouter returns a gin.Engine with the API routes registered on gdb.
+func newRouter(gdb *gorm.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api.RegisterRoutes(r, gdb)
+	return r
+}
+
+// setupRouter initializes an in-memory database, seeds test data and returns a gin.Engine.
+func setupRouter(t *testing.T) (*gin.Engine, bool) {
+	r, _, hasFTS := setupRouterDB(t)
+	return r, hasFTS
+}
+
+// setupRouterDB is like setupRouter but also returns the seeded database.
+func setupRouterDB(t *testing.T) (*gin.Engine, *gorm.DB, bool) {
+	gdb := newTestDB(t)
 
 	// Seed tags
 	tagAnimal := db.Tag{Name: "animal"}
@@ -44,10 +69,7 @@ func setupRouter(t *testing.T) (*gin.Engine, bool) {
 	// Determine if FTS is available
 	hasFTS := gdb.Exec("SELECT 1 FROM images_fts LIMIT 1").Error == nil
 
-	gin.SetMode(gin.TestMode)
-	r := gin.New()
-	api.RegisterRoutes(r, gdb)
-	return r, hasFTS
+	return newRouter(gdb), gdb, hasFTS
 }
 
 func getFileNames(t *testing.T, r *gin.Engine, url string) []string {
@@ -108,3 +130,173 @@ func TestListImagesFilters(t *testing.T) {
 		require.ElementsMatch(t, []string{"cat"}, names)
 	})
 }
+
+func TestListImagesStructuredFilters(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+
+	sdxl := db.Model{Name: "sdxl"}
+	require.NoError(t, gdb.Create(&sdxl).Error)
+	alice := db.Lora{Name: "alice"}
+	require.NoError(t, gdb.Create(&alice).Error)
+	emb := db.Embedding{Name: "easyneg"}
+	require.NoError(t, gdb.Create(&emb).Error)
+
+	require.NoError(t, gdb.Model(&db.Image{}).Where("file_name = ?", "cat").Updates(map[string]any{
+		"model_id": sdxl.ID, "sampler": "Euler", "steps": 30, "cfg_scale": 7.0,
+		"width": 1024, "height": 1024, "rating": 4, "size_bytes": 5000,
+	}).Error)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("file_name = ?", "dog").Updates(map[string]any{
+		"sampler": "DPM++ 2M", "steps": 20, "cfg_scale": 5.0,
+		"width": 832, "height": 1216, "rating": 2, "size_bytes": 3000,
+	}).Error)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("file_name = ?", "sunflower").Updates(map[string]any{
+		"model_id": sdxl.ID, "steps": 50, "width": 512, "height": 512, "rating": 3,
+	}).Error)
+
+	var cat, dog db.Image
+	require.NoError(t, gdb.First(&cat, "file_name = ?", "cat").Error)
+	require.NoError(t, gdb.First(&dog, "file_name = ?", "dog").Error)
+	hi, lo := 0.8, 0.4
+	require.NoError(t, gdb.Create(&db.ImageLora{ImageID: cat.ID, LoraID: alice.ID, Weight: &hi}).Error)
+	require.NoError(t, gdb.Create(&db.ImageLora{ImageID: dog.ID, LoraID: alice.ID, Weight: &lo}).Error)
+	require.NoError(t, gdb.Create(&db.ImageEmbedding{ImageID: dog.ID, EmbeddingID: emb.ID}).Error)
+
+	cases := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"model", "model=sdxl", []string{"cat", "sunflower"}},
+		{"lora", "lora=alice", []string{"cat", "dog"}},
+		{"lora weight", "lora=alice&loraWeightMin=0.7", []string{"cat"}},
+		{"lora and model", "lora=alice&loraWeightMin=0.7&model=sdxl", []string{"cat"}},
+		{"embedding", "embedding=easyneg", []string{"dog"}},
+		{"sampler is case-insensitive", "sampler=euler", []string{"cat"}},
+		{"steps range", "stepsMin=25&stepsMax=40", []string{"cat"}},
+		{"cfg range", "cfgMax=6", []string{"dog"}},
+		{"sdxl dimensions", "widthMin=832&heightMin=832", []string{"cat", "dog"}},
+		{"portrait aspect", "aspectMax=0.9", []string{"dog"}},
+		{"size range", "sizeMin=2000&sizeMax=4000", []string{"dog"}},
+		{"rating min", "ratingMin=3", []string{"cat", "sunflower"}},
+		{"tags any", "tags=cat,flower&tagMode=any", []string{"cat", "sunflower"}},
+		{"tags exclude", "tags=animal&excludeTags=dog", []string{"cat"}},
+		{"tags any exclude", "tags=cat,dog,flower&tagMode=any&excludeTags=cat", []string{"dog", "sunflower"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names := getFileNames(t, r, "/api/images?nsfw=show&"+tc.query)
+			require.ElementsMatch(t, tc.want, names)
+		})
+	}
+
+	t.Run("sort by steps", func(t *testing.T) {
+		names := getFileNames(t, r, "/api/images?nsfw=show&sort=steps&order=asc")
+		require.Equal(t, []string{"dog", "cat", "sunflower"}, names)
+	})
+
+	t.Run("random sort is stable for a seed", func(t *testing.T) {
+		a := getFileNames(t, r, "/api/images?nsfw=show&sort=random&seed=42")
+		b := getFileNames(t, r, "/api/images?nsfw=show&sort=random&seed=42")
+		require.Equal(t, a, b)
+		require.Len(t, a, 3)
+		// Seeds are reduced rather than overflowing the hash.
+		require.Len(t, getFileNames(t, r, "/api/images?nsfw=show&sort=random&seed=9223372036854775807"), 3)
+		require.Len(t, getFileNames(t, r, "/api/images?nsfw=show&sort=random&seed=-5"), 3)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images?stepsMin=abc", nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestListImagesCursorPagination(t *testing.T) {
+	gdb := newTestDB(t)
+	for i := 0; i < 7; i++ {
+		img := db.Image{Path: fmt.Sprintf("img%d.png", i), FileName: fmt.Sprintf("img%d", i), Ext: "png", SizeBytes: 1, SHA256: fmt.Sprintf("sha%d", i)}
+		if i%2 == 0 {
+			steps := 10 + i/2
+			img.Steps = &steps
+		}
+		require.NoError(t, gdb.Create(&img).Error)
+	}
+	r := newRouter(gdb)
+
+	type page struct {
+		Items []struct {
+			FileName string `json:"fileName"`
+		} `json:"items"`
+		Total      int64  `json:"total"`
+		NextCursor string `json:"nextCursor"`
+	}
+	fetch := func(t *testing.T, u string) page {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var p page
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		return p
+	}
+	walk := func(t *testing.T, base string) []string {
+		var names []string
+		p := fetch(t, base+"&cursor=")
+		for {
+			for _, it := range p.Items {
+				names = append(names, it.FileName)
+			}
+			if p.NextCursor == "" {
+				return names
+			}
+			p = fetch(t, base+"&cursor="+url.QueryEscape(p.NextCursor))
+		}
+	}
+
+	for _, sort := range []string{"file_name", "steps", "imported_at", "random"} {
+		for _, order := range []string{"asc", "desc"} {
+			t.Run(sort+" "+order, func(t *testing.T) {
+				base := "/api/images?pageSize=2&count=none&seed=7&sort=" + sort + "&order=" + order
+				want := getFileNames(t, r, "/api/images?pageSize=50&seed=7&sort="+sort+"&order="+order)
+				require.Equal(t, want, walk(t, base))
+			})
+		}
+	}
+
+	t.Run("random without seed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images?pageSize=50&sort=random", nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp struct {
+			Seed *int64 `json:"seed"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.NotNil(t, resp.Seed)
+		want := getFileNames(t, r, fmt.Sprintf("/api/images?pageSize=50&sort=random&seed=%d", *resp.Seed))
+		// Later pages follow the seed carried by the cursor.
+		require.ElementsMatch(t, want, walk(t, "/api/images?pageSize=2&sort=random"))
+	})
+
+	t.Run("stable across inserts", func(t *testing.T) {
+		base := "/api/images?pageSize=3&sort=file_name&order=asc"
+		p := fetch(t, base+"&cursor=")
+		require.NoError(t, gdb.Create(&db.Image{Path: "a.png", FileName: "a", Ext: "png", SizeBytes: 1, SHA256: "shaA"}).Error)
+		p = fetch(t, base+"&cursor="+url.QueryEscape(p.NextCursor))
+		require.Equal(t, "img3", p.Items[0].FileName)
+	})
+
+	t.Run("count modes", func(t *testing.T) {
+		require.Equal(t, int64(-1), fetch(t, "/api/images?count=none").Total)
+		require.Equal(t, int64(8), fetch(t, "/api/images?count=approx").Total)
+	})
+
+	t.Run("cursor must match sort", func(t *testing.T) {
+		p := fetch(t, "/api/images?pageSize=2&sort=file_name&cursor=")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images?pageSize=2&sort=steps&cursor="+url.QueryEscape(p.NextCursor), nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
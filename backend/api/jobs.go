@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"gen-library/backend/jobs"
+)
+
+func listJobs() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"items": jobs.List()})
+	}
+}
+
+func getJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		j, ok := jobs.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, j)
+	}
+}
+
+func cancelJob() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !jobs.Cancel(c.Param("id")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		j, _ := jobs.Get(c.Param("id"))
+		c.JSON(http.StatusOK, j)
+	}
+}
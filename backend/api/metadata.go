@@ -0,0 +1,488 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+	"gen-library/backend/logger"
+	"gen-library/backend/scan"
+)
+
+// optional distinguishes a field that is absent from a patch from one that is
+// explicitly set to null.
+type optional[T any] struct {
+	Set   bool
+	Value *T
+}
+
+func (o *optional[T]) UnmarshalJSON(b []byte) error {
+	o.Set = true
+	if string(b) == "null" {
+		o.Value = nil
+		return nil
+	}
+	var v T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	o.Value = &v
+	return nil
+}
+
+func (o *optional[T]) present() bool { return o.Set }
+func (o *optional[T]) isNull() bool  { return o.Value == nil }
+
+func (o *optional[T]) value() any {
+	if o.Value == nil {
+		return nil
+	}
+	return *o.Value
+}
+
+// patchValue is implemented by every optional field of a patch.
+type patchValue interface {
+	json.Unmarshaler
+	present() bool
+	isNull() bool
+	value() any
+}
+
+type loraPatch struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash"`
+	Weight *float64 `json:"weight"`
+}
+
+// metadataPatch lists the image fields clients may edit. File identity and
+// file-derived columns are owned by the scanner and are deliberately absent.
+type metadataPatch struct {
+	Rating   optional[int]
+	Favorite optional[bool]
+	NSFW     optional[bool]
+	Hidden   optional[bool]
+
+	Prompt                   optional[string]
+	NegativePrompt           optional[string]
+	Sampler                  optional[string]
+	Steps                    optional[int]
+	CFGScale                 optional[float64]
+	Seed                     optional[string]
+	Scheduler                optional[string]
+	ClipSkip                 optional[int]
+	SourceApp                optional[string]
+	VariationSeed            optional[int]
+	VariationSeedStrength    optional[float64]
+	AspectRatio              optional[string]
+	RefinerControlPercentage optional[float64]
+	RefinerUpscale           optional[float64]
+	RefinerUpscaleMethod     optional[string]
+
+	ModelName optional[string]
+	ModelHash optional[string]
+	Loras     optional[[]loraPatch]
+
+	Notes optional[string]
+	// Fields sets custom field values by field name; null clears one.
+	// Fields left out keep their value.
+	Fields optional[map[string]json.RawMessage]
+}
+
+// patchField maps a JSON key to its target and, for plain columns, the
+// database column it updates.
+type patchField struct {
+	column   string
+	value    patchValue
+	nullable bool
+}
+
+func (p *metadataPatch) fields() map[string]patchField {
+	return map[string]patchField{
+		"rating":                   {"rating", &p.Rating, false},
+		"favorite":                 {"favorite", &p.Favorite, false},
+		"nsfw":                     {"nsfw", &p.NSFW, false},
+		"hidden":                   {"hidden", &p.Hidden, false},
+		"prompt":                   {"prompt", &p.Prompt, true},
+		"negativePrompt":           {"negative_prompt", &p.NegativePrompt, true},
+		"sampler":                  {"sampler", &p.Sampler, true},
+		"steps":                    {"steps", &p.Steps, true},
+		"cfgScale":                 {"cfg_scale", &p.CFGScale, true},
+		"seed":                     {"seed", &p.Seed, true},
+		"scheduler":                {"scheduler", &p.Scheduler, true},
+		"clipSkip":                 {"clip_skip", &p.ClipSkip, true},
+		"sourceApp":                {"source_app", &p.SourceApp, true},
+		"variationSeed":            {"variation_seed", &p.VariationSeed, true},
+		"variationSeedStrength":    {"variation_seed_strength", &p.VariationSeedStrength, true},
+		"aspectRatio":              {"aspect_ratio", &p.AspectRatio, true},
+		"refinerControlPercentage": {"refiner_control_percentage", &p.RefinerControlPercentage, true},
+		"refinerUpscale":           {"refiner_upscale", &p.RefinerUpscale, true},
+		"refinerUpscaleMethod":     {"refiner_upscale_method", &p.RefinerUpscaleMethod, true},
+		"modelName":                {"", &p.ModelName, true},
+		"modelHash":                {"", &p.ModelHash, true},
+		"loras":                    {"", &p.Loras, true},
+		"notes":                    {"notes", &p.Notes, true},
+		"fields":                   {"", &p.Fields, false},
+	}
+}
+
+// fieldErrors maps JSON field names to validation messages.
+type fieldErrors map[string]string
+
+func (e fieldErrors) Error() string { return "invalid metadata" }
+
+// decodeMetadataPatch parses a patch body, rejecting unknown fields and
+// values of the wrong type or outside their valid range.
+func decodeMetadataPatch(body []byte) (metadataPatch, error) {
+	var p metadataPatch
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return p, err
+	}
+	fields := p.fields()
+	errs := fieldErrors{}
+	for key, v := range raw {
+		f, ok := fields[key]
+		if !ok {
+			errs[key] = "unknown field"
+			continue
+		}
+		if _, isBool := f.value.(*optional[bool]); isBool {
+			v = normalizeBool(v)
+		}
+		if err := f.value.UnmarshalJSON(v); err != nil {
+			errs[key] = "invalid value"
+			continue
+		}
+		if !f.nullable && f.value.isNull() {
+			errs[key] = "must not be null"
+		}
+	}
+	p.validate(errs)
+	if len(errs) > 0 {
+		return p, errs
+	}
+	return p, nil
+}
+
+// normalizeBool accepts the numeric and string forms older clients send for
+// boolean flags.
+func normalizeBool(v json.RawMessage) json.RawMessage {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		if b, err := strconv.ParseBool(s); err == nil {
+			return json.RawMessage(strconv.FormatBool(b))
+		}
+		return v
+	}
+	var n float64
+	if err := json.Unmarshal(v, &n); err == nil {
+		return json.RawMessage(strconv.FormatBool(n != 0))
+	}
+	return v
+}
+
+func (p *metadataPatch) validate(errs fieldErrors) {
+	check := func(key string, ok bool, msg string) {
+		if _, exists := errs[key]; !exists && !ok {
+			errs[key] = msg
+		}
+	}
+	if v := p.Rating.Value; v != nil {
+		check("rating", *v >= 0 && *v <= 5, "must be between 0 and 5")
+	}
+	if v := p.Steps.Value; v != nil {
+		check("steps", *v > 0, "must be greater than 0")
+	}
+	if v := p.CFGScale.Value; v != nil {
+		check("cfgScale", *v >= 0, "must not be negative")
+	}
+	if v := p.ClipSkip.Value; v != nil {
+		check("clipSkip", *v >= 0, "must not be negative")
+	}
+	if v := p.VariationSeedStrength.Value; v != nil {
+		check("variationSeedStrength", *v >= 0 && *v <= 1, "must be between 0 and 1")
+	}
+	if p.Loras.Value != nil {
+		for i, l := range *p.Loras.Value {
+			check(fmt.Sprintf("loras[%d]", i), l.Name != "" || l.Hash != "", "name or hash is required")
+		}
+	}
+}
+
+// columns returns the plain column updates carried by the patch.
+func (p *metadataPatch) columns() map[string]any {
+	updates := map[string]any{}
+	for _, f := range p.fields() {
+		if f.column != "" && f.value.present() {
+			updates[f.column] = f.value.value()
+		}
+	}
+	return updates
+}
+
+func updateMetadata(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		patch, err := decodeMetadataPatch(body)
+		var ferrs fieldErrors
+		if errors.As(err, &ferrs) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": ferrs.Error(), "fields": ferrs})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if patch.Hidden.Set && !vaultUnlocked(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+			return
+		}
+
+		err = gdb.Transaction(func(tx *gorm.DB) error {
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
+			}
+			return trackChanges(c, tx, auditUpdate, func() error {
+				if err := bumpVersion(tx, id, c.GetHeader("If-Match")); err != nil {
+					return err
+				}
+				return applyMetadataPatch(tx, uint(id), patch, c.Query("recomputeNsfw") == "true")
+			}, id)
+		})
+		switch {
+		case errors.Is(err, errVersionConflict):
+			respondVersionConflict(c, gdb, id)
+			return
+		case errors.Is(err, errVaultLocked):
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		case errors.As(err, &ferrs):
+			c.JSON(http.StatusBadRequest, gin.H{"error": ferrs.Error(), "fields": ferrs})
+			return
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		respondImage(c, gdb)
+	}
+}
+
+// applyMetadataPatch writes a validated patch to an image. The FTS index
+// follows through the images_au trigger, and through the
+// image_field_values triggers for custom fields. An nsfw value that differs
+// from the stored one marks the flag as set by hand. When recomputeNSFW is set and the prompts, model or
+// LoRAs change without an explicit nsfw value, the flag is re-derived from
+// the NSFW policy instead.
+func applyMetadataPatch(tx *gorm.DB, id uint, p metadataPatch, recomputeNSFW bool) error {
+	var img db.Image
+	if err := tx.Select("id").First(&img, id).Error; err != nil {
+		return err
+	}
+
+	updates := p.columns()
+	if p.NSFW.Set && p.NSFW.Value != nil {
+		// Clients send the flag back with every save, so only a change
+		// counts as setting it by hand.
+		updates["nsfw_manual"] = gorm.Expr("nsfw_manual OR nsfw <> ?", *p.NSFW.Value)
+	}
+
+	if p.ModelName.Set || p.ModelHash.Set {
+		name, hash := "", ""
+		if p.ModelName.Value != nil {
+			name = *p.ModelName.Value
+		}
+		if p.ModelHash.Value != nil {
+			hash = *p.ModelHash.Value
+		}
+		modelID, err := resolveModel(tx, name, hash)
+		if err != nil {
+			return err
+		}
+		if modelID == nil && hash != "" {
+			return fieldErrors{"modelHash": "unknown model hash"}
+		}
+		updates["model_id"] = modelID
+	}
+
+	if len(updates) > 0 {
+		if err := tx.Model(&db.Image{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+
+	if p.Loras.Set {
+		if err := tx.Where("image_id = ?", id).Delete(&db.ImageLora{}).Error; err != nil {
+			return err
+		}
+		var loras []loraPatch
+		if p.Loras.Value != nil {
+			loras = *p.Loras.Value
+		}
+		seen := map[uint]bool{}
+		for i, lp := range loras {
+			l, err := resolveLora(tx, lp.Name, lp.Hash)
+			if err != nil {
+				return err
+			}
+			if l == nil {
+				return fieldErrors{fmt.Sprintf("loras[%d]", i): "unknown lora hash"}
+			}
+			if seen[l.ID] {
+				continue
+			}
+			seen[l.ID] = true
+			if err := tx.Create(&db.ImageLora{ImageID: id, LoraID: l.ID, Weight: lp.Weight}).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.Fields.Value != nil && len(*p.Fields.Value) > 0 {
+		if err := applyFieldValues(tx, id, *p.Fields.Value); err != nil {
+			return err
+		}
+	}
+
+	if recomputeNSFW && !p.NSFW.Set &&
+		(p.Prompt.Set || p.NegativePrompt.Set || p.ModelName.Set || p.ModelHash.Set || p.Loras.Set) {
+		nsfw, err := scan.ClassifyImage(tx, id)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&db.Image{}).Where("id = ?", id).
+			Updates(map[string]any{"nsfw": nsfw, "nsfw_manual": false}).Error
+	}
+	return nil
+}
+
+// resolveModel finds or creates the model named name, recording hash on it
+// when it has none. With only a hash, an existing model is looked up; nil is
+// returned when none matches or both are empty.
+func resolveModel(tx *gorm.DB, name, hash string) (*uint, error) {
+	var m db.Model
+	switch {
+	case name != "":
+		err := tx.Where("name = ?", name).First(&m).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			m = db.Model{Name: name}
+			err = tx.Create(&m).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+	case hash != "":
+		err := tx.Where("hash = ?", hash).First(&m).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &m.ID, nil
+	default:
+		return nil, nil
+	}
+
+	if hash == "" || (m.Hash != nil && *m.Hash == hash) {
+		return &m.ID, nil
+	}
+	if m.Hash != nil {
+		// A differing hash that belongs to another model wins over the name.
+		var existing db.Model
+		err := tx.Where("hash = ?", hash).First(&existing).Error
+		if err == nil {
+			return &existing.ID, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	m.Hash = &hash
+	if err := tx.Save(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m.ID, nil
+}
+
+// resolveLora finds or creates a LoRA by name, preferring an existing LoRA
+// with the same hash when the name conflicts. Without a name, only an
+// existing LoRA with the hash is returned; nil means none matched.
+func resolveLora(tx *gorm.DB, name, hash string) (*db.Lora, error) {
+	var l db.Lora
+	if name == "" {
+		err := tx.Where("hash = ?", hash).First(&l).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &l, nil
+	}
+
+	byHash := func() (*db.Lora, error) {
+		var existing db.Lora
+		err := tx.Where("hash = ?", hash).First(&existing).Error
+		if err == nil {
+			logger.Warn().Str("lora", name).Str("existing", existing.Name).Msg("hash conflict for lora; using existing")
+			return &existing, nil
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	err := tx.Where("name = ?", name).First(&l).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if hash != "" {
+			if existing, err := byHash(); existing != nil || err != nil {
+				return existing, err
+			}
+			l = db.Lora{Name: name, Hash: &hash}
+		} else {
+			l = db.Lora{Name: name}
+		}
+		if err := tx.Create(&l).Error; err != nil {
+			return nil, err
+		}
+		return &l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hash == "" || (l.Hash != nil && *l.Hash == hash) {
+		return &l, nil
+	}
+	if l.Hash != nil {
+		if existing, err := byHash(); existing != nil || err != nil {
+			return existing, err
+		}
+	}
+	l.Hash = &hash
+	if err := tx.Save(&l).Error; err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
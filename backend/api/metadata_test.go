@@ -0,0 +1,118 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+// doJSON sends a request with a JSON body and returns the recorded response.
+func doJSON(r *gin.Engine, method, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestUpdateMetadata(t *testing.T) {
+	r, gdb, hasFTS := setupRouterDB(t)
+
+	fieldErrs := func(t *testing.T, w *httptest.ResponseRecorder) map[string]string {
+		t.Helper()
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		var resp struct {
+			Fields map[string]string `json:"fields"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Fields
+	}
+
+	t.Run("rejects unknown and invalid fields", func(t *testing.T) {
+		errs := fieldErrs(t, doJSON(r, http.MethodPut, "/api/images/1/metadata",
+			`{"sha256":"x","ratng":3,"rating":7,"steps":0,"cfgScale":"high","favorite":null,"loras":[{"weight":1}]}`))
+		require.Equal(t, map[string]string{
+			"sha256":   "unknown field",
+			"ratng":    "unknown field",
+			"rating":   "must be between 0 and 5",
+			"steps":    "must be greater than 0",
+			"cfgScale": "invalid value",
+			"favorite": "must not be null",
+			"loras[0]": "name or hash is required",
+		}, errs)
+
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 1).Error)
+		require.Equal(t, "sha1", img.SHA256)
+		require.Equal(t, 0, img.Rating)
+	})
+
+	t.Run("updates and clears fields", func(t *testing.T) {
+		w := doJSON(r, http.MethodPut, "/api/images/1/metadata",
+			`{"rating":4,"nsfw":"1","steps":30,"sampler":"Euler","modelName":"sdxl","modelHash":"abc","loras":[{"name":"detail","hash":"h1","weight":0.6}]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var got struct {
+			Rating    int     `json:"rating"`
+			NSFW      bool    `json:"nsfw"`
+			Steps     *int    `json:"steps"`
+			ModelName *string `json:"modelName"`
+			Loras     []struct {
+				Name   string   `json:"name"`
+				Weight *float64 `json:"weight"`
+			} `json:"loras"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+		require.Equal(t, 4, got.Rating)
+		require.True(t, got.NSFW)
+		require.Equal(t, 30, *got.Steps)
+		require.Equal(t, "sdxl", *got.ModelName)
+		require.Len(t, got.Loras, 1)
+		require.Equal(t, "detail", got.Loras[0].Name)
+		require.InDelta(t, 0.6, *got.Loras[0].Weight, 1e-9)
+
+		w = doJSON(r, http.MethodPut, "/api/images/1/metadata", `{"sampler":null,"modelName":null,"loras":[]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var img db.Image
+		require.NoError(t, gdb.Preload("Loras").First(&img, 1).Error)
+		require.Nil(t, img.Sampler)
+		require.Nil(t, img.ModelID)
+		require.Empty(t, img.Loras)
+		require.Equal(t, 30, *img.Steps)
+		require.Equal(t, 4, img.Rating)
+	})
+
+	t.Run("prompt edits update search and nsfw", func(t *testing.T) {
+		w := doJSON(r, http.MethodPut, "/api/images/3/metadata", `{"prompt":"golden meadow"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		if hasFTS {
+			require.Equal(t, []string{"sunflower"}, getFileNames(t, r, "/api/images?q=meadow"))
+		}
+
+		w = doJSON(r, http.MethodPut, "/api/images/3/metadata?recomputeNsfw=true", `{"prompt":"nude statue"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 3).Error)
+		require.True(t, img.NSFW)
+		if hasFTS {
+			require.Empty(t, getFileNames(t, r, "/api/images?q=meadow&nsfw=show"))
+			require.Equal(t, []string{"sunflower"}, getFileNames(t, r, "/api/images?q=statue&nsfw=show"))
+		}
+
+		// Without the flag the existing classification is kept.
+		w = doJSON(r, http.MethodPut, "/api/images/3/metadata", `{"prompt":"a quiet field"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, gdb.First(&img, 3).Error)
+		require.True(t, img.NSFW)
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodPut, "/api/images/99/metadata", `{"rating":1}`).Code)
+	})
+}
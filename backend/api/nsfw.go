@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"gen-library/backend/db"
+	"gen-library/backend/jobs"
+	"gen-library/backend/scan"
+)
+
+// reclassifyRequest controls a reclassification run. IncludeManual also
+// reclassifies images whose flag was set by hand, clearing that mark.
+type reclassifyRequest struct {
+	DryRun        bool `json:"dryRun"`
+	IncludeManual bool `json:"includeManual"`
+}
+
+type nsfwChange struct {
+	ID   uint `json:"id"`
+	NSFW bool `json:"nsfw"`
+}
+
+// reclassifier derives NSFW flags with the same judge as an import.
+type reclassifier struct {
+	judge         *scan.NSFWJudge
+	includeManual bool
+}
+
+func newReclassifier(gdb *gorm.DB, includeManual bool) (*reclassifier, error) {
+	j, err := scan.LoadNSFWJudge(gdb)
+	if err != nil {
+		return nil, err
+	}
+	return &reclassifier{judge: j, includeManual: includeManual}, nil
+}
+
+// plan returns an image's current flags and the flag it should have. Flags
+// set by hand are kept unless includeManual is set.
+func (r *reclassifier) plan(tx *gorm.DB, id uint) (db.Image, bool, error) {
+	var img db.Image
+	if err := tx.Select("id, nsfw, nsfw_manual").First(&img, id).Error; err != nil {
+		return img, false, err
+	}
+	if r.skips(img) {
+		return img, img.NSFW, nil
+	}
+	nsfw, err := r.judge.Judge(tx, id)
+	return img, nsfw, err
+}
+
+func (r *reclassifier) skips(img db.Image) bool { return img.NSFWManual && !r.includeManual }
+
+func getNSFWPolicy(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, err := scan.LoadNSFWPolicy(gdb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// setNSFWPolicy saves a policy. Omitted fields keep their defaults. Existing
+// images are not changed until a reclassify job runs.
+func setNSFWPolicy(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		p, err := scan.ParseNSFWPolicy(string(body))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		raw, _ := json.Marshal(p)
+		s := db.Setting{Key: scan.NSFWPolicySetting, Value: string(raw)}
+		if err := gdb.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			UpdateAll: true,
+		}).Create(&s).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// reclassifyNSFW applies the current policy to existing images. A dry run
+// lists the flags that would change; otherwise an nsfw_reclassify job writes
+// them. Images whose flag was set by hand are skipped unless includeManual
+// is given.
+func reclassifyNSFW(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req reclassifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		r, err := newReclassifier(gdb, req.IncludeManual)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		var ids []uint
+		if err := gdb.Model(&db.Image{}).Where("deleted_at IS NULL").Order("id").Pluck("id", &ids).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.DryRun {
+			changes := []nsfwChange{}
+			skipped := 0
+			for _, id := range ids {
+				img, nsfw, err := r.plan(gdb, id)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if r.skips(img) {
+					skipped++
+				} else if nsfw != img.NSFW {
+					changes = append(changes, nsfwChange{ID: id, NSFW: nsfw})
+				}
+			}
+			c.JSON(http.StatusOK, gin.H{"dryRun": true, "checked": len(ids), "skipped": skipped, "changes": changes})
+			return
+		}
+
+		if jobs.Running("nsfw_reclassify") {
+			c.JSON(http.StatusConflict, gin.H{"error": "reclassification already running"})
+			return
+		}
+		j := jobs.Start("nsfw_reclassify", func(ctx context.Context, p *jobs.Progress) error {
+			p.SetTotal(int64(len(ids)))
+			var res struct {
+				Flagged   int `json:"flagged"`
+				Unflagged int `json:"unflagged"`
+				Skipped   int `json:"skipped"`
+			}
+			defer func() { p.SetResult(res) }()
+			for _, id := range ids {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				err := gdb.Transaction(func(tx *gorm.DB) error {
+					img, nsfw, err := r.plan(tx, id)
+					switch {
+					case err != nil:
+						return err
+					case r.skips(img):
+						res.Skipped++
+						return nil
+					case nsfw == img.NSFW && !img.NSFWManual:
+						return nil
+					}
+					if err := trackChanges(nil, tx, auditUpdate, func() error {
+						return tx.Model(&db.Image{}).Where("id = ?", id).Updates(map[string]any{
+							"nsfw":        nsfw,
+							"nsfw_manual": false,
+							"version":     gorm.Expr("version + 1"),
+						}).Error
+					}, id); err != nil {
+						return err
+					}
+					if nsfw && !img.NSFW {
+						res.Flagged++
+					} else if !nsfw && img.NSFW {
+						res.Unflagged++
+					}
+					return nil
+				})
+				if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+					return err
+				}
+				p.Add(1)
+			}
+			return nil
+		})
+		c.JSON(http.StatusAccepted, j)
+	}
+}
@@ -0,0 +1,81 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestNSFWReclassify(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 1).Update("prompt", "cat on a cumulus cloud, velvet").Error)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 3).Update("prompt", "sunflower").Error)
+
+	// Saving other fields with the flag unchanged, as the editor does,
+	// leaves it automatic.
+	w := doJSON(r, http.MethodPut, "/api/images/2/metadata", `{"rating":3,"nsfw":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var img db.Image
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	require.False(t, img.NSFWManual)
+
+	// A hand-set flag survives reclassification.
+	w = doJSON(r, http.MethodPut, "/api/images/3/metadata", `{"nsfw":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	require.True(t, img.NSFWManual)
+
+	w = doJSON(r, http.MethodPut, "/api/nsfw/policy", `{"denyRegex":["("]}`)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPut, "/api/settings/nsfw_policy", `{"value":"{\"deny\":1}"}`).Code)
+	w = doJSON(r, http.MethodPut, "/api/nsfw/policy", `{"deny":["velvet"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = doJSON(r, http.MethodGet, "/api/nsfw/policy", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var policy struct {
+		Deny                  []string `json:"deny"`
+		ExcludeNegativePrompt bool     `json:"excludeNegativePrompt"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &policy))
+	require.Equal(t, []string{"velvet"}, policy.Deny)
+	require.True(t, policy.ExcludeNegativePrompt)
+
+	w = doJSON(r, http.MethodPost, "/api/nsfw/reclassify", `{"dryRun":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"dryRun":true,"checked":3,"skipped":1,"changes":[{"id":1,"nsfw":true},{"id":2,"nsfw":false}]}`, w.Body.String())
+
+	w = doJSON(r, http.MethodPost, "/api/nsfw/reclassify", "")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	j := waitJob(t, r, w.Body.Bytes())
+	require.Equal(t, "done", j["status"])
+	require.Equal(t, map[string]any{"flagged": float64(1), "unflagged": float64(1), "skipped": float64(1)}, j["result"])
+
+	nsfw := func(id uint) bool {
+		var img db.Image
+		require.NoError(t, gdb.First(&img, id).Error)
+		return img.NSFW
+	}
+	require.True(t, nsfw(1))
+	require.False(t, nsfw(2))
+	require.True(t, nsfw(3))
+	// The job's changes are recorded as the system's.
+	h := getHistory(t, r, "1")
+	require.Equal(t, []string{"nsfw"}, historyFields(h))
+	require.Equal(t, "system", h[0].Client)
+
+	w = doJSON(r, http.MethodPost, "/api/nsfw/reclassify", `{"includeManual":true}`)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	waitJob(t, r, w.Body.Bytes())
+	require.NoError(t, gdb.First(&img, 3).Error)
+	require.False(t, img.NSFW)
+	require.False(t, img.NSFWManual)
+
+	// recomputeNsfw on a metadata edit uses the policy too.
+	w = doJSON(r, http.MethodPut, "/api/images/3/metadata?recomputeNsfw=true", `{"prompt":"a velvet sunflower"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.True(t, nsfw(3))
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/logger"
+)
+
+// libraryRootsSetting used to list extra library roots. Roots are server
+// configuration now, so the settings endpoints refuse the key.
+const libraryRootsSetting = "library_roots"
+
+// extraRoots are the library roots allowed in addition to library_path, set
+// once at startup from the server's configuration.
+var extraRoots struct {
+	sync.RWMutex
+	paths []string
+}
+
+// SetLibraryRoots sets the folders the backend may use in addition to the
+// library path.
+func SetLibraryRoots(paths []string) {
+	extraRoots.Lock()
+	defer extraRoots.Unlock()
+	extraRoots.paths = append([]string(nil), paths...)
+}
+
+// errOutsideRoots is returned when a path resolves outside every configured
+// library root.
+var errOutsideRoots = errors.New("path is outside the configured library roots")
+
+// libraryRoots returns the library path and the configured extra roots as
+// absolute paths with symlinks resolved.
+func libraryRoots(gdb *gorm.DB) ([]string, error) {
+	var raw []string
+	lp, err := settingValue(gdb, "library_path")
+	if err != nil {
+		return nil, err
+	}
+	if lp != "" {
+		raw = append(raw, lp)
+	}
+	extraRoots.RLock()
+	raw = append(raw, extraRoots.paths...)
+	extraRoots.RUnlock()
+
+	roots := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if strings.TrimSpace(r) == "" {
+			continue
+		}
+		if resolved, err := resolvePath(r); err == nil {
+			roots = append(roots, resolved)
+		}
+	}
+	return roots, nil
+}
+
+// resolvePath returns the absolute form of p with symlinks followed. For a
+// path that does not exist yet, the deepest existing ancestor is resolved
+// and the remainder appended, so a dangling link cannot point outside.
+func resolvePath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	parent, base := filepath.Split(abs)
+	parent = filepath.Clean(parent)
+	if parent == abs {
+		return abs, nil
+	}
+	rp, err := resolvePath(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(rp, base), nil
+}
+
+// imageAbsPath resolves a stored image path, which is relative to the
+// library path unless absolute.
+func imageAbsPath(gdb *gorm.DB, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return p, nil
+	}
+	root, err := settingValue(gdb, "library_path")
+	if err != nil {
+		return "", err
+	}
+	if root != "" {
+		p = filepath.Join(root, p)
+	}
+	return filepath.Abs(p)
+}
+
+// withinRoot reports whether the resolved path p lies inside root.
+func withinRoot(p, root string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel))
+}
+
+// pathInRoots reports whether p, after following symlinks, is inside one of
+// the already resolved roots.
+func pathInRoots(p string, roots []string) bool {
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return false
+	}
+	for _, r := range roots {
+		if withinRoot(resolved, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPathAllowed verifies that p, after following symlinks, is inside one
+// of the library roots. Violations are logged as security events.
+func checkPathAllowed(c *gin.Context, gdb *gorm.DB, p, action string) error {
+	roots, err := libraryRoots(gdb)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		if withinRoot(resolved, r) {
+			return nil
+		}
+	}
+	logSecurityEvent(c, action, p, resolved)
+	return errOutsideRoots
+}
+
+// checkLibraryPath verifies that a new library path stays inside the current
+// roots, so the setting cannot widen what the backend may touch. Any path is
+// accepted while no root is configured yet.
+func checkLibraryPath(c *gin.Context, gdb *gorm.DB, p string) error {
+	roots, err := libraryRoots(gdb)
+	if err != nil || len(roots) == 0 {
+		return err
+	}
+	return checkPathAllowed(c, gdb, p, "set_library_path")
+}
+
+// logSecurityEvent records an attempt to reach a path outside the library.
+func logSecurityEvent(c *gin.Context, action, path, resolved string) {
+	log := logger.With().Str("component", "security").Str("event", "path_violation").Str("action", action).Str("path", path).Str("resolved", resolved).Logger()
+	evt := log.Warn()
+	if c != nil {
+		evt = evt.Str("client_ip", c.ClientIP())
+		if id, ok := c.Get("RequestID"); ok {
+			evt = evt.Interface("request_id", id)
+		}
+	}
+	evt.Msg("")
+}
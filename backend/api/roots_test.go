@@ -0,0 +1,93 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/api"
+	"gen-library/backend/db"
+)
+
+func TestLibraryRootPolicy(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.png")
+	require.NoError(t, os.WriteFile(secret, []byte("secret"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "ok.png"), []byte("ok"), 0o644))
+	require.NoError(t, os.Symlink(secret, filepath.Join(root, "link.png")))
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "ok.png", FileName: "ok.png", Ext: "png", SizeBytes: 2, SHA256: "ok"}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: secret, FileName: "secret.png", Ext: "png", SizeBytes: 6, SHA256: "abs"}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "link.png", FileName: "link.png", Ext: "png", SizeBytes: 6, SHA256: "link"}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "../" + filepath.Base(outside) + "/secret.png", FileName: "dots.png", Ext: "png", SizeBytes: 6, SHA256: "dots"}).Error)
+	r := newRouter(gdb)
+
+	do := func(method, u, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, u, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("serve", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, do(http.MethodGet, "/api/images/1/file", "").Code)
+		for _, id := range []string{"2", "3", "4"} {
+			require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/api/images/"+id+"/file", "").Code, id)
+			require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/api/images/"+id+"/thumb", "").Code, id)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/scan", `{"root":"`+outside+`"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		api.SetLibraryRoots([]string{outside})
+		w = do(http.MethodPost, "/api/scan", `{"root":"`+outside+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		api.SetLibraryRoots(nil)
+	})
+
+	t.Run("settings cannot widen roots", func(t *testing.T) {
+		w := do(http.MethodPut, "/api/settings/library_roots", `{"value":"[\"/\"]"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodPut, "/api/settings/library_path", `{"value":"/"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		w = do(http.MethodPut, "/api/settings/library_path", `{"value":"`+outside+`"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, http.StatusForbidden, do(http.MethodPost, "/api/scan", `{"root":"`+outside+`"}`).Code)
+		require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/api/images/2/file", "").Code)
+
+		// Moving the library within its roots is allowed.
+		sub := filepath.Join(root, "sub")
+		w = do(http.MethodPut, "/api/settings/library_path", `{"value":"`+sub+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		w = do(http.MethodPut, "/api/settings/library_path", `{"value":"`+root+`"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.NoError(t, gdb.Model(&db.Setting{}).Where("key = ?", "library_path").Update("value", root).Error)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		token := confirmToken(t, do(http.MethodDelete, "/api/images/2?mode=hard", ""))
+		w := do(http.MethodDelete, "/api/images/2?mode=hard", `{"token":"`+token+`"}`)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.FileExists(t, secret)
+	})
+
+	t.Run("metadata cannot rewrite path", func(t *testing.T) {
+		w := do(http.MethodPut, "/api/images/1/metadata", `{"path":"`+secret+`","rating":2}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 1).Error)
+		require.Equal(t, "ok.png", img.Path)
+		require.Equal(t, 0, img.Rating)
+	})
+}
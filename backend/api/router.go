@@ -6,18 +6,77 @@ import (
 )
 
 func RegisterRoutes(r *gin.Engine, db *gorm.DB) {
-	api := r.Group("/api")
+	r.GET("/thumbs/*filepath", serveThumbFile(db))
+	r.HEAD("/thumbs/*filepath", serveThumbFile(db))
+
+	api := r.Group("/api", scheduleTraining())
 	{
 		api.GET("/images", listImages(db))
+		api.GET("/images/facets", tagFacets(db))
+		api.GET("/images/export", exportImages(db))
 		api.GET("/images/:id", getImage(db))
 		api.GET("/images/:id/file", serveImage(db))
+		api.HEAD("/images/:id/file", serveImage(db))
+		api.GET("/images/:id/thumb", serveThumb(db))
+		api.GET("/images/:id/tiles.dzi", serveDZI(db))
+		api.GET("/images/:id/tiles_files/:level/:tile", serveTile(db))
 		api.PUT("/images/:id/metadata", updateMetadata(db))
 		api.POST("/images/:id/tags", addTags(db))
 		api.DELETE("/images/:id/tags", removeTags(db))
 		api.DELETE("/images/:id", deleteImage(db))
+		api.GET("/images/:id/history", imageHistory(db))
+		api.POST("/images/:id/revert", revertImage(db))
+		api.POST("/images/bulk", bulkImages(db))
+		api.POST("/images/bulk/edit", bulkEditImages(db))
+		api.GET("/tags", listTags(db))
+		api.POST("/tags/merge", mergeTagsHandler(db))
+		api.PATCH("/tags/:id", renameTag(db))
+		api.DELETE("/tags/:id", deleteTag(db))
+		api.POST("/tags/:id/aliases", addTagAlias(db))
+		api.DELETE("/tags/aliases/:alias", deleteTagAlias(db))
+		api.GET("/albums", listAlbums(db))
+		api.POST("/albums", createAlbum(db))
+		api.GET("/albums/:id", getAlbum(db))
+		api.PATCH("/albums/:id", updateAlbum(db))
+		api.DELETE("/albums/:id", deleteAlbum(db))
+		api.POST("/albums/:id/images", addAlbumImages(db))
+		api.DELETE("/albums/:id/images", removeAlbumImages(db))
+		api.PUT("/albums/:id/order", reorderAlbum(db))
+		api.GET("/searches", listSearches(db))
+		api.POST("/searches", createSearch(db))
+		api.GET("/searches/:id", getSearch(db))
+		api.PATCH("/searches/:id", updateSearch(db))
+		api.DELETE("/searches/:id", deleteSearch(db))
+		api.GET("/fields", listFields(db))
+		api.POST("/fields", createField(db))
+		api.PATCH("/fields/:id", updateField(db))
+		api.DELETE("/fields/:id", deleteField(db))
+		api.GET("/trash", listTrash(db))
+		api.POST("/trash/restore", restoreTrash(db))
+		api.POST("/trash/purge", purgeTrash(db))
+		api.GET("/audit", listAudit(db))
+		api.GET("/rules", listRules(db))
+		api.POST("/rules", createRule(db))
+		api.POST("/rules/apply", applyRules(db))
+		api.PUT("/rules/:id", updateRule(db))
+		api.DELETE("/rules/:id", deleteRule(db))
+		api.GET("/nsfw/policy", getNSFWPolicy(db))
+		api.PUT("/nsfw/policy", setNSFWPolicy(db))
+		api.POST("/nsfw/reclassify", reclassifyNSFW(db))
+		api.POST("/classifier/train", trainClassifier(db))
 		api.POST("/scan", scanFolder(db))
+		api.GET("/vault", getVault(db))
+		api.PUT("/vault/pin", setVaultPIN(db))
+		api.POST("/vault/unlock", unlockVault(db))
+		api.POST("/vault/lock", lockVault())
 		api.GET("/settings/:key", getSetting(db))
 		api.PUT("/settings/:key", setSetting(db))
+		api.GET("/thumbs/stats", getThumbStats(db))
+		api.POST("/thumbs/gc", gcThumbs(db))
+		api.POST("/thumbs/pregenerate", pregenerateThumbs(db))
+		api.GET("/jobs", listJobs())
+		api.GET("/jobs/:id", getJob())
+		api.POST("/jobs/:id/cancel", cancelJob())
 		api.GET("/watcher", getWatcherStatus())
 		api.POST("/watcher/start", startWatcher(db))
 		api.POST("/watcher/stop", stopWatcher())
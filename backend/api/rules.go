@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+	"gen-library/backend/jobs"
+	"gen-library/backend/rules"
+)
+
+// ruleRequest is the body of rule create and update requests. Enabled
+// defaults to true.
+type ruleRequest struct {
+	Name       string           `json:"name"`
+	Enabled    *bool            `json:"enabled"`
+	Priority   int              `json:"priority"`
+	Conditions rules.Conditions `json:"conditions"`
+	Actions    rules.Actions    `json:"actions"`
+}
+
+// applyRulesRequest targets ids, a listImages filter or, with neither, every
+// image outside the trash, hidden ones only while the vault is unlocked.
+// Rules restricts the run to the listed rules, which may be
+// disabled so a new rule can be previewed before it is switched on.
+type applyRulesRequest struct {
+	IDs    []uint  `json:"ids"`
+	Filter *string `json:"filter"`
+	Rules  []uint  `json:"rules"`
+	DryRun bool    `json:"dryRun"`
+}
+
+type ruleMatch struct {
+	ID uint `json:"id"`
+	rules.Outcome
+}
+
+// bindRule decodes and validates a rule, writing a 400 response on failure.
+func bindRule(c *gin.Context, id uint) (db.Rule, bool) {
+	var req ruleRequest
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return db.Rule{}, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if _, err := rules.New(id, req.Name, req.Conditions, req.Actions); err != nil {
+		var verr rules.ValidationError
+		if errors.As(err, &verr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": verr.Error(), "fields": verr})
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return db.Rule{}, false
+	}
+	cond, _ := json.Marshal(req.Conditions)
+	act, _ := json.Marshal(req.Actions)
+	row := db.Rule{ID: id, Name: req.Name, Enabled: true, Priority: req.Priority, Conditions: cond, Actions: act}
+	if req.Enabled != nil {
+		row.Enabled = *req.Enabled
+	}
+	return row, true
+}
+
+func listRules(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		items := []db.Rule{}
+		if err := gdb.Order("priority, id").Find(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+func createRule(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		row, ok := bindRule(c, 0)
+		if !ok {
+			return
+		}
+		if err := gdb.Create(&row).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, row)
+	}
+}
+
+// updateRule replaces a rule.
+func updateRule(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var existing db.Rule
+		if err := gdb.First(&existing, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		row, ok := bindRule(c, existing.ID)
+		if !ok {
+			return
+		}
+		if err := gdb.Save(&row).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, row)
+	}
+}
+
+func deleteRule(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := gdb.Delete(&db.Rule{}, c.Param("id"))
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// applyRules re-runs rules against existing images. A dry run lists the
+// images each rule matches and what would change on them; otherwise a
+// rules_apply job applies the changes, one transaction per image.
+func applyRules(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req applyRulesRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Filter == nil && len(req.IDs) == 0 {
+			// Everything the library shows by default, NSFW included:
+			// never trashed images, and hidden ones only while the
+			// vault is unlocked.
+			all := "nsfw=show"
+			if vaultUnlocked(c) {
+				all += "&hidden=show"
+			}
+			req.Filter = &all
+		}
+		ids, _, err := bulkTargets(c, gdb, req.IDs, req.Filter)
+		if err != nil {
+			respondTargetsError(c, err)
+			return
+		}
+		rs, err := rules.Load(gdb, req.Rules...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Rules) > 0 && len(rs) != len(uniqueIDs(req.Rules)) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+			return
+		}
+
+		if req.DryRun {
+			items := []ruleMatch{}
+			changed := 0
+			for _, id := range ids {
+				o, err := rules.Plan(gdb, rs, id)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if len(o.Rules) == 0 {
+					continue
+				}
+				if !o.Empty() {
+					changed++
+				}
+				items = append(items, ruleMatch{ID: id, Outcome: o})
+			}
+			c.JSON(http.StatusOK, gin.H{"dryRun": true, "matched": len(items), "changed": changed, "items": items})
+			return
+		}
+
+		if jobs.Running("rules_apply") {
+			c.JSON(http.StatusConflict, gin.H{"error": "rules are already being applied"})
+			return
+		}
+		j := jobs.Start("rules_apply", func(ctx context.Context, p *jobs.Progress) error {
+			p.SetTotal(int64(len(ids)))
+			var res struct {
+				Matched int `json:"matched"`
+				Changed int `json:"changed"`
+				Failed  int `json:"failed"`
+			}
+			defer func() { p.SetResult(res) }()
+			for _, id := range ids {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				var o rules.Outcome
+				err := gdb.Transaction(func(tx *gorm.DB) error {
+					var err error
+					if o, err = rules.Plan(tx, rs, id); err != nil {
+						return err
+					}
+					return rules.Apply(tx, id, o)
+				})
+				switch {
+				case errors.Is(err, gorm.ErrRecordNotFound):
+					// Deleted since the job started.
+				case err != nil:
+					res.Failed++
+				case len(o.Rules) > 0:
+					res.Matched++
+					if !o.Empty() {
+						res.Changed++
+					}
+				}
+				p.Add(1)
+			}
+			return nil
+		})
+		c.JSON(http.StatusAccepted, j)
+	}
+}
+
+// uniqueIDs drops duplicate ids, keeping order.
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	out := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
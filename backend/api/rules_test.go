@@ -0,0 +1,174 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+type ruleApplyPreview struct {
+	Matched int `json:"matched"`
+	Changed int `json:"changed"`
+	Items   []struct {
+		ID      uint     `json:"id"`
+		Rules   []uint   `json:"rules"`
+		AddTags []string `json:"addTags"`
+		Rating  *int     `json:"rating"`
+		NSFW    *bool    `json:"nsfw"`
+		Hidden  *bool    `json:"hidden"`
+	} `json:"items"`
+}
+
+func TestTaggingRules(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = ?", 1).Update("prompt", "a tabby CAT").Error)
+	lora := db.Lora{Name: "alice_v2"}
+	require.NoError(t, gdb.Create(&lora).Error)
+	require.NoError(t, gdb.Create(&db.ImageLora{ImageID: 2, LoraID: lora.ID}).Error)
+
+	createRule := func(body string) uint {
+		t.Helper()
+		w := doJSON(r, http.MethodPost, "/api/rules", body)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var rule db.Rule
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rule))
+		return rule.ID
+	}
+	preview := func(body string) ruleApplyPreview {
+		t.Helper()
+		w := doJSON(r, http.MethodPost, "/api/rules/apply", body)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var p ruleApplyPreview
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		return p
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/rules", `{"name":"bad","conditions":{"prompt":"("},"actions":{"rating":9}}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		var resp struct {
+			Fields map[string]string `json:"fields"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Contains(t, resp.Fields, "conditions.prompt")
+		require.Contains(t, resp.Fields, "actions.rating")
+
+		require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/rules", `{"name":"empty","actions":{"favorite":true}}`).Code)
+		require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/rules", `{"name":"typo","conditions":{"lora":["x"]},"actions":{"favorite":true}}`).Code)
+	})
+
+	aliceRule := createRule(`{"name":"alice","conditions":{"loras":["ALICE_V2"]},"actions":{"addTags":["Character: alice"],"rating":4}}`)
+	catRule := createRule(`{"name":"cats","enabled":false,"conditions":{"prompt":"(?i)\\bcat\\b","maxWidth":100},"actions":{"hidden":true}}`)
+
+	t.Run("preview", func(t *testing.T) {
+		p := preview(`{"dryRun":true}`)
+		require.Equal(t, 1, p.Matched)
+		require.Equal(t, 1, p.Changed)
+		require.Equal(t, uint(2), p.Items[0].ID)
+		require.Equal(t, []uint{aliceRule}, p.Items[0].Rules)
+		require.Equal(t, []string{"character:alice"}, p.Items[0].AddTags)
+		require.Equal(t, 4, *p.Items[0].Rating)
+
+		// Disabled rules can be previewed by id.
+		p = preview(fmt.Sprintf(`{"dryRun":true,"rules":[%d]}`, catRule))
+		require.Equal(t, 1, p.Matched)
+		require.Equal(t, uint(1), p.Items[0].ID)
+		require.True(t, *p.Items[0].Hidden)
+
+		require.Zero(t, preview(`{"dryRun":true,"ids":[1,3]}`).Matched)
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodPost, "/api/rules/apply", `{"dryRun":true,"rules":[999]}`).Code)
+	})
+
+	t.Run("apply job", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/rules/apply", `{}`)
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		j := waitJob(t, r, w.Body.Bytes())
+		require.Equal(t, "done", j["status"])
+		require.Equal(t, map[string]any{"matched": float64(1), "changed": float64(1), "failed": float64(0)}, j["result"])
+
+		require.ElementsMatch(t, []string{"animal", "dog", "character:alice"}, imageTagNames(t, r, 2))
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 2).Error)
+		require.Equal(t, 4, img.Rating)
+		require.Equal(t, 2, img.Version)
+
+		p := preview(`{"dryRun":true}`)
+		require.Equal(t, 1, p.Matched)
+		require.Zero(t, p.Changed)
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		w := doJSON(r, http.MethodPut, fmt.Sprintf("/api/rules/%d", catRule), `{"name":"cats","priority":5,"conditions":{"prompt":"cat"},"actions":{"hidden":true}}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var rule db.Rule
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rule))
+		require.True(t, rule.Enabled)
+
+		// Matching is case sensitive unless the pattern says otherwise.
+		require.Equal(t, 1, preview(`{"dryRun":true}`).Matched)
+
+		w = doJSON(r, http.MethodGet, "/api/rules", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var list struct {
+			Items []db.Rule `json:"items"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Items, 2)
+		require.Equal(t, aliceRule, list.Items[0].ID)
+
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, fmt.Sprintf("/api/rules/%d", catRule), "").Code)
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, fmt.Sprintf("/api/rules/%d", catRule), "").Code)
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodPut, "/api/rules/999", `{}`).Code)
+	})
+
+	t.Run("scope", func(t *testing.T) {
+		add := func(name string, set map[string]any) uint {
+			prompt := "scope test"
+			img := db.Image{Path: name + ".png", FileName: name, Ext: "png", SizeBytes: 1, SHA256: name, Prompt: &prompt}
+			require.NoError(t, gdb.Create(&img).Error)
+			require.NoError(t, gdb.Model(&img).Updates(set).Error)
+			return img.ID
+		}
+		trashed := add("trashed", map[string]any{"deleted_at": time.Now()})
+		hidden := add("hidden", map[string]any{"hidden": true})
+		manual := add("manual", map[string]any{"nsfw": true, "nsfw_manual": true})
+		flagged := add("flagged", map[string]any{"nsfw": true})
+		createRule(`{"name":"scope","conditions":{"prompt":"scope"},"actions":{"nsfw":false,"rating":2}}`)
+
+		items := func(p ruleApplyPreview) map[uint]*bool {
+			out := map[uint]*bool{}
+			for _, it := range p.Items {
+				out[it.ID] = it.NSFW
+			}
+			return out
+		}
+		got := items(preview(`{"dryRun":true}`))
+		require.NotContains(t, got, trashed)
+		require.NotContains(t, got, hidden)
+		require.Contains(t, got, manual)
+		require.Nil(t, got[manual], "a hand-set NSFW flag is kept")
+		require.False(t, *got[flagged])
+
+		token := unlockTestVault(t, r)
+		w := doVault(r, http.MethodPost, "/api/rules/apply", `{"dryRun":true}`, token)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var p ruleApplyPreview
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		require.Contains(t, items(p), hidden)
+
+		w = doJSON(r, http.MethodPost, "/api/rules/apply", `{}`)
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+		require.Equal(t, "done", waitJob(t, r, w.Body.Bytes())["status"])
+		var imgs []db.Image
+		require.NoError(t, gdb.Order("id").Find(&imgs, []uint{trashed, hidden, manual, flagged}).Error)
+		require.Equal(t, []int{0, 0, 2, 2}, []int{imgs[0].Rating, imgs[1].Rating, imgs[2].Rating, imgs[3].Rating})
+		require.True(t, imgs[2].NSFW)
+		require.False(t, imgs[3].NSFW)
+	})
+}
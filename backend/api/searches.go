@@ -0,0 +1,290 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// pagingParams page a listing rather than select images, so they are not
+// stored with a saved search.
+var pagingParams = []string{"page", "pageSize", "cursor", "count"}
+
+var errSearchNotFound = errors.New("saved search not found")
+
+// searchDTO is a saved search with the number of images it currently
+// matches. Count is null for searches revealing hidden images while the
+// vault is locked.
+type searchDTO struct {
+	db.SavedSearch
+	Count *int64 `json:"count"`
+}
+
+// searchRequest is the body of saved search create and update requests. On
+// update, omitted fields are left unchanged.
+type searchRequest struct {
+	Name  *string `json:"name"`
+	Query *string `json:"query"`
+}
+
+// expandSearch replaces search=<id> with the saved query. Parameters given
+// alongside it override the saved ones, so a saved search can be paged or
+// narrowed further.
+func expandSearch(gdb *gorm.DB, v url.Values) (url.Values, error) {
+	id := v.Get("search")
+	if id == "" {
+		return v, nil
+	}
+	var s db.SavedSearch
+	if err := gdb.First(&s, "id = ?", id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errSearchNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	out, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range v {
+		if k != "search" {
+			out[k] = vs
+		}
+	}
+	return out, nil
+}
+
+// listQuery returns the request's query parameters with any saved search
+// expanded, writing the error response on failure.
+func listQuery(c *gin.Context, gdb *gorm.DB) (url.Values, bool) {
+	v, err := expandSearch(gdb, c.Request.URL.Query())
+	switch {
+	case errors.Is(err, errSearchNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return v, true
+}
+
+// normalizeSearchQuery validates a query string as listImages would parse
+// it and drops paging parameters.
+func normalizeSearchQuery(raw string) (string, error) {
+	v, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(raw), "?"))
+	if err != nil {
+		return "", fmt.Errorf("invalid query: %w", err)
+	}
+	if v.Has("search") {
+		return "", errors.New("a saved search cannot refer to another")
+	}
+	for _, p := range pagingParams {
+		v.Del(p)
+	}
+	if _, err := parseImageFilter(v); err != nil {
+		return "", err
+	}
+	return v.Encode(), nil
+}
+
+// loadSearchDTOs returns saved searches with their live counts.
+func loadSearchDTOs(c *gin.Context, gdb *gorm.DB, q *gorm.DB) ([]searchDTO, error) {
+	var searches []db.SavedSearch
+	if err := q.Find(&searches).Error; err != nil {
+		return nil, err
+	}
+	unlocked := vaultUnlocked(c)
+	out := make([]searchDTO, len(searches))
+	for i, s := range searches {
+		out[i].SavedSearch = s
+		v, err := url.ParseQuery(s.Query)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parseImageFilter(v)
+		if err != nil {
+			return nil, err
+		}
+		if f.Hidden != "hide" && !unlocked {
+			continue
+		}
+		var n int64
+		img := gdb.Table("images").Joins("LEFT JOIN models ON images.model_id = models.id")
+		if err := f.apply(gdb, img).Count(&n).Error; err != nil {
+			return nil, err
+		}
+		out[i].Count = &n
+	}
+	return out, nil
+}
+
+// respondSearch writes the current state of a saved search.
+func respondSearch(c *gin.Context, gdb *gorm.DB, id uint, status int) {
+	items, err := loadSearchDTOs(c, gdb, gdb.Where("id = ?", id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(items) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(status, items[0])
+}
+
+// listSearches returns every saved search with the number of images it
+// matches, for showing them as collections.
+func listSearches(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		items, err := loadSearchDTOs(c, gdb, gdb.Order("name"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+func getSearch(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var s db.SavedSearch
+		if err := gdb.First(&s, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondSearch(c, gdb, s.ID, http.StatusOK)
+	}
+}
+
+// bindSearch decodes and validates a saved search request, writing a 400
+// response on failure. The query is normalized in place.
+func bindSearch(c *gin.Context) (searchRequest, bool) {
+	var req searchRequest
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	fields := fieldErrors{}
+	if req.Name != nil {
+		*req.Name = strings.TrimSpace(*req.Name)
+		if *req.Name == "" {
+			fields["name"] = "must not be empty"
+		}
+	}
+	if req.Query != nil {
+		q, err := normalizeSearchQuery(*req.Query)
+		if err != nil {
+			fields["query"] = err.Error()
+		}
+		*req.Query = q
+	}
+	if len(fields) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid saved search", "fields": fields})
+		return req, false
+	}
+	return req, true
+}
+
+// searchNameTaken reports whether another saved search already uses name,
+// writing a 409 response if so.
+func searchNameTaken(c *gin.Context, gdb *gorm.DB, name string, id uint) bool {
+	var n int64
+	if err := gdb.Model(&db.SavedSearch{}).Where("name = ? AND id <> ?", name, id).Count(&n).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a saved search with that name exists"})
+		return true
+	}
+	return false
+}
+
+func createSearch(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindSearch(c)
+		if !ok {
+			return
+		}
+		fields := fieldErrors{}
+		if req.Name == nil {
+			fields["name"] = "is required"
+		}
+		if req.Query == nil {
+			fields["query"] = "is required"
+		}
+		if len(fields) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid saved search", "fields": fields})
+			return
+		}
+		if searchNameTaken(c, gdb, *req.Name, 0) {
+			return
+		}
+		s := db.SavedSearch{Name: *req.Name, Query: *req.Query}
+		if err := gdb.Create(&s).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondSearch(c, gdb, s.ID, http.StatusCreated)
+	}
+}
+
+// updateSearch renames a saved search or replaces its query.
+func updateSearch(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var s db.SavedSearch
+		if err := gdb.First(&s, c.Param("id")).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		req, ok := bindSearch(c)
+		if !ok {
+			return
+		}
+		if req.Name != nil {
+			if searchNameTaken(c, gdb, *req.Name, s.ID) {
+				return
+			}
+			s.Name = *req.Name
+		}
+		if req.Query != nil {
+			s.Query = *req.Query
+		}
+		if err := gdb.Save(&s).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondSearch(c, gdb, s.ID, http.StatusOK)
+	}
+}
+
+func deleteSearch(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := gdb.Delete(&db.SavedSearch{}, c.Param("id"))
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
@@ -0,0 +1,94 @@
+package api_test
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSavedSearches(t *testing.T) {
+	r, _, _ := setupRouterDB(t)
+
+	for _, body := range []string{
+		`{"name":" ","query":"tags=animal"}`,
+		`{"name":"x"}`,
+		`{"name":"x","query":"stepsMin=many"}`,
+		`{"name":"x","query":"search=1"}`,
+	} {
+		require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/searches", body).Code, body)
+	}
+	w := doJSON(r, http.MethodPost, "/api/searches", `{"name":"Animals","query":"?tags=animal&nsfw=show&sort=file_name&order=desc&page=3"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var s struct {
+		ID    uint   `json:"id"`
+		Name  string `json:"name"`
+		Query string `json:"query"`
+		Count *int64 `json:"count"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &s))
+	require.Equal(t, "nsfw=show&order=desc&sort=file_name&tags=animal", s.Query)
+	require.NotNil(t, s.Count)
+	require.EqualValues(t, 2, *s.Count)
+	require.Equal(t, http.StatusConflict, doJSON(r, http.MethodPost, "/api/searches", `{"name":"Animals","query":""}`).Code)
+
+	// A search of hidden images has no count while the vault is locked.
+	w = doJSON(r, http.MethodPost, "/api/searches", `{"name":"Vault","query":"hidden=only"}`)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"count":null`)
+	w = doJSON(r, http.MethodGet, "/api/searches", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"Animals"`)
+
+	require.Equal(t, []string{"dog", "cat"}, getFileNames(t, r, "/api/images?search=1"))
+	require.Equal(t, []string{"cat", "dog"}, getFileNames(t, r, "/api/images?search=1&order=asc"))
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodGet, "/api/images?search=99", "").Code)
+	require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, "/api/images?search=2", "").Code)
+
+	resp := postBulk(t, r, `{"filter":"search=1","actions":{"rating":4},"dryRun":true}`)
+	require.Equal(t, []uint{1, 2}, resp.IDs)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodPost, "/api/images/bulk", `{"filter":"search=99","actions":{"rating":4}}`).Code)
+
+	t.Run("export", func(t *testing.T) {
+		w := doJSON(r, http.MethodGet, "/api/images/export?search=1", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Contains(t, w.Header().Get("Content-Disposition"), "images.json")
+		var rows []struct {
+			ID       uint     `json:"id"`
+			FileName string   `json:"fileName"`
+			Tags     []string `json:"tags"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		require.Len(t, rows, 2)
+		require.Equal(t, "dog", rows[0].FileName)
+		require.ElementsMatch(t, []string{"animal", "cat"}, rows[1].Tags)
+
+		w = doJSON(r, http.MethodGet, "/api/images/export?format=csv&sort=file_name&order=asc", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, records, 3)
+		require.Equal(t, "fileName", records[0][2])
+		require.Equal(t, []string{"cat", "sunflower"}, []string{records[1][2], records[2][2]})
+
+		w = doJSON(r, http.MethodGet, "/api/images/export?format=xml", "")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		w = doJSON(r, http.MethodGet, "/api/images/export?tags=none", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `[]`, w.Body.String())
+	})
+
+	w = doJSON(r, http.MethodPatch, "/api/searches/1", `{"name":"Vault"}`)
+	require.Equal(t, http.StatusConflict, w.Code)
+	w = doJSON(r, http.MethodPatch, "/api/searches/1", `{"query":"tags=flower"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"count":1`)
+	require.Equal(t, []string{"sunflower"}, getFileNames(t, r, "/api/images?search=1"))
+
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/searches/1", "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/searches/1", "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodGet, "/api/searches/1", "").Code)
+}
@@ -9,11 +9,16 @@ import (
 	"gorm.io/gorm/clause"
 
 	"gen-library/backend/db"
+	"gen-library/backend/scan"
 )
 
 func getSetting(gdb *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key := c.Param("key")
+		if key == vaultPINSetting {
+			c.JSON(http.StatusForbidden, gin.H{"error": "use /api/vault"})
+			return
+		}
 		var s db.Setting
 		if err := gdb.First(&s, "key = ?", key).Error; err != nil {
 			if errors.Is(err, gorm.ErrRecordNotFound) {
@@ -37,6 +42,31 @@ func setSetting(gdb *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		switch key {
+		case vaultPINSetting:
+			c.JSON(http.StatusForbidden, gin.H{"error": "use /api/vault/pin"})
+			return
+		case libraryRootsSetting:
+			c.JSON(http.StatusForbidden, gin.H{"error": "library roots are set with LIBRARY_ROOTS on the server"})
+			return
+		case trashPathSetting:
+			c.JSON(http.StatusForbidden, gin.H{"error": "the trash folder is set with TRASH_PATH on the server"})
+			return
+		case "library_path":
+			if err := checkLibraryPath(c, gdb, body.Value); errors.Is(err, errOutsideRoots) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if key == scan.NSFWPolicySetting {
+			if _, err := scan.ParseNSFWPolicy(body.Value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
 		s := db.Setting{Key: key, Value: body.Value}
 		if err := gdb.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "key"}},
@@ -48,3 +78,12 @@ func setSetting(gdb *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"value": s.Value})
 	}
 }
+
+// settingValue returns the value of a setting, or "" if it is not set.
+func settingValue(gdb *gorm.DB, key string) (string, error) {
+	var v string
+	if err := gdb.Table("settings").Select("value").Where("key=?", key).Scan(&v).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+	return v, nil
+}
@@ -0,0 +1,583 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"gen-library/backend/db"
+)
+
+type tagDTO struct {
+	ID        uint     `json:"id"`
+	Name      string   `json:"name"`
+	Namespace string   `json:"namespace"`
+	ParentID  *uint    `json:"parentId"`
+	Count     int64    `json:"count"`
+	Aliases   []string `json:"aliases"`
+}
+
+// tagGroup holds the tags of one namespace; tags without a namespace are
+// grouped under "".
+type tagGroup struct {
+	Namespace string   `json:"namespace"`
+	Items     []tagDTO `json:"items"`
+}
+
+var (
+	errTagExists = errors.New("a tag with that name exists")
+	errTagCycle  = errors.New("a tag cannot be moved under itself")
+)
+
+// tagSubtreeSQL selects the ids of the tags named by its two arguments, as
+// names or aliases, together with all of their descendants.
+const tagSubtreeSQL = `WITH RECURSIVE subtree(id) AS (
+	SELECT id FROM tags WHERE name IN ? OR id IN (SELECT tag_id FROM tag_aliases WHERE alias IN ?)
+	UNION SELECT tags.id FROM tags JOIN subtree ON tags.parent_id = subtree.id
+) SELECT id FROM subtree`
+
+// orphanTagSQL matches tags that no image carries and that have no children,
+// which removing a tag from images cleans up.
+const orphanTagSQL = "NOT EXISTS (SELECT 1 FROM image_tags WHERE image_tags.tag_id = tags.id) AND " +
+	"NOT EXISTS (SELECT 1 FROM tags c WHERE c.parent_id = tags.id)"
+
+// tagIDSubtreeSQL is like tagSubtreeSQL but starts from tag ids.
+const tagIDSubtreeSQL = `WITH RECURSIVE subtree(id) AS (
+	SELECT id FROM tags WHERE id IN ?
+	UNION SELECT tags.id FROM tags JOIN subtree ON tags.parent_id = subtree.id
+) SELECT id FROM subtree`
+
+// canonicalTagNames canonicalizes names, dropping any left empty.
+func canonicalTagNames(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		if n = db.CanonicalTagName(n); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// childTagName returns the name child takes when moved under parent.
+func childTagName(parent, child string) string {
+	ns, path := db.SplitTagName(parent)
+	_, leaf := db.SplitTagName(child)
+	if len(leaf) == 0 {
+		return parent
+	}
+	return db.JoinTagName(ns, append(path, leaf[len(leaf)-1]))
+}
+
+// tagSubtreeIDs returns the ids of tag id and all of its descendants.
+func tagSubtreeIDs(tx *gorm.DB, id uint) ([]uint, error) {
+	var ids []uint
+	err := tx.Raw(tagIDSubtreeSQL, []uint{id}).Scan(&ids).Error
+	return ids, err
+}
+
+// taggedImages returns the ids of the images carrying one of the tags, as
+// trackChanges takes them.
+func taggedImages(tx *gorm.DB, tagIDs []uint) ([]any, error) {
+	var images []any
+	err := tx.Model(&db.ImageTag{}).Distinct("image_id").Where("tag_id IN ?", tagIDs).Order("image_id").Pluck("image_id", &images).Error
+	return images, err
+}
+
+// bumpTaggedImages increments the version of every image carrying one of
+// the tags, since renaming or merging a tag changes those images.
+func bumpTaggedImages(tx *gorm.DB, tagIDs []uint) error {
+	return tx.Model(&db.Image{}).
+		Where("id IN (SELECT image_id FROM image_tags WHERE tag_id IN ?)", tagIDs).
+		UpdateColumn("version", gorm.Expr("version + 1")).Error
+}
+
+// mergeTags moves every image of the source tags onto target and deletes the
+// sources. Their aliases follow; with alias set, the source names become
+// aliases of target too.
+func mergeTags(tx *gorm.DB, target db.Tag, sources []db.Tag, alias bool) error {
+	ids := make([]uint, 0, len(sources))
+	for _, s := range sources {
+		if s.ID != target.ID {
+			ids = append(ids, s.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := bumpTaggedImages(tx, ids); err != nil {
+		return err
+	}
+	stmts := []struct {
+		sql  string
+		args []any
+	}{
+		{`INSERT OR IGNORE INTO image_tags (image_id, tag_id) SELECT image_id, ? FROM image_tags WHERE tag_id IN ?`, []any{target.ID, ids}},
+		{`DELETE FROM image_tags WHERE tag_id IN ?`, []any{ids}},
+		{`UPDATE tag_aliases SET tag_id = ? WHERE tag_id IN ?`, []any{target.ID, ids}},
+		{`DELETE FROM tags WHERE id IN ?`, []any{ids}},
+	}
+	for _, s := range stmts {
+		if err := tx.Exec(s.sql, s.args...).Error; err != nil {
+			return err
+		}
+	}
+	if alias {
+		for _, s := range sources {
+			if s.ID == target.ID {
+				continue
+			}
+			if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).
+				Create(&db.TagAlias{Alias: s.Name, TagID: target.ID}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTagTree merges sources into target like mergeTags, first moving the
+// children of each source under target.
+func mergeTagTree(tx *gorm.DB, target db.Tag, sources []db.Tag, alias bool) error {
+	for _, s := range sources {
+		if s.ID == target.ID {
+			continue
+		}
+		sub, err := tagSubtreeIDs(tx, s.ID)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(sub, target.ID) {
+			return errTagCycle
+		}
+		var children []db.Tag
+		if err := tx.Where("parent_id = ?", s.ID).Find(&children).Error; err != nil {
+			return err
+		}
+		for _, child := range children {
+			if _, err := renameTagTx(tx, child, childTagName(target.Name, child.Name), alias); err != nil {
+				return err
+			}
+		}
+		if err := mergeTags(tx, target, []db.Tag{s}, alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameTagTx renames t and its descendants, merging into an existing tag of
+// the same name. It returns the id of the resulting tag.
+func renameTagTx(tx *gorm.DB, t db.Tag, name string, alias bool) (uint, error) {
+	if name == t.Name {
+		return t.ID, nil
+	}
+	if strings.HasPrefix(name, t.Name+"/") {
+		return 0, errTagCycle
+	}
+	var existing db.Tag
+	err := tx.Where("name = ?", name).First(&existing).Error
+	if err == nil {
+		return existing.ID, mergeTagTree(tx, existing, []db.Tag{t}, alias)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+
+	// A real tag name must not be shadowed by an alias.
+	if err := tx.Where("alias = ?", name).Delete(&db.TagAlias{}).Error; err != nil {
+		return 0, err
+	}
+	ns, _ := db.SplitTagName(name)
+	var parentID *uint
+	if pn := db.ParentTagName(name); pn != "" {
+		p, err := db.EnsureTag(tx, pn)
+		if err != nil {
+			return 0, err
+		}
+		parentID = &p.ID
+	}
+	if err := bumpTaggedImages(tx, []uint{t.ID}); err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&db.Tag{}).Where("id = ?", t.ID).
+		Updates(map[string]any{"name": name, "namespace": ns, "parent_id": parentID}).Error; err != nil {
+		return 0, err
+	}
+	if alias {
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(&db.TagAlias{Alias: t.Name, TagID: t.ID}).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	var children []db.Tag
+	if err := tx.Where("parent_id = ?", t.ID).Find(&children).Error; err != nil {
+		return 0, err
+	}
+	for _, child := range children {
+		if _, err := renameTagTx(tx, child, childTagName(name, child.Name), alias); err != nil {
+			return 0, err
+		}
+	}
+	return t.ID, nil
+}
+
+// groupTags splits tags by namespace, keeping their order within a group.
+func groupTags(tags []tagDTO) []tagGroup {
+	groups := []tagGroup{}
+	index := map[string]int{}
+	for _, t := range tags {
+		i, ok := index[t.Namespace]
+		if !ok {
+			i = len(groups)
+			index[t.Namespace] = i
+			groups = append(groups, tagGroup{Namespace: t.Namespace})
+		}
+		groups[i].Items = append(groups[i].Items, t)
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Namespace < groups[j].Namespace })
+	return groups
+}
+
+// loadTagDTOs returns tags with their image counts and aliases. Hidden
+// images are only counted when hidden is set; trashed images never are.
+func loadTagDTOs(gdb *gorm.DB, q *gorm.DB, hidden bool) ([]tagDTO, error) {
+	excluded := "deleted_at IS NOT NULL"
+	if !hidden {
+		excluded += " OR hidden = 1"
+	}
+	join := "LEFT JOIN image_tags ON image_tags.tag_id = tags.id AND image_tags.image_id NOT IN (SELECT id FROM images WHERE " + excluded + ")"
+	var tags []tagDTO
+	if err := q.Table("tags").
+		Select("tags.id, tags.name, tags.namespace, tags.parent_id, COUNT(image_tags.image_id) AS count").
+		Joins(join).
+		Group("tags.id").
+		Scan(&tags).Error; err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return []tagDTO{}, nil
+	}
+	ids := make([]uint, len(tags))
+	byID := make(map[uint]*tagDTO, len(tags))
+	for i := range tags {
+		tags[i].Aliases = []string{}
+		ids[i] = tags[i].ID
+		byID[tags[i].ID] = &tags[i]
+	}
+	var aliases []db.TagAlias
+	if err := gdb.Where("tag_id IN ?", ids).Order("alias").Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+	for _, a := range aliases {
+		if t := byID[a.TagID]; t != nil {
+			t.Aliases = append(t.Aliases, a.Alias)
+		}
+	}
+	return tags, nil
+}
+
+// listTags returns every tag with the number of images carrying it. q
+// filters by name or alias substring, namespace restricts to one namespace
+// and sort is name (default) or count. With group=namespace the tags are
+// returned grouped by namespace.
+func listTags(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := gdb
+		if s := strings.TrimSpace(c.Query("q")); s != "" {
+			like := "%" + s + "%"
+			q = q.Where("tags.name LIKE ? OR tags.id IN (SELECT tag_id FROM tag_aliases WHERE alias LIKE ?)", like, like)
+		}
+		if ns, ok := c.GetQuery("namespace"); ok {
+			q = q.Where("tags.namespace = ?", strings.ToLower(strings.TrimSpace(ns)))
+		}
+		switch c.DefaultQuery("sort", "name") {
+		case "count":
+			q = q.Order("count DESC").Order("tags.name")
+		case "name":
+			q = q.Order("tags.name")
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid sort"})
+			return
+		}
+		tags, err := loadTagDTOs(gdb, q, vaultUnlocked(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if c.Query("group") == "namespace" {
+			c.JSON(http.StatusOK, gin.H{"groups": groupTags(tags)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": tags})
+	}
+}
+
+// respondTag writes the current state of a tag.
+func respondTag(c *gin.Context, gdb *gorm.DB, id uint) {
+	tags, err := loadTagDTOs(gdb, gdb.Where("tags.id = ?", id), vaultUnlocked(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(tags) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, tags[0])
+}
+
+// renameTag renames a tag. If another tag already has the new name the two
+// are merged. With alias set, the old name keeps resolving to the tag.
+func renameTag(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Name  string `json:"name"`
+			Alias bool   `json:"alias"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		name := db.CanonicalTagName(body.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+			return
+		}
+
+		var result uint
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			var t db.Tag
+			if err := tx.First(&t, c.Param("id")).Error; err != nil {
+				return err
+			}
+			ids, err := tagSubtreeIDs(tx, t.ID)
+			if err != nil {
+				return err
+			}
+			images, err := taggedImages(tx, ids)
+			if err != nil {
+				return err
+			}
+			return trackChanges(c, tx, auditUpdate, func() error {
+				var err error
+				result, err = renameTagTx(tx, t, name, body.Alias)
+				return err
+			}, images...)
+		})
+		respondTagChange(c, gdb, result, err)
+	}
+}
+
+// respondTagChange writes the outcome of a rename or merge.
+func respondTagChange(c *gin.Context, gdb *gorm.DB, id uint, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	case errors.Is(err, errTagCycle):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		respondTag(c, gdb, id)
+	}
+}
+
+// mergeTagsHandler merges the source tags, given by name or alias, into the
+// target tag, creating the target if needed.
+func mergeTagsHandler(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Sources []string `json:"sources"`
+			Target  string   `json:"target"`
+			Alias   bool     `json:"alias"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		target := db.CanonicalTagName(body.Target)
+		names := uniqueNames(body.Sources)
+		if target == "" || len(names) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sources and target are required"})
+			return
+		}
+
+		var result uint
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			var sources []db.Tag
+			for _, n := range names {
+				t, err := db.LookupTag(tx, n)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				sources = append(sources, t)
+			}
+			if len(sources) == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			var ids []uint
+			for _, s := range sources {
+				sub, err := tagSubtreeIDs(tx, s.ID)
+				if err != nil {
+					return err
+				}
+				ids = append(ids, sub...)
+			}
+			images, err := taggedImages(tx, ids)
+			if err != nil {
+				return err
+			}
+			return trackChanges(c, tx, auditUpdate, func() error {
+				t, err := db.ResolveTag(tx, target)
+				if err != nil {
+					return err
+				}
+				result = t.ID
+				return mergeTagTree(tx, t, sources, body.Alias)
+			}, images...)
+		})
+		respondTagChange(c, gdb, result, err)
+	}
+}
+
+// deleteTag removes a tag and its descendants from every image, along with
+// their aliases.
+func deleteTag(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var removed int64
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			var t db.Tag
+			if err := tx.First(&t, c.Param("id")).Error; err != nil {
+				return err
+			}
+			ids, err := tagSubtreeIDs(tx, t.ID)
+			if err != nil {
+				return err
+			}
+			images, err := taggedImages(tx, ids)
+			if err != nil {
+				return err
+			}
+			return trackChanges(c, tx, auditUpdate, func() error {
+				if err := bumpTaggedImages(tx, ids); err != nil {
+					return err
+				}
+				res := tx.Where("tag_id IN ?", ids).Delete(&db.ImageTag{})
+				if res.Error != nil {
+					return res.Error
+				}
+				removed = res.RowsAffected
+				if err := tx.Where("tag_id IN ?", ids).Delete(&db.TagAlias{}).Error; err != nil {
+					return err
+				}
+				return tx.Where("id IN ?", ids).Delete(&db.Tag{}).Error
+			}, images...)
+		})
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "images": removed})
+	}
+}
+
+// addTagAlias makes an extra name resolve to a tag in addTags. An alias
+// cannot reuse the name of an existing tag.
+func addTagAlias(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Alias string `json:"alias"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		alias := db.CanonicalTagName(body.Alias)
+		if alias == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "alias is required"})
+			return
+		}
+
+		var tagID uint
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			var t db.Tag
+			if err := tx.First(&t, c.Param("id")).Error; err != nil {
+				return err
+			}
+			tagID = t.ID
+			var n int64
+			if err := tx.Model(&db.Tag{}).Where("name = ?", alias).Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				return errTagExists
+			}
+			return tx.Clauses(clause.OnConflict{UpdateAll: true}).
+				Create(&db.TagAlias{Alias: alias, TagID: t.ID}).Error
+		})
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		case errors.Is(err, errTagExists):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			respondTag(c, gdb, tagID)
+		}
+	}
+}
+
+func deleteTagAlias(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		res := gdb.Where("alias = ?", db.CanonicalTagName(c.Param("alias"))).Delete(&db.TagAlias{})
+		if res.Error != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+			return
+		}
+		if res.RowsAffected == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
+
+// tagFacets counts the tags on the images matching a listImages filter,
+// grouped by namespace and ordered by count within each group.
+func tagFacets(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, ok := listQuery(c, gdb)
+		if !ok {
+			return
+		}
+		filter, err := parseImageFilter(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !checkHiddenFilter(c, filter) {
+			return
+		}
+		matched := filter.apply(gdb, gdb.Table("images").Joins("LEFT JOIN models ON images.model_id = models.id")).
+			Select("images.id")
+		q := gdb.Where("image_tags.image_id IN (?)", matched).Order("count DESC, tags.name")
+		tags, err := loadTagDTOs(gdb, q, vaultUnlocked(c))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"groups": groupTags(tags)})
+	}
+}
@@ -0,0 +1,210 @@
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+type tagItem struct {
+	ID      uint     `json:"id"`
+	Name    string   `json:"name"`
+	Count   int64    `json:"count"`
+	Aliases []string `json:"aliases"`
+}
+
+func listTagItems(t *testing.T, r *gin.Engine, url string) []tagItem {
+	t.Helper()
+	w := doJSON(r, http.MethodGet, url, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Items []tagItem `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Items
+}
+
+func imageTagNames(t *testing.T, r *gin.Engine, id uint) []string {
+	t.Helper()
+	w := doJSON(r, http.MethodGet, fmt.Sprintf("/api/images/%d", id), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var img db.Image
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &img))
+	names := []string{}
+	for _, tag := range img.Tags {
+		names = append(names, tag.Name)
+	}
+	return names
+}
+
+func TestTagManagement(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	tagID := func(name string) uint {
+		var tag db.Tag
+		require.NoError(t, gdb.Where("name = ?", name).First(&tag).Error)
+		return tag.ID
+	}
+
+	t.Run("list", func(t *testing.T) {
+		items := listTagItems(t, r, "/api/tags?sort=count")
+		require.Len(t, items, 4)
+		require.Equal(t, tagItem{ID: tagID("animal"), Name: "animal", Count: 2, Aliases: []string{}}, items[0])
+		require.Equal(t, "cat", listTagItems(t, r, "/api/tags?q=ca")[0].Name)
+		require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodGet, "/api/tags?sort=size", "").Code)
+	})
+
+	t.Run("rename keeps alias", func(t *testing.T) {
+		w := doJSON(r, http.MethodPatch, fmt.Sprintf("/api/tags/%d", tagID("flower")), `{"name":"flowers","alias":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var tag tagItem
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tag))
+		require.Equal(t, "flowers", tag.Name)
+		require.Equal(t, []string{"flower"}, tag.Aliases)
+		require.Equal(t, []string{"flowers"}, imageTagNames(t, r, 3))
+
+		var img db.Image
+		require.NoError(t, gdb.First(&img, 3).Error)
+		require.Equal(t, 2, img.Version)
+
+		// addTags resolves the alias instead of recreating the old tag.
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodPost, "/api/images/1/tags", `{"tags":["flower"]}`).Code)
+		require.ElementsMatch(t, []string{"animal", "cat", "flowers"}, imageTagNames(t, r, 1))
+		require.Len(t, listTagItems(t, r, "/api/tags"), 4)
+	})
+
+	t.Run("rename onto existing name merges", func(t *testing.T) {
+		w := doJSON(r, http.MethodPatch, fmt.Sprintf("/api/tags/%d", tagID("dog")), `{"name":"cat"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var tag tagItem
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tag))
+		require.Equal(t, tagItem{ID: tagID("cat"), Name: "cat", Count: 2, Aliases: []string{}}, tag)
+		require.ErrorIs(t, gdb.Where("name = ?", "dog").First(&db.Tag{}).Error, gorm.ErrRecordNotFound)
+		require.ElementsMatch(t, []string{"animal", "cat"}, imageTagNames(t, r, 2))
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		w := doJSON(r, http.MethodPost, "/api/tags/merge", `{"sources":["cat","animal","missing"],"target":"pet","alias":true}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var tag tagItem
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tag))
+		require.Equal(t, "pet", tag.Name)
+		require.EqualValues(t, 2, tag.Count)
+		require.Equal(t, []string{"animal", "cat"}, tag.Aliases)
+		require.ElementsMatch(t, []string{"pet", "flowers"}, imageTagNames(t, r, 1))
+
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodPost, "/api/images/3/tags", `{"tags":["cat"]}`).Code)
+		require.ElementsMatch(t, []string{"pet", "flowers"}, imageTagNames(t, r, 3))
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/images/3/tags", `{"tags":["animal"]}`).Code)
+		require.ElementsMatch(t, []string{"flowers"}, imageTagNames(t, r, 3))
+
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodPost, "/api/tags/merge", `{"sources":["nothing"],"target":"pet"}`).Code)
+	})
+
+	t.Run("aliases", func(t *testing.T) {
+		pet := tagID("pet")
+		require.Equal(t, http.StatusConflict, doJSON(r, http.MethodPost, fmt.Sprintf("/api/tags/%d/aliases", pet), `{"alias":"flowers"}`).Code)
+		w := doJSON(r, http.MethodPost, fmt.Sprintf("/api/tags/%d/aliases", pet), `{"alias":"kitty"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "pet", listTagItems(t, r, "/api/tags?q=kitty")[0].Name)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/tags/aliases/kitty", "").Code)
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/tags/aliases/kitty", "").Code)
+	})
+
+	t.Run("delete everywhere", func(t *testing.T) {
+		w := doJSON(r, http.MethodDelete, fmt.Sprintf("/api/tags/%d", tagID("pet")), "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"ok":true,"images":2}`, w.Body.String())
+		require.ElementsMatch(t, []string{"flowers"}, imageTagNames(t, r, 1))
+		require.Empty(t, imageTagNames(t, r, 2))
+		var n int64
+		require.NoError(t, gdb.Model(&db.TagAlias{}).Count(&n).Error)
+		require.EqualValues(t, 1, n)
+		require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodDelete, "/api/tags/999", "").Code)
+	})
+}
+
+func TestHierarchicalTags(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	tagByName := func(name string) db.Tag {
+		var tag db.Tag
+		require.NoError(t, gdb.Where("name = ?", name).First(&tag).Error)
+		return tag
+	}
+
+	w := doJSON(r, http.MethodPost, "/api/images/1/tags", `{"tags":["Project: book-cover / chapter-3","style:watercolor"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodPost, "/api/images/3/tags", `{"tags":["project:book-cover/chapter-4"]}`).Code)
+
+	t.Run("addTags builds the hierarchy", func(t *testing.T) {
+		parent := tagByName("project:book-cover")
+		child := tagByName("project:book-cover/chapter-3")
+		require.Equal(t, "project", parent.Namespace)
+		require.Nil(t, parent.ParentID)
+		require.Equal(t, "project", child.Namespace)
+		require.Equal(t, parent.ID, *child.ParentID)
+		require.Equal(t, "style", tagByName("style:watercolor").Namespace)
+	})
+
+	t.Run("parent filter matches descendants", func(t *testing.T) {
+		require.ElementsMatch(t, []string{"cat", "sunflower"}, getFileNames(t, r, "/api/images?tags=project:book-cover"))
+		require.ElementsMatch(t, []string{"cat"}, getFileNames(t, r, "/api/images?tags=project:book-cover,animal"))
+		require.ElementsMatch(t, []string{"cat"}, getFileNames(t, r, "/api/images?tags=project:book-cover/chapter-3"))
+		require.Empty(t, getFileNames(t, r, "/api/images?tags=project:book-cover&excludeTags=animal,flower"))
+	})
+
+	t.Run("grouped listing and facets", func(t *testing.T) {
+		w := doJSON(r, http.MethodGet, "/api/tags?group=namespace", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Groups []struct {
+				Namespace string    `json:"namespace"`
+				Items     []tagItem `json:"items"`
+			} `json:"groups"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		namespaces := []string{}
+		for _, g := range resp.Groups {
+			namespaces = append(namespaces, g.Namespace)
+		}
+		require.Equal(t, []string{"", "project", "style"}, namespaces)
+		require.Len(t, resp.Groups[1].Items, 3)
+		require.Len(t, listTagItems(t, r, "/api/tags?namespace=style"), 1)
+
+		w = doJSON(r, http.MethodGet, "/api/images/facets?tags=animal&nsfw=show", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		resp.Groups = nil
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Len(t, resp.Groups, 3)
+		require.Equal(t, "animal", resp.Groups[0].Items[0].Name)
+		require.EqualValues(t, 2, resp.Groups[0].Items[0].Count)
+		require.Equal(t, "project:book-cover/chapter-3", resp.Groups[1].Items[0].Name)
+	})
+
+	t.Run("rename moves the subtree", func(t *testing.T) {
+		parent := tagByName("project:book-cover")
+		w := doJSON(r, http.MethodPatch, fmt.Sprintf("/api/tags/%d", parent.ID), `{"name":"project:poster"}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		child := tagByName("project:poster/chapter-3")
+		require.Equal(t, parent.ID, *child.ParentID)
+		require.ElementsMatch(t, []string{"animal", "cat", "project:poster/chapter-3", "style:watercolor"}, imageTagNames(t, r, 1))
+
+		w = doJSON(r, http.MethodPatch, fmt.Sprintf("/api/tags/%d", parent.ID), `{"name":"project:poster/old"}`)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("delete removes the subtree", func(t *testing.T) {
+		w := doJSON(r, http.MethodDelete, fmt.Sprintf("/api/tags/%d", tagByName("project:poster").ID), "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.JSONEq(t, `{"ok":true,"images":2}`, w.Body.String())
+		var n int64
+		require.NoError(t, gdb.Model(&db.Tag{}).Where("namespace = ?", "project").Count(&n).Error)
+		require.Zero(t, n)
+	})
+}
@@ -0,0 +1,375 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/jobs"
+	"gen-library/backend/logger"
+	"gen-library/backend/util"
+)
+
+// thumbCacheMaxSetting holds the thumbnail cache size cap in megabytes.
+const thumbCacheMaxSetting = "thumb_cache_max_mb"
+
+// nsfwBlurSetting turns on blur mode. While it is "1" or "true", thumbnails
+// of NSFW images are only served blurred, whatever the client asks for.
+const nsfwBlurSetting = "nsfw_blur"
+
+// blurMode reports whether blur mode is on.
+func blurMode(gdb *gorm.DB) (bool, error) {
+	v, err := settingValue(gdb, nsfwBlurSetting)
+	v = strings.ToLower(strings.TrimSpace(v))
+	return v == "1" || v == "true", err
+}
+
+// serveThumb returns a thumbnail of the requested width, generating it on
+// demand. The width is snapped to util.ThumbSizes and the format is chosen
+// from the Accept header. blur=1 returns the blurred variant, which is also
+// the only one served for NSFW images in blur mode.
+func serveThumb(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		img, err := lookupImageFile(c, gdb, c.Param("id"), "thumb")
+		if err != nil {
+			respondImageFileError(c, err)
+			return
+		}
+
+		w, _ := strconv.Atoi(c.Query("w"))
+		width := util.ThumbWidth(w)
+		format := negotiateThumbFormat(c.GetHeader("Accept"))
+
+		b := c.Query("blur")
+		blur := b == "1" || strings.ToLower(b) == "true"
+		if !blur && img.NSFW {
+			if blur, err = blurMode(gdb); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		var p string
+		if blur {
+			util.CountThumbLookup(util.BlurThumbCached(img.BlurID, width, format))
+			p, err = util.GenerateBlurThumb(img.BlurID, img.SHA256, img.AbsPath, width, format)
+		} else {
+			util.CountThumbLookup(util.ThumbCached(img.SHA256, width, format))
+			p, err = util.GenerateThumb(img.SHA256, img.AbsPath, width, format)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Header("Vary", "Accept")
+		serveFileCached(c, p, filepath.Base(p), cacheRevalidate)
+	}
+}
+
+// imageFile is the file level information of an image row.
+type imageFile struct {
+	ID       uint
+	Path     string
+	SHA256   string `gorm:"column:sha256"`
+	Width    *int
+	Height   *int
+	BlurID   string
+	Hidden   bool
+	NSFW     bool
+	Trashed  bool
+	TrashDir *string
+	AbsPath  string `gorm:"-"`
+}
+
+// lookupImageFile loads an image's file information and resolves its path
+// against the library root. It returns gorm.ErrRecordNotFound for unknown ids,
+// errVaultLocked for hidden images without an unlocked vault and
+// errOutsideRoots when the file is not inside a library root, or for trashed
+// images, the trash folder.
+func lookupImageFile(c *gin.Context, gdb *gorm.DB, id, action string) (imageFile, error) {
+	var img imageFile
+	res := gdb.Table("images").Select("id, path, sha256, width, height, COALESCE(blur_id, '') AS blur_id, hidden, nsfw, deleted_at IS NOT NULL AS trashed, trash_dir").Where("id = ?", id).Limit(1).Scan(&img)
+	if res.Error != nil {
+		return img, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return img, gorm.ErrRecordNotFound
+	}
+	if img.Hidden && !vaultUnlocked(c) {
+		return img, errVaultLocked
+	}
+	abs, err := imageAbsPath(gdb, img.Path)
+	if err != nil {
+		return img, err
+	}
+	img.AbsPath = abs
+	if img.Trashed {
+		if ok, err := inTrashDir(gdb, abs, img.TrashDir); err != nil {
+			return img, err
+		} else if !ok {
+			return img, errOutsideRoots
+		}
+		return img, nil
+	}
+	if err := checkPathAllowed(c, gdb, img.AbsPath, action); err != nil {
+		return img, err
+	}
+	return img, nil
+}
+
+// respondImageFileError maps lookupImageFile errors to HTTP responses.
+func respondImageFileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	case errors.Is(err, errOutsideRoots), errors.Is(err, errVaultLocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// negotiateThumbFormat picks WebP when the client accepts it and an encoder is
+// available, JPEG otherwise.
+func negotiateThumbFormat(accept string) string {
+	if util.WebPSupported() && strings.Contains(accept, "image/webp") {
+		return util.FormatWebP
+	}
+	return util.FormatJPEG
+}
+
+// thumbURL returns the URL the gallery should load for an image. A cached
+// default thumbnail is linked directly; otherwise the on-demand endpoint is
+// returned so listing never waits on image encoding. Hidden images always go
+// through the endpoint, which checks the vault. With blur set the blurred
+// variant is linked instead, named by blurID so the URL does not reveal the
+// sha.
+func thumbURL(id uint, sha, blurID string, hidden, blur bool) string {
+	cached, key, p, query := util.ThumbCached, sha, util.ThumbPath(sha, util.DefaultThumbWidth), ""
+	if blur {
+		cached, key, p, query = util.BlurThumbCached, blurID, util.BlurThumbPathFormat(blurID, util.DefaultThumbWidth, util.FormatJPEG), "&blur=1"
+	}
+	if !hidden && cached(key, util.DefaultThumbWidth, util.FormatJPEG) {
+		return "/thumbs/" + filepath.Base(p)
+	}
+	return "/api/images/" + strconv.FormatUint(uint64(id), 10) + "/thumb?w=" + strconv.Itoa(util.DefaultThumbWidth) + query
+}
+
+// thumbCacheLimit returns the configured cache cap in bytes, or 0 if unset.
+func thumbCacheLimit(gdb *gorm.DB) (int64, error) {
+	v, err := settingValue(gdb, thumbCacheMaxSetting)
+	if err != nil || v == "" {
+		return 0, err
+	}
+	mb, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return mb << 20, nil
+}
+
+func getThumbStats(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		st, err := util.ThumbStats()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		limit, _ := thumbCacheLimit(gdb)
+		c.JSON(http.StatusOK, gin.H{
+			"files":    st.Files,
+			"bytes":    st.Bytes,
+			"hits":     st.Hits,
+			"misses":   st.Misses,
+			"maxBytes": limit,
+		})
+	}
+}
+
+// gcThumbs starts a job that removes thumbnails of images no longer in the
+// library and then applies the size cap.
+func gcThumbs(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jobs.Running("thumb_gc") {
+			c.JSON(http.StatusConflict, gin.H{"error": "thumbnail gc already running"})
+			return
+		}
+		j := jobs.Start("thumb_gc", func(ctx context.Context, p *jobs.Progress) error {
+			res, err := runThumbGC(gdb)
+			p.SetResult(res)
+			return err
+		})
+		c.JSON(http.StatusAccepted, j)
+	}
+}
+
+type thumbGCResult struct {
+	Orphans      int   `json:"orphans"`
+	OrphanBytes  int64 `json:"orphanBytes"`
+	Evicted      int   `json:"evicted"`
+	EvictedBytes int64 `json:"evictedBytes"`
+}
+
+func runThumbGC(gdb *gorm.DB) (thumbGCResult, error) {
+	var res thumbGCResult
+	var keys []struct {
+		SHA256 string `gorm:"column:sha256"`
+		BlurID string
+	}
+	if err := gdb.Table("images").Select("sha256, COALESCE(blur_id, '') AS blur_id").Scan(&keys).Error; err != nil {
+		return res, err
+	}
+	// Blurred thumbnails are named by blur id, the others by sha.
+	known := make(map[string]struct{}, 2*len(keys))
+	for _, k := range keys {
+		known[k.SHA256] = struct{}{}
+		known[k.BlurID] = struct{}{}
+	}
+	var err error
+	res.Orphans, res.OrphanBytes, err = util.GCThumbs(func(sha string) bool {
+		_, ok := known[sha]
+		return ok
+	})
+	if err != nil {
+		return res, err
+	}
+	limit, err := thumbCacheLimit(gdb)
+	if err != nil {
+		return res, err
+	}
+	res.Evicted, res.EvictedBytes, err = util.EnforceThumbCacheLimit(limit)
+	return res, err
+}
+
+// pregenerateThumbs starts a job that generates the requested thumbnail width
+// for every image, plus the blurred variant for NSFW images, reporting
+// progress through the jobs API.
+func pregenerateThumbs(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jobs.Running("thumb_pregenerate") {
+			c.JSON(http.StatusConflict, gin.H{"error": "pregeneration already running"})
+			return
+		}
+		w, _ := strconv.Atoi(c.Query("w"))
+		width := util.ThumbWidth(w)
+		root, err := settingValue(gdb, "library_path")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		roots, err := libraryRoots(gdb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		j := jobs.Start("thumb_pregenerate", func(ctx context.Context, p *jobs.Progress) error {
+			var total int64
+			if err := gdb.Table("images").Where("deleted_at IS NULL").Count(&total).Error; err != nil {
+				return err
+			}
+			p.SetTotal(total)
+
+			type row struct {
+				ID       uint
+				Path     string
+				SHA256   string `gorm:"column:sha256"`
+				BlurID   string
+				BlurHash *string
+				NSFW     bool
+			}
+			var (
+				lastID uint
+				failed int
+			)
+			for {
+				var batch []row
+				if err := gdb.Table("images").Select("id, path, sha256, COALESCE(blur_id, '') AS blur_id, blur_hash, nsfw").Where("id > ? AND deleted_at IS NULL", lastID).Order("id").Limit(200).Scan(&batch).Error; err != nil {
+					return err
+				}
+				if len(batch) == 0 {
+					break
+				}
+				for _, r := range batch {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+					src := r.Path
+					if root != "" && !filepath.IsAbs(src) {
+						src = filepath.Join(root, src)
+					}
+					if !pathInRoots(src, roots) {
+						logSecurityEvent(nil, "thumb_pregenerate", src, "")
+						failed++
+						p.Add(1)
+						continue
+					}
+					thumb, err := util.GenerateThumb(r.SHA256, src, width, util.FormatJPEG)
+					if err == nil && r.NSFW {
+						_, err = util.GenerateBlurThumb(r.BlurID, r.SHA256, src, width, util.FormatJPEG)
+					}
+					if err != nil {
+						failed++
+					} else if r.BlurHash == nil {
+						// Backfill placeholders for thumbnails cached
+						// before BlurHash existed.
+						if hash, err := util.BlurHashFile(thumb); err == nil {
+							storeBlurHash(gdb, r.SHA256, hash)
+						}
+					}
+					p.Add(1)
+				}
+				lastID = batch[len(batch)-1].ID
+			}
+			p.SetResult(gin.H{"width": width, "failed": failed})
+
+			limit, err := thumbCacheLimit(gdb)
+			if err != nil {
+				return err
+			}
+			_, _, err = util.EnforceThumbCacheLimit(limit)
+			return err
+		})
+		c.JSON(http.StatusAccepted, j)
+	}
+}
+
+// StartThumbJanitor periodically applies the thumbnail cache size cap until
+// ctx is cancelled.
+func StartThumbJanitor(ctx context.Context, gdb *gorm.DB, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			limit, err := thumbCacheLimit(gdb)
+			if err == nil {
+				_, _, err = util.EnforceThumbCacheLimit(limit)
+			}
+			if err != nil {
+				log := logger.With().Str("component", "thumbs").Str("event", "janitor").Logger()
+				log.Warn().Err(err).Msg("")
+			}
+		}
+	}
+}
+
+// BlurHashRecorder returns a util.OnBlurHash callback that stores placeholders
+// on the matching image rows.
+func BlurHashRecorder(gdb *gorm.DB) func(sha, hash string) {
+	return func(sha, hash string) { storeBlurHash(gdb, sha, hash) }
+}
+
+func storeBlurHash(gdb *gorm.DB, sha, hash string) {
+	if err := gdb.Table("images").Where("sha256 = ?", sha).Update("blur_hash", hash).Error; err != nil {
+		log := logger.With().Str("component", "thumbs").Str("event", "blurhash").Str("sha256", sha).Logger()
+		log.Warn().Err(err).Msg("")
+	}
+}
@@ -0,0 +1,264 @@
+package api_test
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	api "gen-library/backend/api"
+	"gen-library/backend/db"
+	"gen-library/backend/util"
+)
+
+func TestServeThumb(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+
+	src := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for x := 0; x < 1000; x++ {
+		src.Set(x, 0, color.RGBA{R: 255, A: 255})
+	}
+	f, err := os.Create(filepath.Join(root, "wide.png"))
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, src))
+	require.NoError(t, f.Close())
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	img := db.Image{Path: "wide.png", FileName: "wide.png", Ext: "png", SizeBytes: 1, SHA256: "widesha"}
+	require.NoError(t, gdb.Create(&img).Error)
+	r := newRouter(gdb)
+	util.OnBlurHash = api.BlurHashRecorder(gdb)
+	t.Cleanup(func() { util.OnBlurHash = nil })
+
+	t.Run("list returns placeholder until generated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images", nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Contains(t, w.Body.String(), `"thumbUrl":"/api/images/1/thumb?w=400"`)
+	})
+
+	t.Run("width snaps to a fixed size", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images/1/thumb?w=300", nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+
+		cfg, _, err := image.DecodeConfig(w.Body)
+		require.NoError(t, err)
+		require.Equal(t, 400, cfg.Width)
+		require.Equal(t, 200, cfg.Height)
+	})
+
+	t.Run("webp for clients that accept it", func(t *testing.T) {
+		if !util.WebPSupported() {
+			t.Skip("built without a WebP encoder")
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images/1/thumb?w=300", nil)
+		req.Header.Set("Accept", "image/webp,image/*")
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "image/webp", w.Header().Get("Content-Type"))
+
+		cfg, format, err := image.DecodeConfig(w.Body)
+		require.NoError(t, err)
+		require.Equal(t, "webp", format)
+		require.Equal(t, 400, cfg.Width)
+	})
+
+	t.Run("list links cached thumbnail", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images", nil)
+		r.ServeHTTP(w, req)
+		require.Contains(t, w.Body.String(), `"thumbUrl":"/thumbs/widesha_400.jpg"`)
+		require.NotContains(t, w.Body.String(), `"blurHash":null`)
+	})
+
+	t.Run("unknown image", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/images/99/thumb", nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestBlurredThumb(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+
+	// A fine checkerboard: its detail must not survive blurring.
+	src := image.NewGray(image.Rect(0, 0, 800, 400))
+	for x := 0; x < 800; x++ {
+		for y := 0; y < 400; y++ {
+			if (x/4+y/4)%2 == 0 {
+				src.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	f, err := os.Create(filepath.Join(root, "check.png"))
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, src))
+	require.NoError(t, f.Close())
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "check.png", FileName: "check", Ext: "png", SizeBytes: 1, SHA256: "checksha", NSFW: true}).Error)
+	r := newRouter(gdb)
+	var blurID string
+	require.NoError(t, gdb.Table("images").Where("id = 1").Pluck("blur_id", &blurID).Error)
+	require.Len(t, blurID, 32)
+
+	require.Contains(t, doJSON(r, http.MethodGet, "/api/images?nsfw=blur", "").Body.String(), `"thumbUrl":"/api/images/1/thumb?w=400\u0026blur=1"`)
+	require.Contains(t, doJSON(r, http.MethodGet, "/api/images?nsfw=show", "").Body.String(), `"thumbUrl":"/api/images/1/thumb?w=400"`)
+	require.NotContains(t, doJSON(r, http.MethodGet, "/api/images", "").Body.String(), "check")
+
+	w := doJSON(r, http.MethodGet, "/api/images/1/thumb?blur=1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	thumb, _, err := image.Decode(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, 400, thumb.Bounds().Dx())
+	var lo, hi uint32 = 0xffff, 0
+	for x := 0; x < 400; x++ {
+		for y := 0; y < 200; y++ {
+			v, _, _, _ := thumb.At(x, y).RGBA()
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	require.Less(t, hi-lo, uint32(0x4000), "blurred thumbnail keeps contrast")
+
+	// Once cached, the blurred variant is linked directly under its blur
+	// id, which does not lead to the plain thumbnail.
+	blurURL := "/thumbs/" + blurID + "_400b.jpg"
+	blurred, err := os.ReadFile(".cache/thumbs/" + blurID + "_400b.jpg")
+	require.NoError(t, err)
+	require.Contains(t, doJSON(r, http.MethodGet, "/api/images?nsfw=blur", "").Body.String(), `"thumbUrl":"`+blurURL+`"`)
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, blurURL, "").Code)
+	require.Equal(t, http.StatusNotFound, doJSON(r, http.MethodGet, "/thumbs/checksha_400b.jpg", "").Code)
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/thumbs/checksha_400.jpg", "").Code)
+
+	t.Run("blur mode", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodPut, "/api/settings/nsfw_blur", `{"value":"1"}`).Code)
+		t.Cleanup(func() { doJSON(r, http.MethodPut, "/api/settings/nsfw_blur", `{"value":""}`) })
+
+		require.Contains(t, doJSON(r, http.MethodGet, "/api/images?nsfw=show", "").Body.String(), `"thumbUrl":"`+blurURL+`"`)
+		w := doJSON(r, http.MethodGet, "/api/images/1/thumb", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Equal(t, blurred, w.Body.Bytes())
+		require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, "/thumbs/checksha_400.jpg", "").Code)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, blurURL, "").Code)
+	})
+}
+
+// waitJob polls the jobs API until the job finishes and returns its body.
+func waitJob(t *testing.T, r http.Handler, body []byte) map[string]any {
+	t.Helper()
+	var j map[string]any
+	require.NoError(t, json.Unmarshal(body, &j))
+	id := j["id"].(string)
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/api/jobs/"+id, nil)
+		r.ServeHTTP(w, req)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &j))
+		return j["status"] != "running"
+	}, 5*time.Second, 10*time.Millisecond)
+	return j
+}
+
+func TestThumbCacheManagement(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+	createTestPNG(t, filepath.Join(root, "a.png"), 600, 300)
+	createTestPNG(t, filepath.Join(root, "b.png"), 600, 300)
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "a.png", FileName: "a.png", Ext: "png", SizeBytes: 1, SHA256: "shaa"}).Error)
+	require.NoError(t, gdb.Create(&db.Image{Path: "b.png", FileName: "b.png", Ext: "png", SizeBytes: 1, SHA256: "shab"}).Error)
+	// Trashed images are skipped.
+	trashed := time.Now()
+	require.NoError(t, gdb.Create(&db.Image{Path: "/trash/c.png", FileName: "c.png", Ext: "png", SizeBytes: 1, SHA256: "shac", DeletedAt: &trashed}).Error)
+	r := newRouter(gdb)
+
+	require.NoError(t, os.MkdirAll(".cache/thumbs", 0o755))
+	orphan := ".cache/thumbs/gone_400.jpg"
+	require.NoError(t, os.WriteFile(orphan, []byte("stale"), 0o644))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/api/thumbs/pregenerate?w=200", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	j := waitJob(t, r, w.Body.Bytes())
+	require.Equal(t, "done", j["status"])
+	require.EqualValues(t, 2, j["done"])
+	require.EqualValues(t, 0, j["result"].(map[string]any)["failed"])
+	require.FileExists(t, ".cache/thumbs/shaa_200.jpg")
+	require.FileExists(t, ".cache/thumbs/shab_200.jpg")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/api/thumbs/gc", nil)
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code)
+	j = waitJob(t, r, w.Body.Bytes())
+	require.Equal(t, "done", j["status"])
+	require.EqualValues(t, 1, j["result"].(map[string]any)["orphans"])
+	require.NoFileExists(t, orphan)
+	require.FileExists(t, ".cache/thumbs/shaa_200.jpg")
+
+	t.Run("size cap evicts least recently used", func(t *testing.T) {
+		old := time.Now().Add(-24 * time.Hour)
+		require.NoError(t, os.Chtimes(".cache/thumbs/shaa_200.jpg", old, old))
+		fi, err := os.Stat(".cache/thumbs/shab_200.jpg")
+		require.NoError(t, err)
+		// The setting is in megabytes, so drive the byte-level cap directly.
+		_, _, err = util.EnforceThumbCacheLimit(fi.Size())
+		require.NoError(t, err)
+		require.NoFileExists(t, ".cache/thumbs/shaa_200.jpg")
+		require.FileExists(t, ".cache/thumbs/shab_200.jpg")
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		stats := func() map[string]any {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/api/thumbs/stats", nil)
+			r.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+			var st map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+			return st
+		}
+		before := stats()
+		require.EqualValues(t, 1, before["files"])
+
+		// Listing links cached thumbnails without counting; each served
+		// thumbnail counts once.
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/api/images", "").Code)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/api/images/2/thumb?w=200", "").Code)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/thumbs/shab_200.jpg", "").Code)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/api/images/1/thumb?w=200", "").Code)
+		after := stats()
+		require.EqualValues(t, 2, after["hits"].(float64)-before["hits"].(float64))
+		require.EqualValues(t, 1, after["misses"].(float64)-before["misses"].(float64))
+	})
+}
+
+func createTestPNG(t *testing.T, path string, w, h int) {
+	t.Helper()
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, w, h))))
+	require.NoError(t, f.Close())
+}
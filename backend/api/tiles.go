@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/util"
+)
+
+// dziImage is the Deep Zoom descriptor of an image.
+type dziImage struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image" json:"-"`
+	Format   string   `xml:"Format,attr" json:"format"`
+	Overlap  int      `xml:"Overlap,attr" json:"overlap"`
+	TileSize int      `xml:"TileSize,attr" json:"tileSize"`
+	Size     struct {
+		Width  int `xml:"Width,attr" json:"width"`
+		Height int `xml:"Height,attr" json:"height"`
+	} `xml:"Size" json:"size"`
+	MaxLevel int    `xml:"-" json:"maxLevel"`
+	TilesURL string `xml:"-" json:"tilesUrl"`
+}
+
+// serveDZI returns the Deep Zoom descriptor for an image. Viewers derive the
+// tile URLs from the descriptor URL, so tiles live under tiles_files/.
+// Pass ?format=json for a JSON rendering with the tile URL spelled out.
+func serveDZI(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		img, err := lookupImageFile(c, gdb, c.Param("id"), "tiles")
+		if err != nil {
+			respondImageFileError(c, err)
+			return
+		}
+		w, h, err := pixelSize(img)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		w, h = util.OrientedSize(img.AbsPath, w, h)
+
+		d := dziImage{Format: util.TileFormat, Overlap: util.TileOverlap, TileSize: util.TileSize}
+		d.Size.Width, d.Size.Height = w, h
+		d.MaxLevel = util.MaxTileLevel(w, h)
+		d.TilesURL = fmt.Sprintf("/api/images/%d/tiles_files/", img.ID)
+		if c.Query("format") == "json" {
+			c.JSON(http.StatusOK, d)
+			return
+		}
+		c.XML(http.StatusOK, d)
+	}
+}
+
+// serveTile returns one tile of an image's pyramid, generating the pyramid
+// lazily on first use.
+func serveTile(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		level, err := strconv.Atoi(c.Param("level"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid level"})
+			return
+		}
+		var col, row int
+		var ext string
+		if n, _ := fmt.Sscanf(c.Param("tile"), "%d_%d.%s", &col, &row, &ext); n != 3 || ext != util.TileFormat {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid tile"})
+			return
+		}
+
+		img, err := lookupImageFile(c, gdb, c.Param("id"), "tile")
+		if err != nil {
+			respondImageFileError(c, err)
+			return
+		}
+		// Reject tiles outside the pyramid up front so a bad request never
+		// triggers a rebuild looking for a tile that cannot exist.
+		w, h, err := pixelSize(img)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		w, h = util.OrientedSize(img.AbsPath, w, h)
+		lw, lh := util.TileLevelSize(w, h, level)
+		if level < 0 || level > util.MaxTileLevel(w, h) || col < 0 || row < 0 || col*util.TileSize >= lw || row*util.TileSize >= lh {
+			c.JSON(http.StatusNotFound, gin.H{"error": "tile not found"})
+			return
+		}
+
+		p, err := util.EnsureTile(img.SHA256, img.AbsPath, level, col, row)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "tile not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		serveFileCached(c, p, fmt.Sprintf("%s-%d-%d-%d", img.SHA256, level, col, row), cacheRevalidate)
+	}
+}
+
+// pixelSize returns the stored dimensions of an image, reading them from the
+// file when the scanner could not record them.
+func pixelSize(img imageFile) (int, int, error) {
+	if img.Width != nil && img.Height != nil && *img.Width > 0 && *img.Height > 0 {
+		return *img.Width, *img.Height, nil
+	}
+	f, err := os.Open(img.AbsPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cfg.Width, cfg.Height, nil
+}
@@ -0,0 +1,74 @@
+package api_test
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+func TestDeepZoomTiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+	createTestPNG(t, filepath.Join(root, "big.png"), 600, 300)
+
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	w, h := 600, 300
+	require.NoError(t, gdb.Create(&db.Image{Path: "big.png", FileName: "big.png", Ext: "png", SizeBytes: 1, SHA256: "bigsha", Width: &w, Height: &h}).Error)
+	r := newRouter(gdb)
+
+	get := func(u string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("descriptor", func(t *testing.T) {
+		rec := get("/api/images/1/tiles.dzi")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="jpg" Overlap="1" TileSize="256"><Size Width="600" Height="300"></Size></Image>`)
+
+		rec = get("/api/images/1/tiles.dzi?format=json")
+		var d struct {
+			MaxLevel int    `json:"maxLevel"`
+			TilesURL string `json:"tilesUrl"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &d))
+		require.Equal(t, 10, d.MaxLevel)
+		require.Equal(t, "/api/images/1/tiles_files/", d.TilesURL)
+	})
+
+	tileSize := func(t *testing.T, u string) (int, int) {
+		rec := get(u)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		cfg, _, err := image.DecodeConfig(rec.Body)
+		require.NoError(t, err)
+		return cfg.Width, cfg.Height
+	}
+
+	t.Run("edge tile at full resolution includes overlap", func(t *testing.T) {
+		w, h := tileSize(t, "/api/images/1/tiles_files/10/2_1.jpg")
+		require.Equal(t, 600-511, w)
+		require.Equal(t, 300-255, h)
+	})
+
+	t.Run("lowest level is a single pixel", func(t *testing.T) {
+		w, h := tileSize(t, "/api/images/1/tiles_files/0/0_0.jpg")
+		require.Equal(t, 1, w)
+		require.Equal(t, 1, h)
+	})
+
+	t.Run("out of range tile", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, get("/api/images/1/tiles_files/10/9_9.jpg").Code)
+		require.Equal(t, http.StatusNotFound, get("/api/images/1/tiles_files/11/0_0.jpg").Code)
+		require.Equal(t, http.StatusBadRequest, get("/api/images/1/tiles_files/1/x.jpg").Code)
+	})
+}
@@ -0,0 +1,576 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+	"gen-library/backend/logger"
+	"gen-library/backend/util"
+)
+
+const (
+	// trashPathSetting used to name the trash folder. The folder is server
+	// configuration now, so the settings endpoints refuse the key; images
+	// trashed into the folder it named are still accepted.
+	trashPathSetting = "trash_path"
+	defaultTrashPath = "trash"
+	// trashRetentionSetting is how many days trashed images are kept before
+	// they are purged; 0 keeps them until purged by hand.
+	trashRetentionSetting = "trash_retention_days"
+	defaultTrashRetention = 30
+)
+
+var (
+	errInTrash    = errors.New("image is in the trash")
+	errNotInTrash = errors.New("image is not in the trash")
+	errDestExists = errors.New("destination already exists")
+)
+
+// trashFolder is the folder trashed files are moved to, set once at startup
+// from the server's configuration.
+var trashFolder struct {
+	sync.RWMutex
+	path string
+}
+
+// SetTrashDir sets the folder trashed files are moved to. An empty path
+// means "trash" next to the database.
+func SetTrashDir(p string) {
+	trashFolder.Lock()
+	defer trashFolder.Unlock()
+	trashFolder.path = p
+}
+
+// TrashDir returns the absolute trash folder.
+func TrashDir() (string, error) {
+	trashFolder.RLock()
+	dir := trashFolder.path
+	trashFolder.RUnlock()
+	if strings.TrimSpace(dir) == "" {
+		dir = defaultTrashPath
+	}
+	return resolvePath(dir)
+}
+
+// trashRetention returns the retention period in days.
+func trashRetention(gdb *gorm.DB) (int, error) {
+	v, err := settingValue(gdb, trashRetentionSetting)
+	if err != nil || strings.TrimSpace(v) == "" {
+		return defaultTrashRetention, err
+	}
+	days, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("%s must be a whole number of days", trashRetentionSetting)
+	}
+	return days, nil
+}
+
+// inTrashDir reports whether p lies inside the trash folder it was moved
+// into, recorded on the row. Rows trashed before the folder was recorded
+// are checked against the configured folder and the legacy trash_path
+// setting.
+func inTrashDir(gdb *gorm.DB, p string, recorded *string) (bool, error) {
+	var dirs []string
+	if recorded != nil {
+		dirs = append(dirs, *recorded)
+	} else {
+		dir, err := TrashDir()
+		if err != nil {
+			return false, err
+		}
+		legacy, err := settingValue(gdb, trashPathSetting)
+		if err != nil {
+			return false, err
+		}
+		dirs = append(dirs, dir)
+		if strings.TrimSpace(legacy) != "" {
+			dirs = append(dirs, legacy)
+		}
+	}
+	resolved, err := resolvePath(p)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range dirs {
+		if dir, err := resolvePath(d); err == nil && withinRoot(resolved, dir) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// moveFile moves src to dst, copying across file systems. An existing file
+// at dst is never replaced.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	// Linking fails when dst exists, where a rename would replace it.
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return errDestExists
+	}
+	if cerr := copyFile(src, dst); cerr != nil {
+		if errors.Is(cerr, fs.ErrExist) {
+			return errDestExists
+		}
+		return err
+	}
+	return os.Remove(src)
+}
+
+// fileMove is a file moved while a transaction updated its row. If the
+// transaction does not commit, undo puts the file back where the row still
+// points.
+type fileMove struct {
+	src, dst string
+}
+
+// undo moves the file back. It runs after a rollback, so failures are only
+// logged.
+func (m fileMove) undo() {
+	if m.dst == "" {
+		return
+	}
+	if err := moveFile(m.dst, m.src); err != nil {
+		log := logger.With().Str("component", "trash").Str("path", m.dst).Str("event", "undo_move").Logger()
+		log.Warn().Err(err).Msg("")
+	}
+}
+
+// copyFile copies src to a new file at dst, removing dst on failure.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// undoMoves undoes moves, latest first.
+func undoMoves(moves []fileMove) {
+	for i := len(moves) - 1; i >= 0; i-- {
+		moves[i].undo()
+	}
+}
+
+// trashImage soft deletes an image whose file is at abs: the row keeps its
+// metadata and is marked deleted, and the file is moved into the trash
+// folder. The row is updated first so a failed move rolls back cleanly; the
+// returned move must be undone if tx does not commit.
+func trashImage(c *gin.Context, tx *gorm.DB, img db.Image, abs string) (fileMove, error) {
+	if img.DeletedAt != nil {
+		return fileMove{}, errInTrash
+	}
+	dir, err := TrashDir()
+	if err != nil {
+		return fileMove{}, err
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%d_%s", img.ID, filepath.Base(abs)))
+	if err := tx.Model(&db.Image{}).Where("id = ?", img.ID).Updates(map[string]any{
+		"deleted_at":    time.Now(),
+		"original_path": img.Path,
+		"path":          dst,
+		"trash_dir":     dir,
+	}).Error; err != nil {
+		return fileMove{}, err
+	}
+	if err := recordAudit(c, tx, auditTrash, img.ID, gin.H{"path": img.Path, "trashPath": dst}); err != nil {
+		return fileMove{}, err
+	}
+	if err := moveFile(abs, dst); err != nil {
+		return fileMove{}, err
+	}
+	return fileMove{src: abs, dst: dst}, nil
+}
+
+// restoreImage moves a trashed image's file back to where it was and clears
+// the deleted mark. Like trashImage it returns the move to undo if tx does
+// not commit.
+func restoreImage(c *gin.Context, tx *gorm.DB, id uint) (fileMove, error) {
+	if err := bumpVersion(tx, id, ""); err != nil {
+		return fileMove{}, err
+	}
+	var img db.Image
+	if err := tx.Select("id, path, original_path, deleted_at").First(&img, id).Error; err != nil {
+		return fileMove{}, err
+	}
+	if img.DeletedAt == nil || img.OriginalPath == nil {
+		return fileMove{}, errNotInTrash
+	}
+	dst, err := imageAbsPath(tx, *img.OriginalPath)
+	if err != nil {
+		return fileMove{}, err
+	}
+	if err := checkPathAllowed(c, tx, dst, "restore"); err != nil {
+		return fileMove{}, err
+	}
+	var taken int64
+	if err := tx.Model(&db.Image{}).Where("path = ? AND id <> ?", *img.OriginalPath, id).Count(&taken).Error; err != nil {
+		return fileMove{}, err
+	}
+	if taken > 0 {
+		return fileMove{}, errDestExists
+	}
+	if err := tx.Model(&db.Image{}).Where("id = ?", id).Updates(map[string]any{
+		"deleted_at":    nil,
+		"original_path": nil,
+		"trash_dir":     nil,
+		"path":          *img.OriginalPath,
+	}).Error; err != nil {
+		return fileMove{}, err
+	}
+	if err := recordAudit(c, tx, auditRestore, id, gin.H{"path": *img.OriginalPath, "trashPath": img.Path}); err != nil {
+		return fileMove{}, err
+	}
+	if err := moveFile(img.Path, dst); err != nil {
+		return fileMove{}, err
+	}
+	return fileMove{src: img.Path, dst: dst}, nil
+}
+
+// hardDeleteImage permanently deletes a library image. Its file at abs and
+// its thumbnails are returned as a removal for the caller to run once the
+// transaction has committed.
+func hardDeleteImage(c *gin.Context, tx *gorm.DB, img db.Image, abs string) (fileRemoval, error) {
+	if err := tx.Delete(&db.Image{}, img.ID).Error; err != nil {
+		return fileRemoval{}, err
+	}
+	if err := recordAudit(c, tx, auditDelete, img.ID, gin.H{"path": img.Path, "sha256": img.SHA256}); err != nil {
+		return fileRemoval{}, err
+	}
+	return fileRemoval{path: abs, img: img}, nil
+}
+
+// purgeImage permanently removes a trashed image. Like hardDeleteImage it
+// leaves the file and thumbnails to the returned removal. c is nil when the
+// retention janitor purges.
+func purgeImage(c *gin.Context, tx *gorm.DB, id uint) (fileRemoval, error) {
+	var img db.Image
+	if err := tx.Select("id, path, original_path, trash_dir, sha256, blur_id, deleted_at").First(&img, id).Error; err != nil {
+		return fileRemoval{}, err
+	}
+	if img.DeletedAt == nil {
+		return fileRemoval{}, errNotInTrash
+	}
+	if ok, err := inTrashDir(tx, img.Path, img.TrashDir); err != nil {
+		return fileRemoval{}, err
+	} else if !ok {
+		return fileRemoval{}, errOutsideRoots
+	}
+	if err := tx.Delete(&db.Image{}, id).Error; err != nil {
+		return fileRemoval{}, err
+	}
+	if err := recordAudit(c, tx, auditPurge, id, gin.H{"path": img.OriginalPath, "trashPath": img.Path, "sha256": img.SHA256}); err != nil {
+		return fileRemoval{}, err
+	}
+	return fileRemoval{path: img.Path, img: img}, nil
+}
+
+// fileRemoval is the file and thumbnails of a deleted image. It is run only
+// after the deleting transaction commits, so a rollback never leaves a row
+// pointing at a file that is gone.
+type fileRemoval struct {
+	path string
+	img  db.Image
+}
+
+// run deletes the file and thumbnails. The row is already gone, so failures
+// are only logged.
+func (r fileRemoval) run() {
+	if r.path == "" {
+		return
+	}
+	err := os.Remove(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err == nil {
+		err = deleteImageThumbs(r.img)
+	}
+	if err != nil {
+		log := logger.With().Str("component", "trash").Str("path", r.path).Str("event", "remove").Logger()
+		log.Warn().Err(err).Msg("")
+	}
+}
+
+// deleteImageThumbs removes the cached thumbnails of img, including the
+// blurred variants named by its blur id.
+func deleteImageThumbs(img db.Image) error {
+	if err := util.DeleteThumbs(img.SHA256); err != nil {
+		return err
+	}
+	if img.BlurID != nil {
+		return util.DeleteThumbs(*img.BlurID)
+	}
+	return nil
+}
+
+// trashItem is a trashed image as listed by listTrash. PurgeAt is null when
+// trashed images are kept indefinitely.
+type trashItem struct {
+	ID           uint       `json:"id"`
+	FileName     string     `json:"fileName"`
+	OriginalPath string     `json:"originalPath"`
+	DeletedAt    time.Time  `json:"deletedAt"`
+	PurgeAt      *time.Time `json:"purgeAt" gorm:"-"`
+	Hidden       bool       `json:"hidden"`
+	NSFW         bool       `json:"-"`
+	SHA256       string     `json:"-" gorm:"column:sha256"`
+	BlurID       string     `json:"-"`
+	ThumbURL     string     `json:"thumbUrl" gorm:"-"`
+}
+
+// listTrash returns trashed images, most recently deleted first. Hidden
+// images are left out while the vault is locked.
+func listTrash(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+		pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "50"))
+		if page < 1 {
+			page = 1
+		}
+		if pageSize < 1 || pageSize > 200 {
+			pageSize = 50
+		}
+		days, err := trashRetention(gdb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		q := gdb.Table("images").Where("deleted_at IS NOT NULL")
+		if !vaultUnlocked(c) {
+			q = q.Where("hidden = 0")
+		}
+		var total int64
+		if err := q.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		items := []trashItem{}
+		if err := q.Select("id, file_name, original_path, deleted_at, hidden, nsfw, sha256, COALESCE(blur_id, '') AS blur_id").
+			Order("deleted_at DESC, id DESC").
+			Limit(pageSize).Offset((page - 1) * pageSize).
+			Scan(&items).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		blur, err := blurMode(gdb)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range items {
+			items[i].ThumbURL = thumbURL(items[i].ID, items[i].SHA256, items[i].BlurID, items[i].Hidden, blur && items[i].NSFW)
+			if days > 0 {
+				at := items[i].DeletedAt.AddDate(0, 0, days)
+				items[i].PurgeAt = &at
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"page":          page,
+			"pageSize":      pageSize,
+			"total":         total,
+			"retentionDays": days,
+			"items":         items,
+		})
+	}
+}
+
+// trashRequest names the trashed images to restore or purge. All selects
+// the whole trash and, like Token, is only accepted by purge.
+type trashRequest struct {
+	IDs   []uint `json:"ids"`
+	All   bool   `json:"all"`
+	Token string `json:"token"`
+}
+
+// eachTrashed runs fn for every id in its own transaction and reports the
+// outcome per item, like the bulk endpoint. The removal fn returns is run
+// after its transaction commits, and the move is undone if it does not.
+// Hidden images fail while the vault is locked.
+func eachTrashed(c *gin.Context, gdb *gorm.DB, ids []uint, fn func(tx *gorm.DB, id uint) (fileRemoval, fileMove, error)) {
+	results := make([]bulkItemResult, 0, len(ids))
+	succeeded := 0
+	for _, id := range ids {
+		res := bulkItemResult{ID: id, Status: "ok"}
+		var (
+			removal fileRemoval
+			move    fileMove
+		)
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			if err := checkHiddenEdit(c, tx, id); err != nil {
+				return err
+			}
+			var err error
+			removal, move, err = fn(tx, id)
+			return err
+		})
+		if err != nil {
+			move.undo()
+			res.Status, res.Error = "failed", err.Error()
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				res.Error = "not found"
+			}
+		} else {
+			removal.run()
+			succeeded++
+		}
+		results = append(results, res)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"matched":   len(ids),
+		"succeeded": succeeded,
+		"failed":    len(ids) - succeeded,
+		"results":   results,
+	})
+}
+
+// restoreTrash puts trashed images back where they were, with their tags,
+// ratings and other metadata intact.
+func restoreTrash(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req trashRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.IDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+			return
+		}
+		eachTrashed(c, gdb, uniqueIDs(req.IDs), func(tx *gorm.DB, id uint) (fileRemoval, fileMove, error) {
+			move, err := restoreImage(c, tx, id)
+			return fileRemoval{}, move, err
+		})
+	}
+}
+
+// purgeTrash permanently deletes trashed images, or empties the trash with
+// {"all": true}. Like a hard delete it needs a confirmation token, issued
+// with a preview when none is sent.
+func purgeTrash(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req trashRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ids := uniqueIDs(req.IDs)
+		switch {
+		case req.All && len(ids) > 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids and all are mutually exclusive"})
+			return
+		case req.All:
+			q := gdb.Model(&db.Image{}).Where("deleted_at IS NOT NULL")
+			if !vaultUnlocked(c) {
+				q = q.Where("hidden = 0")
+			}
+			if err := q.Order("id").Pluck("id", &ids).Error; err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		case len(ids) == 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ids or all is required"})
+			return
+		}
+		preview := gin.H{"matched": len(ids), "ids": ids}
+		if !confirmed(c, req.Token, confirmScope(auditPurge, ids), preview) {
+			return
+		}
+		eachTrashed(c, gdb, ids, func(tx *gorm.DB, id uint) (fileRemoval, fileMove, error) {
+			removal, err := purgeImage(c, tx, id)
+			return removal, fileMove{}, err
+		})
+	}
+}
+
+// PurgeExpiredTrash permanently deletes images trashed longer than the
+// retention period and returns how many were removed. An image that fails is
+// skipped; the first error is returned.
+func PurgeExpiredTrash(gdb *gorm.DB) (int, error) {
+	days, err := trashRetention(gdb)
+	if err != nil || days == 0 {
+		return 0, err
+	}
+	var rows []struct {
+		ID        uint
+		DeletedAt time.Time
+	}
+	if err := gdb.Table("images").Select("id, deleted_at").Where("deleted_at IS NOT NULL").Scan(&rows).Error; err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	purged := 0
+	var first error
+	for _, r := range rows {
+		if r.DeletedAt.After(cutoff) {
+			continue
+		}
+		var removal fileRemoval
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			var err error
+			removal, err = purgeImage(nil, tx, r.ID)
+			return err
+		})
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		removal.run()
+		purged++
+	}
+	return purged, first
+}
+
+// StartTrashJanitor purges expired trash on every tick until ctx is done.
+func StartTrashJanitor(ctx context.Context, gdb *gorm.DB, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := PurgeExpiredTrash(gdb)
+			log := logger.With().Str("component", "trash").Str("event", "janitor").Logger()
+			if err != nil {
+				log.Warn().Err(err).Msg("")
+			} else if n > 0 {
+				log.Info().Int("purged", n).Msg("")
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package api_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/api"
+	"gen-library/backend/db"
+)
+
+func TestTrash(t *testing.T) {
+	root := t.TempDir()
+	trash := t.TempDir()
+	gdb := newTestDB(t)
+	require.NoError(t, gdb.Create(&db.Setting{Key: "library_path", Value: root}).Error)
+	api.SetTrashDir(trash)
+	t.Cleanup(func() { api.SetTrashDir("") })
+	tag := db.Tag{Name: "keep"}
+	require.NoError(t, gdb.Create(&tag).Error)
+	for _, name := range []string{"a.png", "b.png", "c.png"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(name), 0o644))
+		require.NoError(t, gdb.Create(&db.Image{Path: name, FileName: name, Ext: "png", SizeBytes: 5, SHA256: name, Rating: 4, Tags: []*db.Tag{&tag}}).Error)
+	}
+	r := newRouter(gdb)
+
+	w := doJSON(r, http.MethodDelete, "/api/images/1", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, http.StatusConflict, doJSON(r, http.MethodDelete, "/api/images/1", "").Code)
+	resp := postBulk(t, r, `{"ids":[1,2],"actions":{"delete":"trash"}}`)
+	require.Equal(t, 1, resp.Succeeded)
+	require.Equal(t, "not found", resp.Results[1].Error)
+
+	// Trashed images keep their rows but leave listings and tag counts.
+	require.NoFileExists(t, filepath.Join(root, "a.png"))
+	require.FileExists(t, filepath.Join(trash, "1_a.png"))
+	require.Equal(t, []string{"c.png"}, getFileNames(t, r, "/api/images"))
+	require.Equal(t, int64(1), listTagItems(t, r, "/api/tags")[0].Count)
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodGet, "/api/images/1/file", "").Code)
+
+	w = doJSON(r, http.MethodGet, "/api/trash", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Total         int `json:"total"`
+		RetentionDays int `json:"retentionDays"`
+		Items         []struct {
+			ID           uint       `json:"id"`
+			OriginalPath string     `json:"originalPath"`
+			PurgeAt      *time.Time `json:"purgeAt"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Equal(t, 2, list.Total)
+	require.Equal(t, 30, list.RetentionDays)
+	require.Equal(t, "a.png", list.Items[1].OriginalPath)
+	require.NotNil(t, list.Items[0].PurgeAt)
+
+	// Restoring brings back the file and the metadata.
+	w = doJSON(r, http.MethodPost, "/api/trash/restore", `{"ids":[1,3]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.JSONEq(t, `{"matched":2,"succeeded":1,"failed":1,"results":[{"id":1,"status":"ok"},{"id":3,"status":"failed","error":"image is not in the trash"}]}`, w.Body.String())
+	require.FileExists(t, filepath.Join(root, "a.png"))
+	var a db.Image
+	require.NoError(t, gdb.Preload("Tags").First(&a, 1).Error)
+	require.Equal(t, "a.png", a.Path)
+	require.Nil(t, a.DeletedAt)
+	require.Equal(t, 4, a.Rating)
+	require.Len(t, a.Tags, 1)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "b.png"), []byte("new"), 0o644))
+	w = doJSON(r, http.MethodPost, "/api/trash/restore", `{"ids":[2]}`)
+	require.Contains(t, w.Body.String(), "destination already exists")
+
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/trash/purge", `{}`).Code)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPost, "/api/trash/purge", `{"ids":[2],"all":true}`).Code)
+	token := confirmToken(t, doJSON(r, http.MethodPost, "/api/trash/purge", `{"all":true}`))
+	w = doJSON(r, http.MethodPost, "/api/trash/purge", `{"all":true,"token":"`+token+`"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"succeeded":1`)
+	require.NoFileExists(t, filepath.Join(trash, "2_b.png"))
+	require.FileExists(t, filepath.Join(root, "b.png"))
+	var n int64
+	require.NoError(t, gdb.Model(&db.Image{}).Count(&n).Error)
+	require.EqualValues(t, 2, n)
+
+	t.Run("retention", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/images/3", "").Code)
+		purged, err := api.PurgeExpiredTrash(gdb)
+		require.NoError(t, err)
+		require.Zero(t, purged)
+
+		require.NoError(t, gdb.Model(&db.Image{}).Where("id = 3").Update("deleted_at", time.Now().AddDate(0, 0, -31)).Error)
+		purged, err = api.PurgeExpiredTrash(gdb)
+		require.NoError(t, err)
+		require.Equal(t, 1, purged)
+		require.NoFileExists(t, filepath.Join(trash, "3_c.png"))
+
+		// A retention of 0 keeps trashed images.
+		require.NoError(t, gdb.Create(&db.Setting{Key: "trash_retention_days", Value: "0"}).Error)
+		require.Equal(t, http.StatusOK, doJSON(r, http.MethodDelete, "/api/images/1", "").Code)
+		require.NoError(t, gdb.Model(&db.Image{}).Where("id = 1").Update("deleted_at", time.Now().AddDate(-1, 0, 0)).Error)
+		purged, err = api.PurgeExpiredTrash(gdb)
+		require.NoError(t, err)
+		require.Zero(t, purged)
+	})
+
+	t.Run("trash folder", func(t *testing.T) {
+		w := doJSON(r, http.MethodPut, "/api/settings/trash_path", `{"value":"/tmp"}`)
+		require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+		// Images trashed before the folder changed can still be restored.
+		api.SetTrashDir(t.TempDir())
+		w = doJSON(r, http.MethodPost, "/api/trash/restore", `{"ids":[1]}`)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.Contains(t, w.Body.String(), `"succeeded":1`)
+		require.FileExists(t, filepath.Join(root, "a.png"))
+	})
+
+	t.Run("occupied trash name", func(t *testing.T) {
+		dir := t.TempDir()
+		api.SetTrashDir(dir)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "1_a.png"), []byte("other"), 0o644))
+		w := doJSON(r, http.MethodDelete, "/api/images/1", "")
+		require.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+		data, err := os.ReadFile(filepath.Join(dir, "1_a.png"))
+		require.NoError(t, err)
+		require.Equal(t, "other", string(data))
+		require.FileExists(t, filepath.Join(root, "a.png"))
+		var a db.Image
+		require.NoError(t, gdb.First(&a, 1).Error)
+		require.Nil(t, a.DeletedAt)
+	})
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"gen-library/backend/db"
+)
+
+// vaultPINSetting holds the hash of the PIN that reveals hidden images. It
+// cannot be read or written through the generic settings endpoints.
+const vaultPINSetting = "vault_pin"
+
+const (
+	// vaultTokenHeader and vaultCookie carry the session token; the cookie
+	// lets image tags load hidden files and thumbnails.
+	vaultTokenHeader = "X-Vault-Token"
+	vaultCookie      = "vault_token"
+	vaultTTL         = 15 * time.Minute
+	vaultMinPIN      = 4
+	// After vaultMaxFailures wrong PINs in a row, unlocking is refused for
+	// vaultLockout.
+	vaultMaxFailures = 5
+	vaultLockout     = time.Minute
+	pinIterations    = 200_000
+)
+
+var errVaultLocked = errors.New("vault locked")
+
+// vault holds the unlocked sessions, keyed by token, and the count of
+// consecutive wrong PINs.
+var vault = struct {
+	sync.Mutex
+	sessions map[string]time.Time
+	failures int
+	until    time.Time
+}{sessions: map[string]time.Time{}}
+
+// hashPIN derives a salted PBKDF2 hash, stored as
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>".
+func hashPIN(pin string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, pin, salt, pinIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pinIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+// checkPIN reports whether pin matches a hash made by hashPIN.
+func checkPIN(hash, pin string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(parts[2])
+	want, err2 := enc.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, pin, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// vaultToken returns the session token sent with the request, if any.
+func vaultToken(c *gin.Context) string {
+	if t := c.GetHeader(vaultTokenHeader); t != "" {
+		return t
+	}
+	t, _ := c.Cookie(vaultCookie)
+	return t
+}
+
+// vaultUnlocked reports whether the request carries a live session token.
+func vaultUnlocked(c *gin.Context) bool {
+	t := vaultToken(c)
+	if t == "" {
+		return false
+	}
+	vault.Lock()
+	defer vault.Unlock()
+	exp, ok := vault.sessions[t]
+	if ok && time.Now().After(exp) {
+		delete(vault.sessions, t)
+		ok = false
+	}
+	return ok
+}
+
+// checkHiddenFilter refuses filters that reveal hidden images unless the
+// vault is unlocked, writing a 403 response.
+func checkHiddenFilter(c *gin.Context, f imageFilter) bool {
+	if f.Hidden != "hide" && !vaultUnlocked(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": errVaultLocked.Error()})
+		return false
+	}
+	return true
+}
+
+// checkHiddenEdit refuses, with errVaultLocked, an edit of a hidden image
+// while the vault is locked. It runs inside the edit's transaction so the
+// check and the edit see the same row.
+func checkHiddenEdit(c *gin.Context, tx *gorm.DB, id any) error {
+	if vaultUnlocked(c) {
+		return nil
+	}
+	var n int64
+	if err := tx.Model(&db.Image{}).Where("id = ? AND hidden = 1", id).Count(&n).Error; err != nil {
+		return err
+	}
+	if n > 0 {
+		return errVaultLocked
+	}
+	return nil
+}
+
+// getVault reports whether a PIN is set and whether this request unlocks the
+// vault.
+func getVault(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hash, err := settingValue(gdb, vaultPINSetting)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp := gin.H{"pinSet": hash != "", "unlocked": vaultUnlocked(c)}
+		if resp["unlocked"] == true {
+			vault.Lock()
+			resp["expiresAt"] = vault.sessions[vaultToken(c)]
+			vault.Unlock()
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
+
+// setVaultPIN sets or changes the PIN. Changing it requires the current PIN
+// and ends every open session.
+func setVaultPIN(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			PIN        string `json:"pin"`
+			CurrentPIN string `json:"currentPin"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len([]rune(body.PIN)) < vaultMinPIN {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid pin", "fields": fieldErrors{"pin": fmt.Sprintf("must be at least %d characters", vaultMinPIN)}})
+			return
+		}
+		current, err := settingValue(gdb, vaultPINSetting)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if current != "" && !attemptPIN(c, current, body.CurrentPIN) {
+			return
+		}
+		hash, err := hashPIN(body.PIN)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		s := db.Setting{Key: vaultPINSetting, Value: hash}
+		if err := gdb.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			UpdateAll: true,
+		}).Create(&s).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		vault.Lock()
+		clear(vault.sessions)
+		vault.Unlock()
+		c.JSON(http.StatusOK, gin.H{"pinSet": true})
+	}
+}
+
+// attemptPIN checks a PIN against the stored hash, counting failures towards
+// the lockout. It writes the error response when the PIN is refused.
+func attemptPIN(c *gin.Context, hash, pin string) bool {
+	vault.Lock()
+	defer vault.Unlock()
+	if time.Now().Before(vault.until) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts, try again later"})
+		return false
+	}
+	if !checkPIN(hash, pin) {
+		vault.failures++
+		if vault.failures >= vaultMaxFailures {
+			vault.failures = 0
+			vault.until = time.Now().Add(vaultLockout)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "wrong pin"})
+		return false
+	}
+	vault.failures = 0
+	return true
+}
+
+// unlockVault exchanges the PIN for a session token valid for vaultTTL. The
+// token is returned and also set as a cookie.
+func unlockVault(gdb *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			PIN string `json:"pin"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := settingValue(gdb, vaultPINSetting)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if hash == "" {
+			c.JSON(http.StatusConflict, gin.H{"error": "no pin set"})
+			return
+		}
+		if !attemptPIN(c, hash, body.PIN) {
+			return
+		}
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		token := hex.EncodeToString(raw)
+		exp := time.Now().Add(vaultTTL)
+		vault.Lock()
+		for t, e := range vault.sessions {
+			if time.Now().After(e) {
+				delete(vault.sessions, t)
+			}
+		}
+		vault.sessions[token] = exp
+		vault.Unlock()
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(vaultCookie, token, int(vaultTTL.Seconds()), "/", "", false, true)
+		c.JSON(http.StatusOK, gin.H{"token": token, "expiresAt": exp})
+	}
+}
+
+// lockVault ends the request's session.
+func lockVault() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if t := vaultToken(c); t != "" {
+			vault.Lock()
+			delete(vault.sessions, t)
+			vault.Unlock()
+		}
+		c.SetSameSite(http.SameSiteStrictMode)
+		c.SetCookie(vaultCookie, "", -1, "/", "", false, true)
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	}
+}
@@ -0,0 +1,140 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+)
+
+// doVault sends a request carrying a vault token.
+func doVault(r *gin.Engine, method, url, body, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", token)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// unlockTestVault sets a PIN and returns the token of an unlocked session.
+func unlockTestVault(t *testing.T, r *gin.Engine) string {
+	t.Helper()
+	require.Equal(t, http.StatusOK, doJSON(r, http.MethodPut, "/api/vault/pin", `{"pin":"1234"}`).Code)
+	w := doJSON(r, http.MethodPost, "/api/vault/unlock", `{"pin":"1234"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var session struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	return session.Token
+}
+
+func TestHiddenVault(t *testing.T) {
+	r, gdb, _ := setupRouterDB(t)
+	// Hiding an image is itself a vault operation.
+	w := doJSON(r, http.MethodPut, "/api/images/3/metadata", `{"hidden":true}`)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+	require.NoError(t, gdb.Model(&db.Image{}).Where("id = 3").Update("hidden", true).Error)
+
+	// Hidden images are left out of listings, facets and tag counts.
+	require.ElementsMatch(t, []string{"cat", "dog"}, getFileNames(t, r, "/api/images?nsfw=show"))
+	w = doJSON(r, http.MethodGet, "/api/images/facets?nsfw=show", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, w.Body.String(), "flower")
+	for _, tag := range listTagItems(t, r, "/api/tags") {
+		if tag.Name == "flower" {
+			require.Zero(t, tag.Count)
+		}
+	}
+
+	// Revealing them needs an unlocked vault.
+	for _, url := range []string{"/api/images?hidden=show", "/api/images/facets?hidden=only", "/api/images/3", "/api/images/3/file", "/api/images/3/thumb"} {
+		require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, url, "").Code, url)
+	}
+	w = doJSON(r, http.MethodPost, "/api/images/bulk", `{"filter":"hidden=only","actions":{"favorite":true}}`)
+	require.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+
+	require.Equal(t, http.StatusConflict, doJSON(r, http.MethodPost, "/api/vault/unlock", `{"pin":"1234"}`).Code)
+	require.Equal(t, http.StatusBadRequest, doJSON(r, http.MethodPut, "/api/vault/pin", `{"pin":"12"}`).Code)
+	w = doJSON(r, http.MethodPut, "/api/vault/pin", `{"pin":"1234"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodGet, "/api/settings/vault_pin", "").Code)
+	require.Equal(t, http.StatusForbidden, doJSON(r, http.MethodPut, "/api/settings/vault_pin", `{"value":""}`).Code)
+	require.Equal(t, http.StatusUnauthorized, doJSON(r, http.MethodPost, "/api/vault/unlock", `{"pin":"4321"}`).Code)
+
+	w = doJSON(r, http.MethodPost, "/api/vault/unlock", `{"pin":"1234"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var session struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	require.NotEmpty(t, session.Token)
+	cookie := w.Result().Cookies()[0]
+	require.Equal(t, session.Token, cookie.Value)
+	require.True(t, cookie.HttpOnly)
+
+	w = doVault(r, http.MethodGet, "/api/images?hidden=only", "", session.Token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), `"fileName":"sunflower"`)
+	require.Contains(t, w.Body.String(), `"hidden":true`)
+	require.Equal(t, http.StatusOK, doVault(r, http.MethodGet, "/api/images/3", "", session.Token).Code)
+	require.NotContains(t, doVault(r, http.MethodGet, "/api/images/3/file", "", session.Token).Body.String(), "vault locked")
+	w = doVault(r, http.MethodGet, "/api/vault", "", session.Token)
+	require.Contains(t, w.Body.String(), `"unlocked":true`)
+
+	// Without the token, hidden images cannot be edited, tagged, deleted or
+	// unhidden, and edits do not echo their metadata back.
+	for _, req := range []struct{ method, url, body string }{
+		{http.MethodPut, "/api/images/3/metadata", `{"rating":1}`},
+		{http.MethodPut, "/api/images/3/metadata", `{"hidden":false}`},
+		{http.MethodPut, "/api/images/1/metadata", `{"hidden":true}`},
+		{http.MethodPost, "/api/images/3/tags", `{"tags":["x"]}`},
+		{http.MethodDelete, "/api/images/3/tags", `{"tags":["flower"]}`},
+		{http.MethodDelete, "/api/images/3", ""},
+		{http.MethodDelete, "/api/images/3?mode=hard", ""},
+		{http.MethodPost, "/api/images/3/revert", `{"version":1}`},
+		{http.MethodPost, "/api/images/bulk", `{"ids":[1],"actions":{"hidden":false}}`},
+		{http.MethodPost, "/api/images/bulk/edit", `{"ids":[1],"set":{"hidden":true}}`},
+	} {
+		w := doJSON(r, req.method, req.url, req.body)
+		require.Equal(t, http.StatusForbidden, w.Code, req.url+" "+w.Body.String())
+		require.NotContains(t, w.Body.String(), "sunflower")
+	}
+	resp := postBulk(t, r, `{"ids":[3],"actions":{"rating":2}}`)
+	require.Zero(t, resp.Matched)
+	require.Equal(t, "not found", resp.Results[0].Error)
+	var img db.Image
+	require.NoError(t, gdb.First(&img, 3).Error)
+	require.True(t, img.Hidden)
+	require.Zero(t, img.Rating)
+
+	w = doVault(r, http.MethodPut, "/api/images/3/metadata", `{"rating":1}`, session.Token)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Contains(t, w.Body.String(), "sunflower")
+
+	// The cookie works as well as the header.
+	req, _ := http.NewRequest(http.MethodGet, "/api/images/3", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Changing the PIN needs the current one and ends open sessions.
+	require.Equal(t, http.StatusUnauthorized, doJSON(r, http.MethodPut, "/api/vault/pin", `{"pin":"5678"}`).Code)
+	w = doJSON(r, http.MethodPut, "/api/vault/pin", `{"pin":"5678","currentPin":"1234"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, http.StatusForbidden, doVault(r, http.MethodGet, "/api/images/3", "", session.Token).Code)
+
+	w = doJSON(r, http.MethodPost, "/api/vault/unlock", `{"pin":"5678"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &session))
+	require.Equal(t, http.StatusOK, doVault(r, http.MethodPost, "/api/vault/lock", "", session.Token).Code)
+	require.Equal(t, http.StatusForbidden, doVault(r, http.MethodGet, "/api/images?hidden=show", "", session.Token).Code)
+}
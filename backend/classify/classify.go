@@ -0,0 +1,565 @@
+// Package classify learns from the labels users give images: a multinomial
+// naive Bayes model over prompt tokens, LoRA names and the model name,
+// trained from hand-set NSFW flags and from image tags.
+//
+// Training is incremental. Each image's contribution is recorded with the
+// image version it was computed from, and Sync only revisits images whose
+// version changed since, or that were deleted.
+package classify
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"gen-library/backend/db"
+)
+
+// Labels. Tag labels are "tag:<id>"; every tagged image also counts towards
+// labelTagged, the background tags are scored against.
+const (
+	labelNSFW   = "nsfw"
+	labelSFW    = "sfw"
+	labelTagged = "tagged"
+	tagPrefix   = "tag:"
+)
+
+// MinExamples is the number of labelled images a class needs before it is
+// used for predictions.
+const MinExamples = 3
+
+// NSFWThreshold is the probability above which an import is flagged NSFW.
+const NSFWThreshold = 0.9
+
+// maxSuggestions bounds the suggested tags returned for one image.
+const maxSuggestions = 10
+
+var (
+	loraTagRe  = regexp.MustCompile(`(?i)<(?:lora|lyco):[^>]*>`)
+	stopTokens = map[string]bool{
+		"a": true, "an": true, "and": true, "the": true, "of": true, "in": true, "on": true,
+		"with": true, "at": true, "by": true, "for": true, "to": true, "is": true, "from": true,
+	}
+)
+
+// Features turns image metadata into token counts. Prompt words are lower
+// cased and stripped of weights and punctuation; LoRAs and the model are
+// added as single "lora:" and "model:" features.
+func Features(prompt, model string, loras []string) map[string]int {
+	f := map[string]int{}
+	prompt = loraTagRe.ReplaceAllString(prompt, " ")
+	words := strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-'
+	})
+	for _, w := range words {
+		w = strings.Trim(w, "_-")
+		if len([]rune(w)) < 2 || stopTokens[w] {
+			continue
+		}
+		if _, err := strconv.ParseFloat(w, 64); err == nil {
+			continue
+		}
+		f[w]++
+	}
+	for _, l := range loras {
+		if l = strings.ToLower(strings.TrimSpace(l)); l != "" {
+			f["lora:"+l] = 1
+		}
+	}
+	if model = strings.ToLower(strings.TrimSpace(model)); model != "" {
+		f["model:"+model] = 1
+	}
+	return f
+}
+
+// delta accumulates count changes before they are written.
+type delta struct {
+	docs     map[string]int64
+	tokens   map[string]int64
+	features map[[2]string]int64
+}
+
+func newDelta() *delta {
+	return &delta{docs: map[string]int64{}, tokens: map[string]int64{}, features: map[[2]string]int64{}}
+}
+
+func (d *delta) add(labels []string, features map[string]int, sign int64) {
+	var total int64
+	for _, n := range features {
+		total += int64(n)
+	}
+	for _, l := range labels {
+		d.docs[l] += sign
+		d.tokens[l] += sign * total
+		for f, n := range features {
+			d.features[[2]string{l, f}] += sign * int64(n)
+		}
+	}
+}
+
+func (d *delta) write(tx *gorm.DB) error {
+	for l, n := range d.docs {
+		row := db.ClassifierLabel{Label: l, Docs: n, Tokens: d.tokens[l]}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "label"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"docs":   gorm.Expr("classifier_labels.docs + excluded.docs"),
+				"tokens": gorm.Expr("classifier_labels.tokens + excluded.tokens"),
+			}),
+		}).Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	for k, n := range d.features {
+		if n == 0 {
+			continue
+		}
+		row := db.ClassifierFeature{Label: k[0], Feature: k[1], Count: n}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "label"}, {Name: "feature"}},
+			DoUpdates: clause.Assignments(map[string]any{"count": gorm.Expr("classifier_features.count + excluded.count")}),
+		}).Create(&row).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Where("count <= 0").Delete(&db.ClassifierFeature{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("docs <= 0").Delete(&db.ClassifierLabel{}).Error
+}
+
+// imageDoc computes the labels and features of one image. Only hand-set NSFW
+// flags are used as labels; automatic ones are what the model predicts.
+func imageDoc(tx *gorm.DB, id uint) ([]string, map[string]int, error) {
+	var row struct {
+		Prompt     *string
+		NSFW       bool
+		NSFWManual bool
+		ModelName  *string
+	}
+	if err := tx.Table("images").
+		Select("images.prompt, images.nsfw, images.nsfw_manual, models.name AS model_name").
+		Joins("LEFT JOIN models ON images.model_id = models.id").
+		Where("images.id = ?", id).
+		Take(&row).Error; err != nil {
+		return nil, nil, err
+	}
+	var loras []string
+	if err := tx.Table("image_loras").Joins("JOIN loras ON loras.id = image_loras.lora_id").
+		Where("image_loras.image_id = ?", id).Pluck("loras.name", &loras).Error; err != nil {
+		return nil, nil, err
+	}
+	var tagIDs []uint
+	if err := tx.Table("image_tags").Where("image_id = ?", id).Order("tag_id").Pluck("tag_id", &tagIDs).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var labels []string
+	if row.NSFWManual {
+		if row.NSFW {
+			labels = append(labels, labelNSFW)
+		} else {
+			labels = append(labels, labelSFW)
+		}
+	}
+	if len(tagIDs) > 0 {
+		labels = append(labels, labelTagged)
+		for _, t := range tagIDs {
+			labels = append(labels, tagPrefix+strconv.FormatUint(uint64(t), 10))
+		}
+	}
+	prompt, model := "", ""
+	if row.Prompt != nil {
+		prompt = *row.Prompt
+	}
+	if row.ModelName != nil {
+		model = *row.ModelName
+	}
+	return labels, Features(prompt, model, loras), nil
+}
+
+// syncMu serializes training so two syncs never apply the same delta.
+var syncMu sync.Mutex
+
+// SyncStats reports the work done by a sync.
+type SyncStats struct {
+	Trained   int `json:"trained"`
+	Forgotten int `json:"forgotten"`
+}
+
+// Sync brings the model up to date with the library, retraining images
+// whose version changed and forgetting deleted ones.
+func Sync(gdb *gorm.DB) (SyncStats, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	var stats SyncStats
+	var stale []uint
+	if err := gdb.Table("images").
+		Joins("LEFT JOIN classifier_docs d ON d.image_id = images.id").
+		Where("d.image_id IS NULL OR d.version <> images.version").
+		Order("images.id").
+		Pluck("images.id", &stale).Error; err != nil {
+		return stats, err
+	}
+	var gone []uint
+	if err := gdb.Table("classifier_docs").
+		Where("image_id NOT IN (SELECT id FROM images)").
+		Pluck("image_id", &gone).Error; err != nil {
+		return stats, err
+	}
+
+	const batch = 500
+	for len(stale) > 0 || len(gone) > 0 {
+		var ids, del []uint
+		ids, stale = take(stale, batch)
+		del, gone = take(gone, batch)
+		err := gdb.Transaction(func(tx *gorm.DB) error {
+			d := newDelta()
+			var old []db.ClassifierDoc
+			if err := tx.Where("image_id IN ?", append(append([]uint{}, ids...), del...)).Find(&old).Error; err != nil {
+				return err
+			}
+			for _, o := range old {
+				if err := forget(d, o); err != nil {
+					return err
+				}
+			}
+			if len(del) > 0 {
+				if err := tx.Where("image_id IN ?", del).Delete(&db.ClassifierDoc{}).Error; err != nil {
+					return err
+				}
+			}
+			for _, id := range ids {
+				var version int
+				if err := tx.Table("images").Select("version").Where("id = ?", id).Scan(&version).Error; err != nil {
+					return err
+				}
+				labels, features, err := imageDoc(tx, id)
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					// Deleted since the stale list was read.
+					if err := tx.Where("image_id = ?", id).Delete(&db.ClassifierDoc{}).Error; err != nil {
+						return err
+					}
+					continue
+				} else if err != nil {
+					return err
+				}
+				d.add(labels, features, 1)
+				lj, _ := json.Marshal(labels)
+				fj, _ := json.Marshal(features)
+				if err := tx.Save(&db.ClassifierDoc{ImageID: id, Version: version, Labels: string(lj), Features: string(fj)}).Error; err != nil {
+					return err
+				}
+			}
+			return d.write(tx)
+		})
+		forgetVocabSize(gdb)
+		if err != nil {
+			return stats, err
+		}
+		stats.Trained += len(ids)
+		stats.Forgotten += len(del)
+	}
+	return stats, nil
+}
+
+// Refresh syncs only when the library and the trained documents disagree,
+// judged by comparing row counts and id and version sums, so it is cheap to
+// call whenever the library may have changed.
+func Refresh(gdb *gorm.DB) error {
+	type fingerprint struct{ N, IDs, Versions int64 }
+	var lib, docs fingerprint
+	if err := gdb.Table("images").
+		Select("COUNT(*) AS n, COALESCE(SUM(id), 0) AS ids, COALESCE(SUM(version), 0) AS versions").
+		Scan(&lib).Error; err != nil {
+		return err
+	}
+	if err := gdb.Table("classifier_docs").
+		Select("COUNT(*) AS n, COALESCE(SUM(image_id), 0) AS ids, COALESCE(SUM(version), 0) AS versions").
+		Scan(&docs).Error; err != nil {
+		return err
+	}
+	if lib == docs {
+		return nil
+	}
+	_, err := Sync(gdb)
+	return err
+}
+
+// Reset discards everything learned so the next Sync retrains from scratch.
+func Reset(gdb *gorm.DB) error {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	defer forgetVocabSize(gdb)
+	return gdb.Transaction(func(tx *gorm.DB) error {
+		for _, t := range []string{"classifier_docs", "classifier_labels", "classifier_features"} {
+			if err := tx.Exec("DELETE FROM " + t).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func forget(d *delta, o db.ClassifierDoc) error {
+	var labels []string
+	var features map[string]int
+	if err := json.Unmarshal([]byte(o.Labels), &labels); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(o.Features), &features); err != nil {
+		return err
+	}
+	d.add(labels, features, -1)
+	return nil
+}
+
+func take(ids []uint, n int) ([]uint, []uint) {
+	if len(ids) <= n {
+		return ids, nil
+	}
+	return ids[:n], ids[n:]
+}
+
+// vocabSizes caches the number of distinct features per database. Every
+// score needs it and counting scans the whole feature table, but it only
+// changes when training writes, which drops the cached size.
+var vocabSizes = struct {
+	sync.Mutex
+	gen int64
+	n   map[*gorm.Config]int64
+}{n: map[*gorm.Config]int64{}}
+
+func vocabSize(tx *gorm.DB) (int64, error) {
+	vocabSizes.Lock()
+	n, ok := vocabSizes.n[tx.Config]
+	gen := vocabSizes.gen
+	vocabSizes.Unlock()
+	if ok {
+		return n, nil
+	}
+	if err := tx.Model(&db.ClassifierFeature{}).Distinct("feature").Count(&n).Error; err != nil {
+		return 0, err
+	}
+	// A sync that finished while counting may have changed the size.
+	vocabSizes.Lock()
+	if vocabSizes.gen == gen {
+		vocabSizes.n[tx.Config] = n
+	}
+	vocabSizes.Unlock()
+	return n, nil
+}
+
+func forgetVocabSize(gdb *gorm.DB) {
+	vocabSizes.Lock()
+	vocabSizes.gen++
+	delete(vocabSizes.n, gdb.Config)
+	vocabSizes.Unlock()
+}
+
+// Snapshot holds the label totals and vocabulary size of the trained model,
+// which scoring any document needs. A scan loads it once for all its
+// imports.
+type Snapshot struct {
+	labels map[string]db.ClassifierLabel
+	vocab  int64
+}
+
+// LoadSnapshot reads the current label totals and vocabulary size.
+func LoadSnapshot(tx *gorm.DB) (*Snapshot, error) {
+	s := &Snapshot{labels: map[string]db.ClassifierLabel{}}
+	var labels []db.ClassifierLabel
+	if err := tx.Find(&labels).Error; err != nil {
+		return nil, err
+	}
+	for _, l := range labels {
+		s.labels[l.Label] = l
+	}
+	var err error
+	if s.vocab, err = vocabSize(tx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// model holds the counts needed to score one document.
+type model struct {
+	labels map[string]db.ClassifierLabel
+	counts map[string]map[string]int64 // label -> feature -> count
+	vocab  int64
+}
+
+// model loads the feature counts of one document on top of the snapshot.
+func (s *Snapshot) model(tx *gorm.DB, features map[string]int) (*model, error) {
+	m := &model{labels: s.labels, counts: map[string]map[string]int64{}, vocab: s.vocab}
+	if len(features) == 0 {
+		return m, nil
+	}
+	names := make([]string, 0, len(features))
+	for f := range features {
+		names = append(names, f)
+	}
+	var rows []db.ClassifierFeature
+	if err := tx.Where("feature IN ?", names).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if m.counts[r.Label] == nil {
+			m.counts[r.Label] = map[string]int64{}
+		}
+		m.counts[r.Label][r.Feature] = r.Count
+	}
+	return m, nil
+}
+
+// class is the sufficient statistics of one side of a binary decision.
+type class struct {
+	docs, tokens int64
+	count        func(feature string) int64
+}
+
+// logLikelihood is the class prior times the multinomial likelihood of the
+// features, with Laplace smoothing, in log space.
+func (m *model) logLikelihood(c class, totalDocs int64, features map[string]int) float64 {
+	v := float64(m.vocab + 1)
+	ll := math.Log(float64(c.docs) / float64(totalDocs))
+	for f, n := range features {
+		ll += float64(n) * math.Log((float64(c.count(f))+1)/(float64(c.tokens)+v))
+	}
+	return ll
+}
+
+// probability returns P(a | features) for a binary choice between a and b.
+func (m *model) probability(a, b class, features map[string]int) float64 {
+	total := a.docs + b.docs
+	diff := m.logLikelihood(b, total, features) - m.logLikelihood(a, total, features)
+	return 1 / (1 + math.Exp(diff))
+}
+
+func (m *model) labelClass(label string) class {
+	l := m.labels[label]
+	return class{docs: l.Docs, tokens: l.Tokens, count: func(f string) int64 { return m.counts[label][f] }}
+}
+
+// nsfw returns the NSFW probability, or false when either class has too few
+// examples.
+func (m *model) nsfw(features map[string]int) (float64, bool) {
+	a, b := m.labelClass(labelNSFW), m.labelClass(labelSFW)
+	if a.docs < MinExamples || b.docs < MinExamples {
+		return 0, false
+	}
+	return m.probability(a, b, features), true
+}
+
+// NSFWProbability scores metadata that is not in the library yet, such as an
+// import in progress. ok is false until enough images were flagged by hand.
+func (s *Snapshot) NSFWProbability(tx *gorm.DB, features map[string]int) (p float64, ok bool, err error) {
+	m, err := s.model(tx, features)
+	if err != nil {
+		return 0, false, err
+	}
+	p, ok = m.nsfw(features)
+	return p, ok, nil
+}
+
+// Suggestion is a tag the model expects an image to carry.
+type Suggestion struct {
+	TagID      uint    `json:"tagId"`
+	Tag        string  `json:"tag"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Prediction is what the model infers for one image.
+type Prediction struct {
+	// NSFW is the probability the image is NSFW, or nil until enough
+	// images were flagged by hand.
+	NSFW *float64     `json:"nsfwProbability"`
+	Tags []Suggestion `json:"suggestedTags"`
+}
+
+// Predict scores an image in the library. Tags the image already has are
+// not suggested, and only suggestions more likely than not are returned.
+func Predict(tx *gorm.DB, id uint) (Prediction, error) {
+	pred := Prediction{Tags: []Suggestion{}}
+	_, features, err := imageDoc(tx, id)
+	if err != nil {
+		return pred, err
+	}
+	s, err := LoadSnapshot(tx)
+	if err != nil {
+		return pred, err
+	}
+	m, err := s.model(tx, features)
+	if err != nil {
+		return pred, err
+	}
+	if p, ok := m.nsfw(features); ok {
+		pred.NSFW = &p
+	}
+
+	tagged := m.labels[labelTagged]
+	var have []uint
+	if err := tx.Table("image_tags").Where("image_id = ?", id).Pluck("tag_id", &have).Error; err != nil {
+		return pred, err
+	}
+	skip := map[string]bool{}
+	for _, t := range have {
+		skip[tagPrefix+strconv.FormatUint(uint64(t), 10)] = true
+	}
+	scores := map[uint]float64{}
+	for label, l := range m.labels {
+		if !strings.HasPrefix(label, tagPrefix) || skip[label] || l.Docs < MinExamples || l.Docs >= tagged.Docs {
+			continue
+		}
+		a := m.labelClass(label)
+		rest := class{
+			docs:   tagged.Docs - l.Docs,
+			tokens: tagged.Tokens - l.Tokens,
+			count:  func(f string) int64 { return m.counts[labelTagged][f] - m.counts[label][f] },
+		}
+		if p := m.probability(a, rest, features); p > 0.5 {
+			id, err := strconv.ParseUint(strings.TrimPrefix(label, tagPrefix), 10, 64)
+			if err == nil {
+				scores[uint(id)] = p
+			}
+		}
+	}
+	if len(scores) == 0 {
+		return pred, nil
+	}
+
+	ids := make([]uint, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	var tags []struct {
+		ID   uint
+		Name string
+	}
+	if err := tx.Table("tags").Select("id, name").Where("id IN ?", ids).Scan(&tags).Error; err != nil {
+		return pred, err
+	}
+	for _, t := range tags {
+		pred.Tags = append(pred.Tags, Suggestion{TagID: t.ID, Tag: t.Name, Confidence: scores[t.ID]})
+	}
+	sort.Slice(pred.Tags, func(i, j int) bool {
+		if pred.Tags[i].Confidence != pred.Tags[j].Confidence {
+			return pred.Tags[i].Confidence > pred.Tags[j].Confidence
+		}
+		return pred.Tags[i].Tag < pred.Tags[j].Tag
+	})
+	if len(pred.Tags) > maxSuggestions {
+		pred.Tags = pred.Tags[:maxSuggestions]
+	}
+	return pred, nil
+}
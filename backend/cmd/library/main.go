@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -16,7 +21,9 @@ import (
 	"gen-library/backend/api"
 	"gen-library/backend/db"
 	"gen-library/backend/logger"
+	"gen-library/backend/rules"
 	"gen-library/backend/scan"
+	"gen-library/backend/util"
 )
 
 func requestIDMiddleware() gin.HandlerFunc {
@@ -31,6 +38,27 @@ func requestIDMiddleware() gin.HandlerFunc {
 	}
 }
 
+// thumbWorkers returns the thumbnail worker count from THUMB_WORKERS,
+// defaulting to the number of CPUs.
+func thumbWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("THUMB_WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// libraryRoots returns the extra library roots listed in LIBRARY_ROOTS,
+// separated like PATH.
+func libraryRoots() []string {
+	var roots []string
+	for _, p := range filepath.SplitList(os.Getenv("LIBRARY_ROOTS")) {
+		if strings.TrimSpace(p) != "" {
+			roots = append(roots, p)
+		}
+	}
+	return roots
+}
+
 func main() {
 	if os.Getenv("GENLIBRARY_SKIP_SERVER") != "" {
 		return
@@ -45,7 +73,10 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	dbConn, err := gorm.Open(sqlite.Open("library.db"), &gorm.Config{})
+	// Foreign keys are enabled per connection, so the pragma goes in the
+	// DSN to reach every connection in the pool; deletes rely on the
+	// ON DELETE CASCADE links.
+	dbConn, err := gorm.Open(sqlite.Open("library.db?_pragma=foreign_keys(1)"), &gorm.Config{})
 	if err != nil {
 		logger.Error().Err(err).Msg("failed to open database")
 		os.Exit(1)
@@ -56,6 +87,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	api.SetLibraryRoots(libraryRoots())
+	api.SetTrashDir(os.Getenv("TRASH_PATH"))
+	scan.TrashDir = api.TrashDir
+	util.OnBlurHash = api.BlurHashRecorder(dbConn)
+	rules.Track = api.RuleChangeTracker()
+	util.StartThumbWorkers(thumbWorkers())
+	go api.StartThumbJanitor(context.Background(), dbConn, 10*time.Minute)
+	go api.StartTrashJanitor(context.Background(), dbConn, time.Hour)
+	go api.StartClassifierTrainer(context.Background(), dbConn, time.Minute)
+
 	var root string
 	if err := dbConn.Table("settings").Select("value").Where("key=?", "library_path").Scan(&root).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		logger.Warn().Err(err).Msg("failed to read library_path")
@@ -83,12 +124,12 @@ func main() {
 
 	r.Use(cors.New(cors.Config{
 		AllowOriginFunc:  func(origin string) bool { return true },
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Range", "If-None-Match", "If-Modified-Since", "If-Match", "X-Vault-Token"},
+		ExposeHeaders:    []string{"ETag", "Content-Range", "Accept-Ranges"},
 		AllowCredentials: true,
 	}))
 
-	r.StaticFS("/thumbs", http.Dir(".cache/thumbs"))
 	api.RegisterRoutes(r, dbConn)
 
 	port := os.Getenv("BACKEND_PORT")
@@ -10,7 +10,8 @@ import (
 // ApplyMigrations creates tables and FTS structures idempotently using raw SQL.
 func ApplyMigrations(gdb *gorm.DB) error {
 	stmts := []string{
-		// Pragma & tables
+		// Pragma & tables. The pragma only reaches this connection; pooled
+		// connections need it in the DSN.
 		"PRAGMA foreign_keys = ON;",
 		`CREATE TABLE IF NOT EXISTS models (
                        id INTEGER PRIMARY KEY,
@@ -49,11 +50,16 @@ func ApplyMigrations(gdb *gorm.DB) error {
                         hidden INTEGER DEFAULT 0,
                         favorite INTEGER DEFAULT 0,
                         raw_metadata TEXT,
+                        blur_hash TEXT,
+                        version INTEGER NOT NULL DEFAULT 1,
+                        nsfw_manual INTEGER NOT NULL DEFAULT 0,
                         FOREIGN KEY (model_id) REFERENCES models(id)
                 );`,
 		`CREATE TABLE IF NOT EXISTS tags (
 			id INTEGER PRIMARY KEY,
-			name TEXT UNIQUE NOT NULL
+			name TEXT UNIQUE NOT NULL,
+			namespace TEXT NOT NULL DEFAULT '',
+			parent_id INTEGER REFERENCES tags(id) ON DELETE SET NULL
 		);`,
 		`CREATE TABLE IF NOT EXISTS image_tags (
 			image_id INTEGER NOT NULL,
@@ -62,6 +68,86 @@ func ApplyMigrations(gdb *gorm.DB) error {
 			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE,
 			FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS tag_aliases (
+			alias TEXT PRIMARY KEY,
+			tag_id INTEGER NOT NULL,
+			FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS rules (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			enabled INTEGER NOT NULL DEFAULT 1,
+			priority INTEGER NOT NULL DEFAULT 0,
+			conditions TEXT NOT NULL,
+			actions TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS albums (
+			id INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			cover_image_id INTEGER REFERENCES images(id) ON DELETE SET NULL,
+			created_at DATETIME,
+			updated_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS album_images (
+			album_id INTEGER NOT NULL,
+			image_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			PRIMARY KEY (album_id, image_id),
+			FOREIGN KEY (album_id) REFERENCES albums(id) ON DELETE CASCADE,
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS saved_searches (
+			id INTEGER PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			query TEXT NOT NULL,
+			created_at DATETIME,
+			updated_at DATETIME
+		);`,
+		// Custom fields are typed, per library fields set on images. value has
+		// no declared type so numbers keep numeric comparisons.
+		`CREATE TABLE IF NOT EXISTS custom_fields (
+			id INTEGER PRIMARY KEY,
+			name TEXT UNIQUE NOT NULL,
+			type TEXT NOT NULL,
+			options TEXT NOT NULL DEFAULT '[]',
+			created_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS image_field_values (
+			image_id INTEGER NOT NULL,
+			field_id INTEGER NOT NULL,
+			value NOT NULL,
+			PRIMARY KEY (image_id, field_id),
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE,
+			FOREIGN KEY (field_id) REFERENCES custom_fields(id) ON DELETE CASCADE
+		);`,
+		// image_id has no foreign key so entries outlive the image.
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY,
+			created_at DATETIME NOT NULL,
+			action TEXT NOT NULL,
+			image_id INTEGER,
+			detail TEXT,
+			request_id TEXT NOT NULL DEFAULT '',
+			client TEXT NOT NULL DEFAULT ''
+		);`,
+		`CREATE TABLE IF NOT EXISTS classifier_docs (
+			image_id INTEGER PRIMARY KEY,
+			version INTEGER NOT NULL,
+			labels TEXT NOT NULL,
+			features TEXT NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS classifier_labels (
+			label TEXT PRIMARY KEY,
+			docs INTEGER NOT NULL,
+			tokens INTEGER NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS classifier_features (
+			label TEXT NOT NULL,
+			feature TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (label, feature)
+		);`,
 		`CREATE TABLE IF NOT EXISTS settings (
                        key TEXT PRIMARY KEY,
                        value TEXT NOT NULL
@@ -100,12 +186,27 @@ func ApplyMigrations(gdb *gorm.DB) error {
 		`CREATE INDEX IF NOT EXISTS models_hash_idx ON models(hash);`,
 		`CREATE INDEX IF NOT EXISTS image_tags_image_idx ON image_tags(image_id);`,
 		`CREATE INDEX IF NOT EXISTS image_tags_tag_idx ON image_tags(tag_id);`,
+		`CREATE INDEX IF NOT EXISTS tag_aliases_tag_idx ON tag_aliases(tag_id);`,
 		`CREATE INDEX IF NOT EXISTS loras_hash_idx ON loras(hash);`,
+		`CREATE INDEX IF NOT EXISTS classifier_features_feature_idx ON classifier_features(feature);`,
+		`CREATE INDEX IF NOT EXISTS album_images_position_idx ON album_images(album_id, position);`,
+		`CREATE INDEX IF NOT EXISTS album_images_image_idx ON album_images(image_id);`,
+		`CREATE INDEX IF NOT EXISTS audit_log_image_idx ON audit_log(image_id, id);`,
+		`CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log(action, id);`,
+		`CREATE INDEX IF NOT EXISTS image_field_values_field_idx ON image_field_values(field_id, value);`,
 		`CREATE INDEX IF NOT EXISTS image_loras_image_idx ON image_loras(image_id);`,
 		`CREATE INDEX IF NOT EXISTS image_loras_lora_idx ON image_loras(lora_id);`,
 		`CREATE INDEX IF NOT EXISTS embeddings_hash_idx ON embeddings(hash);`,
 		`CREATE INDEX IF NOT EXISTS image_embeddings_image_idx ON image_embeddings(image_id);`,
 		`CREATE INDEX IF NOT EXISTS image_embeddings_embedding_idx ON image_embeddings(embedding_id);`,
+		// Keyset pagination indexes, one per sort key with id as tie-breaker
+		`CREATE INDEX IF NOT EXISTS images_created_time_id_idx ON images(created_time, id);`,
+		`CREATE INDEX IF NOT EXISTS images_imported_at_id_idx ON images(imported_at, id);`,
+		`CREATE INDEX IF NOT EXISTS images_file_name_id_idx ON images(file_name, id);`,
+		`CREATE INDEX IF NOT EXISTS images_rating_id_idx ON images(rating, id);`,
+		`CREATE INDEX IF NOT EXISTS images_size_bytes_id_idx ON images(size_bytes, id);`,
+		`CREATE INDEX IF NOT EXISTS images_steps_id_idx ON images(steps, id);`,
+		`CREATE INDEX IF NOT EXISTS images_cfg_scale_id_idx ON images(cfg_scale, id);`,
 	}
 
 	for _, s := range stmts {
@@ -163,34 +264,187 @@ func ApplyMigrations(gdb *gorm.DB) error {
 		}
 	}
 
+	if err := ensureColumn(gdb, "images", "blur_hash", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(gdb, "images", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	// blur_id is a random name for the blurred thumbnails, which must not
+	// lead back to the sha and so the plain thumbnail.
+	if err := ensureColumn(gdb, "images", "blur_id", "TEXT"); err != nil {
+		return err
+	}
+	for _, s := range []string{
+		`UPDATE images SET blur_id = lower(hex(randomblob(16))) WHERE blur_id IS NULL;`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS images_blur_id_idx ON images(blur_id);`,
+		`CREATE TRIGGER IF NOT EXISTS images_blur_id AFTER INSERT ON images WHEN new.blur_id IS NULL BEGIN
+			UPDATE images SET blur_id = lower(hex(randomblob(16))) WHERE id = new.id;
+		END;`,
+	} {
+		if err := gdb.Exec(s).Error; err != nil {
+			return fmt.Errorf("migration failed on: %s\nerr: %w", s, err)
+		}
+	}
+	if err := ensureColumn(gdb, "images", "nsfw_manual", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Trashed images keep their row; path points into the trash folder and
+	// original_path is where a restore puts the file back.
+	if err := ensureColumn(gdb, "images", "deleted_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := ensureColumn(gdb, "images", "original_path", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(gdb, "images", "trash_dir", "TEXT"); err != nil {
+		return err
+	}
+	if err := gdb.Exec(`CREATE INDEX IF NOT EXISTS images_deleted_at_idx ON images(deleted_at);`).Error; err != nil {
+		return err
+	}
+	// notes is free text; custom_text collects the image's text and select
+	// custom field values for full text search and is kept up to date by
+	// the image_field_values triggers.
+	if err := ensureColumn(gdb, "images", "notes", "TEXT"); err != nil {
+		return err
+	}
+	if err := ensureColumn(gdb, "images", "custom_text", "TEXT"); err != nil {
+		return err
+	}
+	const customText = `UPDATE images SET custom_text = (
+			SELECT group_concat(v.value, ' ') FROM image_field_values v
+			JOIN custom_fields f ON f.id = v.field_id
+			WHERE v.image_id = images.id AND f.type IN ('text', 'select')
+		) WHERE id = `
+	for _, s := range []string{
+		`CREATE TRIGGER IF NOT EXISTS image_field_values_ai AFTER INSERT ON image_field_values BEGIN
+			` + customText + `new.image_id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS image_field_values_au AFTER UPDATE ON image_field_values BEGIN
+			` + customText + `old.image_id;
+			` + customText + `new.image_id;
+		END;`,
+		`CREATE TRIGGER IF NOT EXISTS image_field_values_ad AFTER DELETE ON image_field_values BEGIN
+			` + customText + `old.image_id;
+		END;`,
+	} {
+		if err := gdb.Exec(s).Error; err != nil {
+			return fmt.Errorf("migration failed on: %s\nerr: %w", s, err)
+		}
+	}
+	// Field level history: old and new values are JSON, version is the
+	// image version the change produced.
+	for _, col := range [][2]string{
+		{"field", "TEXT NOT NULL DEFAULT ''"},
+		{"old_value", "TEXT"},
+		{"new_value", "TEXT"},
+		{"version", "INTEGER"},
+	} {
+		if err := ensureColumn(gdb, "audit_log", col[0], col[1]); err != nil {
+			return err
+		}
+	}
+	// hidden follows the image's hidden flag so the entries of a hidden
+	// image stay behind the vault after the image is deleted.
+	if err := ensureColumn(gdb, "audit_log", "hidden", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := gdb.Exec(`UPDATE audit_log SET hidden = 1 WHERE hidden = 0 AND image_id IN (SELECT id FROM images WHERE hidden = 1);`).Error; err != nil {
+		return err
+	}
+
+	// Tags became hierarchical; existing tags get their namespace and parent
+	// derived from their names once.
+	if exists, err := columnExists(gdb, "tags", "namespace"); err != nil {
+		return err
+	} else if !exists {
+		if err := ensureColumn(gdb, "tags", "namespace", "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		if err := ensureColumn(gdb, "tags", "parent_id", "INTEGER REFERENCES tags(id) ON DELETE SET NULL"); err != nil {
+			return err
+		}
+		if err := backfillTagHierarchy(gdb); err != nil {
+			return fmt.Errorf("failed backfilling tag hierarchy: %w", err)
+		}
+	}
+	for _, s := range []string{
+		`CREATE INDEX IF NOT EXISTS tags_parent_idx ON tags(parent_id);`,
+		`CREATE INDEX IF NOT EXISTS tags_namespace_idx ON tags(namespace);`,
+	} {
+		if err := gdb.Exec(s).Error; err != nil {
+			return fmt.Errorf("migration failed on: %s\nerr: %w", s, err)
+		}
+	}
+
+	// Earlier versions of the update and delete triggers removed only the
+	// file name from the index, leaving stale prompt terms behind, and the
+	// index had no notes or custom field columns. Replace the index and its
+	// triggers and rebuild it once when an old version is found.
+	var auSQL string
+	if err := gdb.Raw(`SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = 'images_au'`).Scan(&auSQL).Error; err != nil {
+		return err
+	}
+	rebuildFTS := auSQL != "" && !strings.Contains(auSQL, "old.custom_text")
+	if rebuildFTS {
+		for _, name := range []string{"images_ai", "images_ad", "images_au"} {
+			if err := gdb.Exec("DROP TRIGGER IF EXISTS " + name + ";").Error; err != nil {
+				return fmt.Errorf("failed dropping trigger %s: %w", name, err)
+			}
+		}
+		if err := gdb.Exec("DROP TABLE IF EXISTS images_fts;").Error; err != nil {
+			if strings.Contains(err.Error(), "no such module: fts5") {
+				return nil
+			}
+			return fmt.Errorf("failed dropping images_fts: %w", err)
+		}
+	}
+
 	// Optional FTS5 setup; ignore if module unavailable
 	ftsStmts := []string{
 		`CREATE VIRTUAL TABLE IF NOT EXISTS images_fts USING fts5(
-                       file_name, model_name, prompt, negative_prompt, raw_metadata,
+                       file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text,
                        content='images', content_rowid='id'
                );`,
 		`CREATE TRIGGER IF NOT EXISTS images_ai AFTER INSERT ON images BEGIN
-                       INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata)
-                       VALUES (new.id, new.file_name, (SELECT name FROM models WHERE id = new.model_id), new.prompt, new.negative_prompt, new.raw_metadata);
+                       INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text)
+                       VALUES (new.id, new.file_name, (SELECT name FROM models WHERE id = new.model_id), new.prompt, new.negative_prompt, new.raw_metadata, new.notes, new.custom_text);
                END;`,
 		`CREATE TRIGGER IF NOT EXISTS images_ad AFTER DELETE ON images BEGIN
-                       INSERT INTO images_fts(images_fts, rowid, file_name) VALUES('delete', old.id, old.file_name);
+                       INSERT INTO images_fts(images_fts, rowid, file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text)
+                       VALUES('delete', old.id, old.file_name, (SELECT name FROM models WHERE id = old.model_id), old.prompt, old.negative_prompt, old.raw_metadata, old.notes, old.custom_text);
                END;`,
 		`CREATE TRIGGER IF NOT EXISTS images_au AFTER UPDATE ON images BEGIN
-                       INSERT INTO images_fts(images_fts, rowid, file_name) VALUES('delete', old.id, old.file_name);
-                       INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata)
-                       VALUES (new.id, new.file_name, (SELECT name FROM models WHERE id = new.model_id), new.prompt, new.negative_prompt, new.raw_metadata);
+                       INSERT INTO images_fts(images_fts, rowid, file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text)
+                       VALUES('delete', old.id, old.file_name, (SELECT name FROM models WHERE id = old.model_id), old.prompt, old.negative_prompt, old.raw_metadata, old.notes, old.custom_text);
+                       INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text)
+                       VALUES (new.id, new.file_name, (SELECT name FROM models WHERE id = new.model_id), new.prompt, new.negative_prompt, new.raw_metadata, new.notes, new.custom_text);
                END;`,
 	}
 	for _, s := range ftsStmts {
 		if err := gdb.Exec(s).Error; err != nil {
 			if strings.Contains(err.Error(), "no such module: fts5") {
-				break
+				return nil
 			}
 			return fmt.Errorf("migration failed on: %s\nerr: %w", s, err)
 		}
 	}
 
+	if rebuildFTS {
+		rebuild := []string{
+			`INSERT INTO images_fts(images_fts) VALUES('delete-all');`,
+			`INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata, notes, custom_text)
+                       SELECT images.id, images.file_name, models.name, images.prompt, images.negative_prompt, images.raw_metadata, images.notes, images.custom_text
+                       FROM images LEFT JOIN models ON models.id = images.model_id;`,
+		}
+		for _, s := range rebuild {
+			if err := gdb.Exec(s).Error; err != nil {
+				return fmt.Errorf("failed rebuilding images_fts: %w", err)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -208,3 +462,18 @@ func columnExists(gdb *gorm.DB, table, column string) (bool, error) {
 	}
 	return false, nil
 }
+
+// ensureColumn adds a column to a table if it is not already present.
+func ensureColumn(gdb *gorm.DB, table, column, decl string) error {
+	exists, err := columnExists(gdb, table, column)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if err := gdb.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, decl)).Error; err != nil {
+		return fmt.Errorf("failed adding %s.%s: %w", table, column, err)
+	}
+	return nil
+}
@@ -37,3 +37,68 @@ func TestApplyMigrationsIsIdempotent(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, has)
 }
+
+func TestApplyMigrationsUpgradesFTSTriggers(t *testing.T) {
+	gdb, err := gorm.Open(sqlite.Open("file:fts_upgrade?mode=memory&cache=shared&_busy_timeout=5000"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := gdb.DB()
+	sqlDB.SetMaxOpenConns(1)
+	defer sqlDB.Close()
+
+	require.NoError(t, ApplyMigrations(gdb))
+	if gdb.Exec("SELECT 1 FROM images_fts LIMIT 1").Error != nil {
+		t.Skip("fts5 not available")
+	}
+
+	// Recreate the original trigger, which only removed file_name terms.
+	require.NoError(t, gdb.Exec(`DROP TRIGGER images_au;`).Error)
+	require.NoError(t, gdb.Exec(`CREATE TRIGGER images_au AFTER UPDATE ON images BEGIN
+		INSERT INTO images_fts(images_fts, rowid, file_name) VALUES('delete', old.id, old.file_name);
+		INSERT INTO images_fts(rowid, file_name, model_name, prompt, negative_prompt, raw_metadata)
+		VALUES (new.id, new.file_name, (SELECT name FROM models WHERE id = new.model_id), new.prompt, new.negative_prompt, new.raw_metadata);
+	END;`).Error)
+	require.NoError(t, gdb.Exec(`INSERT INTO images (path, file_name, ext, size_bytes, sha256, prompt) VALUES ('a.png', 'a', 'png', 1, 'a', 'alpha');`).Error)
+	require.NoError(t, gdb.Exec(`UPDATE images SET prompt = 'beta';`).Error)
+
+	match := func(term string) int64 {
+		var n int64
+		require.NoError(t, gdb.Raw(`SELECT COUNT(*) FROM images_fts WHERE images_fts MATCH ?`, term).Scan(&n).Error)
+		return n
+	}
+	require.EqualValues(t, 1, match("alpha"))
+
+	require.NoError(t, ApplyMigrations(gdb))
+	require.EqualValues(t, 0, match("alpha"))
+	require.EqualValues(t, 1, match("beta"))
+
+	require.NoError(t, gdb.Exec(`UPDATE images SET prompt = 'gamma';`).Error)
+	require.EqualValues(t, 0, match("beta"))
+	require.EqualValues(t, 1, match("gamma"))
+}
+
+func TestApplyMigrationsBackfillsTagHierarchy(t *testing.T) {
+	gdb, err := gorm.Open(sqlite.Open("file:tag_backfill?mode=memory&cache=shared&_busy_timeout=5000"), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, _ := gdb.DB()
+	sqlDB.SetMaxOpenConns(1)
+	defer sqlDB.Close()
+
+	require.NoError(t, gdb.Exec(`CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT UNIQUE NOT NULL);`).Error)
+	require.NoError(t, gdb.Exec(`INSERT INTO tags (name) VALUES ('cat'), ('Style:watercolor'), ('project:book-cover/chapter-3');`).Error)
+	require.NoError(t, ApplyMigrations(gdb))
+
+	byName := func(name string) Tag {
+		var tag Tag
+		require.NoError(t, gdb.Where("name = ?", name).First(&tag).Error)
+		return tag
+	}
+	require.Equal(t, "", byName("cat").Namespace)
+	require.Equal(t, "style", byName("style:watercolor").Namespace)
+
+	parent := byName("project:book-cover")
+	require.Equal(t, "project", parent.Namespace)
+	require.Nil(t, parent.ParentID)
+	child := byName("project:book-cover/chapter-3")
+	require.NotNil(t, child.ParentID)
+	require.Equal(t, parent.ID, *child.ParentID)
+}
@@ -42,8 +42,26 @@ type Image struct {
 	NSFW     bool `gorm:"default:false" json:"nsfw"`
 	Hidden   bool `gorm:"default:false" json:"hidden"`
 	Favorite bool `gorm:"default:false" json:"favorite"`
+	// NSFWManual is set when a user sets the NSFW flag by hand, so
+	// reclassification leaves it alone.
+	NSFWManual bool `gorm:"not null;default:false" json:"nsfwManual"`
+	// DeletedAt is set while the image is in the trash. Path then points
+	// into the trash folder and OriginalPath holds the library path.
+	DeletedAt    *time.Time `json:"deletedAt"`
+	OriginalPath *string    `json:"originalPath,omitempty"`
+	// TrashDir is the trash folder the file was moved into, so a later
+	// change of the configured folder does not strand it.
+	TrashDir *string `json:"-"`
+	Notes    *string `json:"notes"`
+	// Fields holds the image's custom field values keyed by field name.
+	Fields map[string]any `gorm:"-" json:"fields,omitempty"`
 
 	RawMetadata datatypes.JSON `json:"rawMetadata"`
+	BlurHash    *string        `json:"blurHash"`
+	// BlurID names the cached blurred thumbnails so their URLs do not
+	// reveal the sha. The database assigns it on insert.
+	BlurID  *string `json:"-"`
+	Version int     `gorm:"not null;default:1" json:"version"`
 
 	Loras      []*Lora      `gorm:"many2many:image_loras;constraint:OnDelete:CASCADE" json:"loras"`
 	Embeddings []*Embedding `gorm:"many2many:image_embeddings;constraint:OnDelete:CASCADE" json:"embeddings"`
@@ -51,8 +69,15 @@ type Image struct {
 }
 
 type Tag struct {
-	ID   uint   `gorm:"primaryKey" json:"id"`
-	Name string `gorm:"uniqueIndex;not null" json:"name"`
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	Name      string `gorm:"uniqueIndex;not null" json:"name"`
+	Namespace string `gorm:"not null;default:''" json:"namespace"`
+	ParentID  *uint  `json:"parentId"`
+}
+
+type TagAlias struct {
+	Alias string `gorm:"primaryKey" json:"alias"`
+	TagID uint   `gorm:"not null" json:"tagId"`
 }
 
 type ImageTag struct {
@@ -90,6 +115,111 @@ type Embedding struct {
 	Hash *string `gorm:"index" json:"hash"`
 }
 
+// Rule tags or flags images whose metadata matches its conditions. The
+// conditions and actions are JSON documents interpreted by package rules.
+type Rule struct {
+	ID         uint           `gorm:"primaryKey" json:"id"`
+	Name       string         `gorm:"not null" json:"name"`
+	Enabled    bool           `gorm:"not null" json:"enabled"`
+	Priority   int            `gorm:"not null" json:"priority"`
+	Conditions datatypes.JSON `gorm:"not null" json:"conditions"`
+	Actions    datatypes.JSON `gorm:"not null" json:"actions"`
+}
+
+// Album is a curated, ordered collection of images. Removing an album or
+// its images never touches the files.
+type Album struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `gorm:"not null" json:"name"`
+	Description  string    `gorm:"not null" json:"description"`
+	CoverImageID *uint     `json:"coverImageId"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// AlbumImage places an image in an album. Positions order the album
+// ascending and may have gaps.
+type AlbumImage struct {
+	AlbumID  uint `gorm:"primaryKey" json:"albumId"`
+	ImageID  uint `gorm:"primaryKey" json:"imageId"`
+	Position int  `gorm:"not null" json:"position"`
+}
+
+// SavedSearch is a named listImages query string, filters and sort
+// included, that serves as a dynamic collection.
+type SavedSearch struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"uniqueIndex;not null" json:"name"`
+	Query     string    `gorm:"not null" json:"query"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Custom field types.
+const (
+	FieldText   = "text"
+	FieldNumber = "number"
+	FieldDate   = "date"
+	FieldSelect = "select"
+)
+
+// CustomField defines a typed field that can be set on images. Options
+// lists the allowed values of a select field. Values live in
+// image_field_values: text, a number, a YYYY-MM-DD date or one of the
+// options.
+type CustomField struct {
+	ID        uint                        `gorm:"primaryKey" json:"id"`
+	Name      string                      `gorm:"uniqueIndex;not null" json:"name"`
+	Type      string                      `gorm:"not null" json:"type"`
+	Options   datatypes.JSONSlice[string] `json:"options,omitempty"`
+	CreatedAt time.Time                   `json:"createdAt"`
+}
+
+// AuditEntry records a destructive action or a change to one image field.
+// Detail holds what was affected, such as the file path, as JSON. Field
+// changes carry the old and new value as JSON and the image version the
+// change produced.
+type AuditEntry struct {
+	ID        uint           `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Action    string         `gorm:"not null" json:"action"`
+	ImageID   *uint          `json:"imageId"`
+	Field     string         `gorm:"not null;default:''" json:"field,omitempty"`
+	OldValue  datatypes.JSON `json:"oldValue,omitempty"`
+	NewValue  datatypes.JSON `json:"newValue,omitempty"`
+	Version   *int           `json:"version,omitempty"`
+	Detail    datatypes.JSON `json:"detail,omitempty"`
+	RequestID string         `gorm:"not null;default:''" json:"requestId"`
+	Client    string         `gorm:"not null;default:''" json:"client"`
+	Hidden    bool           `gorm:"not null;default:false" json:"-"`
+}
+
+// TableName keeps the audit log table name singular.
+func (AuditEntry) TableName() string { return "audit_log" }
+
+// ClassifierDoc records what one image contributed to the classifier, as
+// of the image version it was computed from.
+type ClassifierDoc struct {
+	ImageID  uint   `gorm:"primaryKey"`
+	Version  int    `gorm:"not null"`
+	Labels   string `gorm:"not null"`
+	Features string `gorm:"not null"`
+}
+
+// ClassifierLabel counts the images and feature occurrences of a label.
+type ClassifierLabel struct {
+	Label  string `gorm:"primaryKey"`
+	Docs   int64  `gorm:"not null"`
+	Tokens int64  `gorm:"not null"`
+}
+
+// ClassifierFeature counts the occurrences of a feature under a label.
+type ClassifierFeature struct {
+	Label   string `gorm:"primaryKey"`
+	Feature string `gorm:"primaryKey"`
+	Count   int64  `gorm:"not null"`
+}
+
 type Setting struct {
 	Key   string `gorm:"primaryKey" json:"key"`
 	Value string `gorm:"not null" json:"value"`
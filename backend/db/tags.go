@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"gorm.io/gorm"
+)
+
+// ErrEmptyTagName is returned for tag names with nothing but separators.
+var ErrEmptyTagName = errors.New("tag name is empty")
+
+// SplitTagName parses a tag written as "namespace:path/to/tag". The
+// namespace is optional and lower-cased; path segments are trimmed and empty
+// ones dropped.
+func SplitTagName(raw string) (namespace string, path []string) {
+	raw = strings.TrimSpace(raw)
+	if i := strings.Index(raw, ":"); i > 0 {
+		ns := raw[:i]
+		if !strings.Contains(ns, "/") && strings.IndexFunc(ns, unicode.IsSpace) < 0 {
+			namespace = strings.ToLower(ns)
+			raw = raw[i+1:]
+		}
+	}
+	for _, seg := range strings.Split(raw, "/") {
+		if seg = strings.TrimSpace(seg); seg != "" {
+			path = append(path, seg)
+		}
+	}
+	return namespace, path
+}
+
+// JoinTagName builds the canonical tag name from a namespace and path.
+func JoinTagName(namespace string, path []string) string {
+	name := strings.Join(path, "/")
+	if namespace != "" && name != "" {
+		return namespace + ":" + name
+	}
+	return name
+}
+
+// CanonicalTagName normalizes a tag as typed by a user, or returns "" if it
+// has no name.
+func CanonicalTagName(raw string) string {
+	return JoinTagName(SplitTagName(raw))
+}
+
+// ParentTagName returns the canonical name of a tag's parent, or "" for a
+// top level tag.
+func ParentTagName(name string) string {
+	ns, path := SplitTagName(name)
+	if len(path) < 2 {
+		return ""
+	}
+	return JoinTagName(ns, path[:len(path)-1])
+}
+
+// LookupTag finds a tag by canonical name or, failing that, by alias.
+func LookupTag(tx *gorm.DB, name string) (Tag, error) {
+	name = CanonicalTagName(name)
+	var t Tag
+	err := tx.Where("name = ?", name).First(&t).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return t, err
+	}
+	var a TagAlias
+	if err := tx.Where("alias = ?", name).First(&a).Error; err != nil {
+		return t, err
+	}
+	return t, tx.First(&t, a.TagID).Error
+}
+
+// ResolveTag returns the tag a name or alias refers to, creating the tag and
+// any missing ancestors if neither exists. Names use "namespace:a/b" syntax.
+func ResolveTag(tx *gorm.DB, raw string) (Tag, error) {
+	if CanonicalTagName(raw) == "" {
+		return Tag{}, ErrEmptyTagName
+	}
+	t, err := LookupTag(tx, raw)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return EnsureTag(tx, CanonicalTagName(raw))
+	}
+	return t, err
+}
+
+// EnsureTag finds or creates the tag with a canonical name, linking it to
+// its parent. Aliases are not consulted so a hierarchy is never rooted in
+// an unrelated tag.
+func EnsureTag(tx *gorm.DB, name string) (Tag, error) {
+	var t Tag
+	err := tx.Where("name = ?", name).First(&t).Error
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return t, err
+	}
+	ns, _ := SplitTagName(name)
+	t = Tag{Name: name, Namespace: ns}
+	if pn := ParentTagName(name); pn != "" {
+		p, err := EnsureTag(tx, pn)
+		if err != nil {
+			return t, err
+		}
+		t.ParentID = &p.ID
+	}
+	return t, tx.Create(&t).Error
+}
+
+// backfillTagHierarchy derives the namespace and parent of tags created
+// before tags were hierarchical, creating missing parent tags.
+func backfillTagHierarchy(gdb *gorm.DB) error {
+	var tags []Tag
+	if err := gdb.Order("id").Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if err := linkTag(gdb, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkTag sets a tag's namespace and parent from its name. Names are
+// rewritten to canonical form unless that would collide with another tag.
+func linkTag(gdb *gorm.DB, t Tag) error {
+	ns, _ := SplitTagName(t.Name)
+	updates := map[string]any{"namespace": ns}
+	if name := CanonicalTagName(t.Name); name != "" && name != t.Name {
+		var n int64
+		if err := gdb.Model(&Tag{}).Where("name = ?", name).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			updates["name"] = name
+		}
+	}
+	if pn := ParentTagName(t.Name); pn != "" {
+		var p Tag
+		err := gdb.Where("name = ?", pn).First(&p).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			p = Tag{Name: pn}
+			if err := gdb.Create(&p).Error; err != nil {
+				return err
+			}
+			if err := linkTag(gdb, p); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		updates["parent_id"] = p.ID
+	}
+	return gdb.Model(&Tag{}).Where("id = ?", t.ID).Updates(updates).Error
+}
@@ -0,0 +1,182 @@
+package jobs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+
+	"gen-library/backend/logger"
+)
+
+// Job statuses.
+const (
+	StatusRunning  = "running"
+	StatusDone     = "done"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+// maxFinished bounds how many finished jobs are kept for inspection.
+const maxFinished = 50
+
+// Job is a long running background task with progress reporting.
+type Job struct {
+	ID         string     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     string     `json:"status"`
+	Total      int64      `json:"total"`
+	Done       int64      `json:"done"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// Progress is handed to a job function to report how far it has got.
+type Progress struct {
+	job *Job
+}
+
+// SetTotal records the number of work items the job will process.
+func (p *Progress) SetTotal(n int64) { atomic.StoreInt64(&p.job.Total, n) }
+
+// Add marks n more work items as processed.
+func (p *Progress) Add(n int64) { atomic.AddInt64(&p.job.Done, n) }
+
+// SetResult stores a value returned with the job once it finishes.
+func (p *Progress) SetResult(v any) {
+	mu.Lock()
+	p.job.Result = v
+	mu.Unlock()
+}
+
+var (
+	mu   sync.Mutex
+	jobs = map[string]*Job{}
+)
+
+// Start runs fn in the background as a job of the given kind and returns a
+// snapshot of it. Cancelling the job cancels the context passed to fn.
+func Start(kind string, fn func(ctx context.Context, p *Progress) error) Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Status:    StatusRunning,
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	mu.Lock()
+	jobs[j.ID] = j
+	prune()
+	snap := snapshot(j)
+	mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := fn(ctx, &Progress{job: j})
+		now := time.Now()
+		mu.Lock()
+		defer mu.Unlock()
+		j.FinishedAt = &now
+		switch {
+		case err == nil:
+			j.Status = StatusDone
+		case ctx.Err() != nil:
+			j.Status = StatusCanceled
+		default:
+			j.Status = StatusFailed
+			j.Error = err.Error()
+			log := logger.With().Str("component", "jobs").Str("event", "failed").Str("kind", kind).Str("job", j.ID).Logger()
+			log.Warn().Err(err).Msg("")
+		}
+	}()
+	return snap
+}
+
+// Get returns a snapshot of the job with the given id.
+func Get(id string) (Job, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	j, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return snapshot(j), true
+}
+
+// List returns snapshots of all known jobs, newest first.
+func List() []Job {
+	mu.Lock()
+	defer mu.Unlock()
+	res := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		res = append(res, snapshot(j))
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].StartedAt.After(res[b].StartedAt) })
+	return res
+}
+
+// Running reports whether a job of the given kind is in progress.
+func Running(kind string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, j := range jobs {
+		if j.Kind == kind && j.Status == StatusRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// Cancel requests cancellation of a running job. It returns false if no such
+// job exists.
+func Cancel(id string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	j, ok := jobs[id]
+	if !ok {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+// snapshot copies a job for callers. mu must be held; the counters are read
+// atomically because the job updates them without the lock.
+func snapshot(j *Job) Job {
+	return Job{
+		ID:         j.ID,
+		Kind:       j.Kind,
+		Status:     j.Status,
+		Total:      atomic.LoadInt64(&j.Total),
+		Done:       atomic.LoadInt64(&j.Done),
+		Error:      j.Error,
+		Result:     j.Result,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// prune drops the oldest finished jobs beyond maxFinished. mu must be held.
+func prune() {
+	var finished []*Job
+	for _, j := range jobs {
+		if j.Status != StatusRunning {
+			finished = append(finished, j)
+		}
+	}
+	if len(finished) <= maxFinished {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].StartedAt.Before(finished[b].StartedAt) })
+	for _, j := range finished[:len(finished)-maxFinished] {
+		delete(jobs, j.ID)
+	}
+}
@@ -0,0 +1,421 @@
+// Package rules evaluates user-defined tagging rules against image metadata.
+// A rule matches when all of its conditions hold and then adds tags or sets
+// flags on the image.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"gen-library/backend/db"
+)
+
+// Conditions select the images a rule applies to. Unset conditions are
+// ignored; a rule needs at least one.
+type Conditions struct {
+	// Prompt and NegativePrompt are regular expressions matched against
+	// the respective prompt.
+	Prompt         string `json:"prompt,omitempty"`
+	NegativePrompt string `json:"negativePrompt,omitempty"`
+	// Models, Loras, Embeddings and SourceApps match when the image uses
+	// any of the listed names, ignoring case.
+	Models     []string `json:"models,omitempty"`
+	Loras      []string `json:"loras,omitempty"`
+	Embeddings []string `json:"embeddings,omitempty"`
+	SourceApps []string `json:"sourceApps,omitempty"`
+	MinWidth   *int     `json:"minWidth,omitempty"`
+	MaxWidth   *int     `json:"maxWidth,omitempty"`
+	MinHeight  *int     `json:"minHeight,omitempty"`
+	MaxHeight  *int     `json:"maxHeight,omitempty"`
+	// Folder matches images stored under it. Paths are compared as stored,
+	// so folders inside the library are given relative to the library path.
+	Folder string `json:"folder,omitempty"`
+}
+
+func (c Conditions) empty() bool {
+	return c.Prompt == "" && c.NegativePrompt == "" && len(c.Models) == 0 && len(c.Loras) == 0 &&
+		len(c.Embeddings) == 0 && len(c.SourceApps) == 0 && c.MinWidth == nil && c.MaxWidth == nil &&
+		c.MinHeight == nil && c.MaxHeight == nil && strings.Trim(c.Folder, "/ ") == ""
+}
+
+// Actions are applied to every image a rule matches.
+type Actions struct {
+	AddTags  []string `json:"addTags,omitempty"`
+	NSFW     *bool    `json:"nsfw,omitempty"`
+	Rating   *int     `json:"rating,omitempty"`
+	Favorite *bool    `json:"favorite,omitempty"`
+	Hidden   *bool    `json:"hidden,omitempty"`
+}
+
+// ValidationError maps the fields of an invalid rule to their problems.
+type ValidationError map[string]string
+
+func (e ValidationError) Error() string { return "invalid rule" }
+
+// Rule is a validated rule ready to be matched.
+type Rule struct {
+	ID         uint
+	Name       string
+	Conditions Conditions
+	Actions    Actions
+
+	prompt   *regexp.Regexp
+	negative *regexp.Regexp
+}
+
+// New validates a rule's conditions and actions.
+func New(id uint, name string, c Conditions, a Actions) (Rule, error) {
+	r := Rule{ID: id, Name: name, Conditions: c, Actions: a}
+	errs := ValidationError{}
+	if strings.TrimSpace(name) == "" {
+		errs["name"] = "name is required"
+	}
+
+	var err error
+	if c.Prompt != "" {
+		if r.prompt, err = regexp.Compile(c.Prompt); err != nil {
+			errs["conditions.prompt"] = "invalid regular expression"
+		}
+	}
+	if c.NegativePrompt != "" {
+		if r.negative, err = regexp.Compile(c.NegativePrompt); err != nil {
+			errs["conditions.negativePrompt"] = "invalid regular expression"
+		}
+	}
+	for key, v := range map[string]*int{"minWidth": c.MinWidth, "maxWidth": c.MaxWidth, "minHeight": c.MinHeight, "maxHeight": c.MaxHeight} {
+		if v != nil && *v < 0 {
+			errs["conditions."+key] = "must not be negative"
+		}
+	}
+	if c.empty() {
+		errs["conditions"] = "at least one condition is required"
+	}
+
+	for i, t := range a.AddTags {
+		if db.CanonicalTagName(t) == "" {
+			errs[fmt.Sprintf("actions.addTags[%d]", i)] = "tag name is empty"
+		}
+	}
+	if a.Rating != nil && (*a.Rating < 0 || *a.Rating > 5) {
+		errs["actions.rating"] = "must be between 0 and 5"
+	}
+	if len(a.AddTags) == 0 && a.NSFW == nil && a.Rating == nil && a.Favorite == nil && a.Hidden == nil {
+		errs["actions"] = "at least one action is required"
+	}
+
+	if len(errs) > 0 {
+		return r, errs
+	}
+	return r, nil
+}
+
+// Compile decodes and validates a stored rule.
+func Compile(row db.Rule) (Rule, error) {
+	var c Conditions
+	var a Actions
+	if err := json.Unmarshal(row.Conditions, &c); err != nil {
+		return Rule{}, fmt.Errorf("rule %d: conditions: %w", row.ID, err)
+	}
+	if err := json.Unmarshal(row.Actions, &a); err != nil {
+		return Rule{}, fmt.Errorf("rule %d: actions: %w", row.ID, err)
+	}
+	return New(row.ID, row.Name, c, a)
+}
+
+// Load returns the enabled rules, or the rules with the given ids whether
+// enabled or not, in the order they run: ascending priority, so a higher
+// priority wins when rules set the same flag.
+func Load(tx *gorm.DB, ids ...uint) ([]Rule, error) {
+	q := tx.Where("enabled = ?", true)
+	if len(ids) > 0 {
+		q = tx.Where("id IN ?", ids)
+	}
+	var rows []db.Rule
+	if err := q.Order("priority, id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	out := make([]Rule, 0, len(rows))
+	for _, row := range rows {
+		r, err := Compile(row)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Subject is the image metadata rules are matched against.
+type Subject struct {
+	Path           string
+	Prompt         string
+	NegativePrompt string
+	Model          string
+	SourceApp      string
+	Loras          []string
+	Embeddings     []string
+	Width          int
+	Height         int
+}
+
+// LoadSubject reads the metadata of one image.
+func LoadSubject(tx *gorm.DB, id uint) (Subject, error) {
+	var row struct {
+		Path           string
+		Prompt         *string
+		NegativePrompt *string
+		SourceApp      *string
+		Width          *int
+		Height         *int
+		ModelName      *string
+	}
+	res := tx.Table("images").
+		Select("images.path, images.prompt, images.negative_prompt, images.source_app, images.width, images.height, models.name AS model_name").
+		Joins("LEFT JOIN models ON images.model_id = models.id").
+		Where("images.id = ?", id).
+		Limit(1).
+		Scan(&row)
+	if res.Error != nil {
+		return Subject{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return Subject{}, gorm.ErrRecordNotFound
+	}
+
+	s := Subject{Path: row.Path}
+	if row.Prompt != nil {
+		s.Prompt = *row.Prompt
+	}
+	if row.NegativePrompt != nil {
+		s.NegativePrompt = *row.NegativePrompt
+	}
+	if row.SourceApp != nil {
+		s.SourceApp = *row.SourceApp
+	}
+	if row.ModelName != nil {
+		s.Model = *row.ModelName
+	}
+	if row.Width != nil {
+		s.Width = *row.Width
+	}
+	if row.Height != nil {
+		s.Height = *row.Height
+	}
+	if err := tx.Table("image_loras").Joins("JOIN loras ON loras.id = image_loras.lora_id").
+		Where("image_loras.image_id = ?", id).Pluck("loras.name", &s.Loras).Error; err != nil {
+		return s, err
+	}
+	if err := tx.Table("image_embeddings").Joins("JOIN embeddings ON embeddings.id = image_embeddings.embedding_id").
+		Where("image_embeddings.image_id = ?", id).Pluck("embeddings.name", &s.Embeddings).Error; err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// Match reports whether every condition of the rule holds for s.
+func (r Rule) Match(s Subject) bool {
+	c := r.Conditions
+	switch {
+	case r.prompt != nil && !r.prompt.MatchString(s.Prompt):
+		return false
+	case r.negative != nil && !r.negative.MatchString(s.NegativePrompt):
+		return false
+	case len(c.Models) > 0 && !anyFold(c.Models, s.Model):
+		return false
+	case len(c.Loras) > 0 && !anyFold(c.Loras, s.Loras...):
+		return false
+	case len(c.Embeddings) > 0 && !anyFold(c.Embeddings, s.Embeddings...):
+		return false
+	case len(c.SourceApps) > 0 && !anyFold(c.SourceApps, s.SourceApp):
+		return false
+	case c.MinWidth != nil && s.Width < *c.MinWidth,
+		c.MaxWidth != nil && s.Width > *c.MaxWidth,
+		c.MinHeight != nil && s.Height < *c.MinHeight,
+		c.MaxHeight != nil && s.Height > *c.MaxHeight:
+		return false
+	}
+	if folder := strings.Trim(c.Folder, " "); strings.Trim(folder, "/") != "" {
+		folder = path.Clean(strings.ReplaceAll(folder, `\`, "/"))
+		if !strings.HasPrefix(path.Clean(s.Path), folder+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// anyFold reports whether any of have equals one of want, ignoring case.
+func anyFold(want []string, have ...string) bool {
+	for _, h := range have {
+		if h == "" {
+			continue
+		}
+		for _, w := range want {
+			if strings.EqualFold(strings.TrimSpace(w), h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Outcome is the combined effect of the rules matching an image.
+type Outcome struct {
+	Rules    []uint   `json:"rules"`
+	AddTags  []string `json:"addTags,omitempty"`
+	NSFW     *bool    `json:"nsfw,omitempty"`
+	Rating   *int     `json:"rating,omitempty"`
+	Favorite *bool    `json:"favorite,omitempty"`
+	Hidden   *bool    `json:"hidden,omitempty"`
+}
+
+// Empty reports whether the outcome changes nothing.
+func (o Outcome) Empty() bool {
+	return len(o.AddTags) == 0 && o.NSFW == nil && o.Rating == nil && o.Favorite == nil && o.Hidden == nil
+}
+
+// Evaluate runs rules in order against s. Tags accumulate; for flags the
+// last matching rule wins.
+func Evaluate(rules []Rule, s Subject) Outcome {
+	o := Outcome{Rules: []uint{}}
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if !r.Match(s) {
+			continue
+		}
+		o.Rules = append(o.Rules, r.ID)
+		for _, t := range r.Actions.AddTags {
+			if name := db.CanonicalTagName(t); !seen[name] {
+				seen[name] = true
+				o.AddTags = append(o.AddTags, name)
+			}
+		}
+		if r.Actions.NSFW != nil {
+			o.NSFW = r.Actions.NSFW
+		}
+		if r.Actions.Rating != nil {
+			o.Rating = r.Actions.Rating
+		}
+		if r.Actions.Favorite != nil {
+			o.Favorite = r.Actions.Favorite
+		}
+		if r.Actions.Hidden != nil {
+			o.Hidden = r.Actions.Hidden
+		}
+	}
+	return o
+}
+
+// Plan evaluates rules against an image and drops the actions that would
+// leave it unchanged: tags it already carries and flags already set. An NSFW
+// flag set by hand is left alone.
+func Plan(tx *gorm.DB, rules []Rule, id uint) (Outcome, error) {
+	s, err := LoadSubject(tx, id)
+	if err != nil {
+		return Outcome{}, err
+	}
+	o := Evaluate(rules, s)
+	if o.Empty() {
+		return o, nil
+	}
+
+	var img db.Image
+	if err := tx.Select("id, rating, nsfw, nsfw_manual, favorite, hidden").First(&img, id).Error; err != nil {
+		return o, err
+	}
+	if o.NSFW != nil && (*o.NSFW == img.NSFW || img.NSFWManual) {
+		o.NSFW = nil
+	}
+	if o.Rating != nil && *o.Rating == img.Rating {
+		o.Rating = nil
+	}
+	if o.Favorite != nil && *o.Favorite == img.Favorite {
+		o.Favorite = nil
+	}
+	if o.Hidden != nil && *o.Hidden == img.Hidden {
+		o.Hidden = nil
+	}
+
+	tags := o.AddTags[:0:0]
+	for _, name := range o.AddTags {
+		t, err := db.LookupTag(tx, name)
+		if err == nil {
+			var n int64
+			if err := tx.Model(&db.ImageTag{}).Where("image_id = ? AND tag_id = ?", id, t.ID).Count(&n).Error; err != nil {
+				return o, err
+			}
+			if n > 0 {
+				continue
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return o, err
+		}
+		tags = append(tags, name)
+	}
+	o.AddTags = tags
+	return o, nil
+}
+
+// Track, when set, wraps the writes Apply makes to an image so they are
+// recorded in its history. main sets it to api.RuleChangeTracker.
+var Track func(tx *gorm.DB, id uint, write func() error) error
+
+// Apply writes a planned outcome to an image, bumping its version when
+// anything changes.
+func Apply(tx *gorm.DB, id uint, o Outcome) error {
+	if o.Empty() {
+		return nil
+	}
+	if Track != nil {
+		return Track(tx, id, func() error { return apply(tx, id, o) })
+	}
+	return apply(tx, id, o)
+}
+
+func apply(tx *gorm.DB, id uint, o Outcome) error {
+	updates := map[string]any{"version": gorm.Expr("version + 1")}
+	if o.NSFW != nil {
+		updates["nsfw"] = *o.NSFW
+	}
+	if o.Rating != nil {
+		updates["rating"] = *o.Rating
+	}
+	if o.Favorite != nil {
+		updates["favorite"] = *o.Favorite
+	}
+	if o.Hidden != nil {
+		updates["hidden"] = *o.Hidden
+	}
+	if err := tx.Model(&db.Image{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		return err
+	}
+	for _, name := range o.AddTags {
+		t, err := db.ResolveTag(tx, name)
+		if err != nil {
+			return err
+		}
+		rel := db.ImageTag{ImageID: id, TagID: t.ID}
+		if err := tx.FirstOrCreate(&rel, rel).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run applies every enabled rule to one image, returning what changed.
+func Run(tx *gorm.DB, id uint) (Outcome, error) {
+	rules, err := Load(tx)
+	if err != nil || len(rules) == 0 {
+		return Outcome{Rules: []uint{}}, err
+	}
+	o, err := Plan(tx, rules, id)
+	if err != nil {
+		return o, err
+	}
+	return o, Apply(tx, id, o)
+}
@@ -0,0 +1,273 @@
+package scan
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"gen-library/backend/classify"
+	"gen-library/backend/rules"
+)
+
+// NSFWPolicySetting is the settings key holding the NSFW policy as JSON.
+const NSFWPolicySetting = "nsfw_policy"
+
+// NSFWPolicy decides which images are flagged NSFW on import and when
+// reclassifying. Deny and Allow entries are words or phrases matched on
+// word boundaries, ignoring case; a trailing * matches any word ending, so
+// "boob*" also matches "boobs". Text matched by an allow entry is ignored
+// when looking for deny matches.
+type NSFWPolicy struct {
+	Deny       []string `json:"deny"`
+	Allow      []string `json:"allow"`
+	DenyRegex  []string `json:"denyRegex"`
+	AllowRegex []string `json:"allowRegex"`
+	// ExcludeNegativePrompt leaves the negative prompt out of matching,
+	// since it lists what the image should not contain.
+	ExcludeNegativePrompt bool `json:"excludeNegativePrompt"`
+	// Models and Loras name checkpoints and LoRAs that imply NSFW on their
+	// own. Names are compared ignoring case and may use * wildcards.
+	Models []string `json:"models"`
+	Loras  []string `json:"loras"`
+}
+
+// DefaultNSFWPolicy is used until a policy is saved.
+func DefaultNSFWPolicy() NSFWPolicy {
+	return NSFWPolicy{
+		Deny: []string{
+			"nude*", "naked", "sex", "sexy", "fuck*", "topless", "bottomless", "pubic",
+			"cum", "porn*", "erotic*", "pussy", "cock", "cocks", "penis*", "vagina*",
+			"boob*", "panties",
+		},
+		Allow:                 []string{},
+		DenyRegex:             []string{},
+		AllowRegex:            []string{},
+		ExcludeNegativePrompt: true,
+		Models:                []string{},
+		Loras:                 []string{},
+	}
+}
+
+// NSFWClassifier is a compiled NSFW policy.
+type NSFWClassifier struct {
+	deny, allow     []*regexp.Regexp
+	models, loras   []*regexp.Regexp
+	excludeNegative bool
+}
+
+// Compile validates the policy. Errors name the offending entry.
+func (p NSFWPolicy) Compile() (*NSFWClassifier, error) {
+	c := &NSFWClassifier{excludeNegative: p.ExcludeNegativePrompt}
+	var errs []error
+	words := func(terms []string) *regexp.Regexp {
+		var alts []string
+		for _, t := range terms {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			stem, wild := strings.CutSuffix(t, "*")
+			alt := regexp.QuoteMeta(stem)
+			if wild {
+				alt += `\w*`
+			}
+			alts = append(alts, alt)
+		}
+		if len(alts) == 0 {
+			return nil
+		}
+		return regexp.MustCompile(`(?i)\b(?:` + strings.Join(alts, "|") + `)\b`)
+	}
+	regexes := func(field string, patterns []string) []*regexp.Regexp {
+		var out []*regexp.Regexp
+		for i, s := range patterns {
+			re, err := regexp.Compile("(?i)" + s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: invalid regular expression", field, i))
+				continue
+			}
+			out = append(out, re)
+		}
+		return out
+	}
+	names := func(terms []string) []*regexp.Regexp {
+		var out []*regexp.Regexp
+		for _, t := range terms {
+			if t = strings.TrimSpace(t); t == "" {
+				continue
+			}
+			parts := strings.Split(t, "*")
+			for i := range parts {
+				parts[i] = regexp.QuoteMeta(parts[i])
+			}
+			out = append(out, regexp.MustCompile(`(?i)^`+strings.Join(parts, ".*")+`$`))
+		}
+		return out
+	}
+
+	if re := words(p.Deny); re != nil {
+		c.deny = append(c.deny, re)
+	}
+	c.deny = append(c.deny, regexes("denyRegex", p.DenyRegex)...)
+	if re := words(p.Allow); re != nil {
+		c.allow = append(c.allow, re)
+	}
+	c.allow = append(c.allow, regexes("allowRegex", p.AllowRegex)...)
+	c.models = names(p.Models)
+	c.loras = names(p.Loras)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// Classify reports whether an image with the given metadata is NSFW.
+func (c *NSFWClassifier) Classify(prompt, negativePrompt, model string, loras []string) bool {
+	for _, re := range c.models {
+		if model != "" && re.MatchString(model) {
+			return true
+		}
+	}
+	for _, re := range c.loras {
+		for _, l := range loras {
+			if re.MatchString(l) {
+				return true
+			}
+		}
+	}
+
+	text := prompt
+	if !c.excludeNegative && negativePrompt != "" {
+		text += "\n" + negativePrompt
+	}
+	for _, re := range c.allow {
+		text = re.ReplaceAllString(text, " ")
+	}
+	for _, re := range c.deny {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// NSFWJudge derives NSFW flags the way an import does: the saved policy,
+// then the local classifier once it has enough examples, then any enabled
+// rule that sets the flag. Imports, reclassify runs and recomputes on edit
+// all go through it so they agree. A judge is loaded once and reused, so a
+// scan compiles the policy and reads the classifier only once.
+type NSFWJudge struct {
+	policy *NSFWClassifier
+	model  *classify.Snapshot
+	rules  []rules.Rule
+}
+
+// LoadNSFWJudge compiles the saved policy, takes a snapshot of the
+// classifier and loads the enabled rules.
+func LoadNSFWJudge(gdb *gorm.DB) (*NSFWJudge, error) {
+	policy, err := LoadNSFWClassifier(gdb)
+	if err != nil {
+		return nil, err
+	}
+	model, err := classify.LoadSnapshot(gdb)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := rules.Load(gdb)
+	if err != nil {
+		return nil, err
+	}
+	return &NSFWJudge{policy: policy, model: model, rules: rs}, nil
+}
+
+// Classify applies the policy and then the classifier to metadata. Rules
+// are left out; an import runs them once the image is stored.
+func (j *NSFWJudge) Classify(tx *gorm.DB, prompt, negativePrompt, model string, loras []string) (bool, error) {
+	if j.policy.Classify(prompt, negativePrompt, model, loras) {
+		return true, nil
+	}
+	// Fall back to the model learned from hand-set flags.
+	p, ok, err := j.model.NSFWProbability(tx, classify.Features(prompt, model, loras))
+	if err != nil {
+		return false, err
+	}
+	return ok && p >= classify.NSFWThreshold, nil
+}
+
+// Judge returns the flag an image in the library should have.
+func (j *NSFWJudge) Judge(tx *gorm.DB, id uint) (bool, error) {
+	s, err := rules.LoadSubject(tx, id)
+	if err != nil {
+		return false, err
+	}
+	nsfw, err := j.Classify(tx, s.Prompt, s.NegativePrompt, s.Model, s.Loras)
+	if err != nil {
+		return false, err
+	}
+	if o := rules.Evaluate(j.rules, s); o.NSFW != nil {
+		nsfw = *o.NSFW
+	}
+	return nsfw, nil
+}
+
+// RunRules applies the judge's rules to an image, as rules.Run does with
+// freshly loaded ones.
+func (j *NSFWJudge) RunRules(tx *gorm.DB, id uint) error {
+	if len(j.rules) == 0 {
+		return nil
+	}
+	o, err := rules.Plan(tx, j.rules, id)
+	if err != nil {
+		return err
+	}
+	return rules.Apply(tx, id, o)
+}
+
+// ClassifyImage derives the flag of an image in the library with the saved
+// policy, the classifier and the rules.
+func ClassifyImage(tx *gorm.DB, id uint) (bool, error) {
+	j, err := LoadNSFWJudge(tx)
+	if err != nil {
+		return false, err
+	}
+	return j.Judge(tx, id)
+}
+
+// ParseNSFWPolicy decodes a stored policy on top of the defaults and checks
+// that it compiles.
+func ParseNSFWPolicy(raw string) (NSFWPolicy, error) {
+	p := DefaultNSFWPolicy()
+	if strings.TrimSpace(raw) == "" {
+		return p, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return p, fmt.Errorf("invalid nsfw policy: %w", err)
+	}
+	if _, err := p.Compile(); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// LoadNSFWPolicy reads the saved policy, or the default if none is saved.
+func LoadNSFWPolicy(gdb *gorm.DB) (NSFWPolicy, error) {
+	var raw string
+	if err := gdb.Table("settings").Select("value").Where("key = ?", NSFWPolicySetting).Scan(&raw).Error; err != nil {
+		return NSFWPolicy{}, err
+	}
+	return ParseNSFWPolicy(raw)
+}
+
+// LoadNSFWClassifier compiles the saved policy.
+func LoadNSFWClassifier(gdb *gorm.DB) (*NSFWClassifier, error) {
+	p, err := LoadNSFWPolicy(gdb)
+	if err != nil {
+		return nil, err
+	}
+	return p.Compile()
+}
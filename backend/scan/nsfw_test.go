@@ -0,0 +1,41 @@
+package scan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNSFWClassifier(t *testing.T) {
+	c, err := DefaultNSFWPolicy().Compile()
+	require.NoError(t, err)
+	require.False(t, c.Classify("cumulus clouds over Essex", "", "", nil))
+	require.True(t, c.Classify("a NUDE figure study", "", "", nil))
+	require.True(t, c.Classify("boobs", "", "", nil))
+	require.False(t, c.Classify("portrait", "nude, lowres", "", nil))
+
+	p := DefaultNSFWPolicy()
+	p.Allow = []string{"nude color palette"}
+	p.DenyRegex = []string{`\blingerie\b`}
+	p.ExcludeNegativePrompt = false
+	p.Models = []string{"pony*"}
+	p.Loras = []string{"spicy_v1"}
+	c, err = p.Compile()
+	require.NoError(t, err)
+	require.False(t, c.Classify("dress in a nude color palette", "", "", nil))
+	require.True(t, c.Classify("nude color palette, nude", "", "", nil))
+	require.True(t, c.Classify("red Lingerie", "", "", nil))
+	require.True(t, c.Classify("portrait", "nude, lowres", "", nil))
+	require.True(t, c.Classify("landscape", "", "PonyDiffusionV6", nil))
+	require.True(t, c.Classify("landscape", "", "", []string{"detail", "SPICY_V1"}))
+	require.False(t, c.Classify("landscape", "", "sdxl", []string{"spicy_v10"}))
+
+	_, err = ParseNSFWPolicy(`{"denyRegex":["("]}`)
+	require.ErrorContains(t, err, "denyRegex[0]")
+	_, err = ParseNSFWPolicy(`{"keywords":["x"]}`)
+	require.Error(t, err)
+	p, err = ParseNSFWPolicy(`{"loras":["a"]}`)
+	require.NoError(t, err)
+	require.Equal(t, DefaultNSFWPolicy().Deny, p.Deny)
+	require.Equal(t, []string{"a"}, p.Loras)
+}
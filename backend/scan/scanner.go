@@ -21,6 +21,7 @@ import (
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 
+	"gen-library/backend/classify"
 	"gen-library/backend/db"
 	"gen-library/backend/logger"
 	"gen-library/backend/util"
@@ -38,13 +39,28 @@ func ScanFolder(gdb *gorm.DB, root string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	skip, err := trashDirs(gdb)
+	if err != nil {
+		return 0, err
+	}
+	refreshClassifier(gdb)
+	j, err := LoadNSFWJudge(gdb)
+	if err != nil {
+		return 0, err
+	}
 
+	var trashed []string
 	err = gdb.Transaction(func(tx *gorm.DB) error {
 		walkErr := filepath.WalkDir(absRoot, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
 			if d.IsDir() {
+				// The trash may sit inside the library; its files are
+				// already known as trashed images.
+				if inDirs(path, skip) {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 
@@ -55,7 +71,7 @@ func ScanFolder(gdb *gorm.DB, root string) (int, error) {
 				return nil
 			}
 
-			added, err := processFile(tx, absRoot, path, ext)
+			added, err := processFile(tx, j, absRoot, path, ext, &trashed)
 			if err != nil {
 				// Log and continue scanning
 				log := logger.With().Str("component", "scan").Str("path", path).Str("event", "scan").Logger()
@@ -72,8 +88,11 @@ func ScanFolder(gdb *gorm.DB, root string) (int, error) {
 		}
 		return nil
 	})
-
-	return count, err
+	if err != nil {
+		return count, err
+	}
+	removeTrashed(trashed)
+	return count, nil
 }
 
 // ScanFile imports or updates a single image file without walking directories.
@@ -95,22 +114,50 @@ func ScanFile(gdb *gorm.DB, root, path string) (bool, error) {
 	default:
 		return false, nil
 	}
+	if skip, err := trashDirs(gdb); err != nil {
+		return false, err
+	} else if inDirs(absPath, skip) {
+		return false, nil
+	}
 
-	var added bool
+	// The classifier trainer catches up with the watcher's imports, so
+	// unlike a folder scan a single file does not refresh it.
+	j, err := LoadNSFWJudge(gdb)
+	if err != nil {
+		return false, err
+	}
+	var (
+		added   bool
+		trashed []string
+	)
 	err = gdb.Transaction(func(tx *gorm.DB) error {
 		var err error
-		added, err = processFile(tx, absRoot, absPath, ext)
+		added, err = processFile(tx, j, absRoot, absPath, ext, &trashed)
 		return err
 	})
 	if err != nil {
 		return false, err
 	}
+	removeTrashed(trashed)
 	return added, nil
 }
 
-// processFile handles a single image file. It returns true if a DB row was
-// inserted or updated.
-func processFile(tx *gorm.DB, root, path, ext string) (bool, error) {
+// removeTrashed deletes trash copies of restored images after the scan has
+// committed. Failures are logged; the rows no longer point at the copies.
+func removeTrashed(paths []string) {
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log := logger.With().Str("component", "scan").Str("path", p).Str("event", "remove").Logger()
+			log.Warn().Err(err).Msg("")
+		}
+	}
+}
+
+// processFile handles a single image file, flagging and tagging it with the
+// scan's judge. It returns true if a DB row was inserted or updated. Trash
+// copies made redundant by a restore are added to trashed, for the caller to
+// remove once the transaction commits.
+func processFile(tx *gorm.DB, j *NSFWJudge, root, path, ext string, trashed *[]string) (bool, error) {
 	// Compute hash first to detect existing files regardless of path
 	sha, err := util.HashFileSHA256(path)
 	if err != nil {
@@ -356,13 +403,22 @@ func processFile(tx *gorm.DB, root, path, ext string) (bool, error) {
 	}
 	rel = filepath.ToSlash(rel)
 
+	loraNames := make([]string, 0, len(loraAssocs))
+	for _, la := range loraAssocs {
+		loraNames = append(loraNames, la.l.Name)
+	}
+	nsfw, err := checkNSFW(tx, j, metaMap, model, loraNames)
+	if err != nil {
+		return false, err
+	}
+
 	img := db.Image{
 		Path:      rel,
 		FileName:  dName(path),
 		Ext:       strings.TrimPrefix(ext, "."),
 		SizeBytes: size,
 		SHA256:    sha,
-		NSFW:      checkNSFW(metaMap),
+		NSFW:      nsfw,
 	}
 	if width > 0 {
 		img.Width = &width
@@ -453,9 +509,23 @@ func processFile(tx *gorm.DB, root, path, ext string) (bool, error) {
 		return false, res.Error
 	}
 	if res.RowsAffected > 0 {
+		// The same file coming back restores a trashed image; the copy
+		// in the trash is no longer needed.
+		if existing.DeletedAt != nil {
+			// Never restore an image onto its own trash copy.
+			if resolve(existing.Path) == resolve(path) {
+				return false, nil
+			}
+			upd := map[string]any{"path": rel, "file_name": dName(path), "deleted_at": nil, "original_path": nil, "trash_dir": nil, "version": gorm.Expr("version + 1")}
+			if err := tx.Model(&db.Image{}).Where("id = ?", existing.ID).Updates(upd).Error; err != nil {
+				return false, err
+			}
+			*trashed = append(*trashed, existing.Path)
+			return true, nil
+		}
 		// Already exists - maybe moved
 		if existing.Path != rel {
-			upd := map[string]any{"path": rel, "file_name": dName(path)}
+			upd := map[string]any{"path": rel, "file_name": dName(path), "version": gorm.Expr("version + 1")}
 			if err := tx.Model(&db.Image{}).Where("id = ?", existing.ID).Updates(upd).Error; err != nil {
 				return false, err
 			}
@@ -464,7 +534,43 @@ func processFile(tx *gorm.DB, root, path, ext string) (bool, error) {
 		return false, nil
 	}
 
-	if err := tx.Create(&img).Error; err != nil {
+	// Same path but new content: refresh the file derived fields in place so
+	// user edits such as rating and tags survive, and drop the stale
+	// thumbnails and placeholder so they are rebuilt from the new pixels.
+	var prev db.Image
+	res = tx.Where("path = ?", rel).Limit(1).Find(&prev)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		img.ID = prev.ID
+		if err := tx.Model(&img).Select(fileColumns).Updates(&img).Error; err != nil {
+			return false, err
+		}
+		// A new version tells clients holding the old one, and the
+		// classifier, that the image changed.
+		if err := tx.Model(&db.Image{}).Where("id = ?", img.ID).UpdateColumn("version", gorm.Expr("version + 1")).Error; err != nil {
+			return false, err
+		}
+		if err := tx.Where("image_id = ?", img.ID).Delete(&db.ImageLora{}).Error; err != nil {
+			return false, err
+		}
+		if err := tx.Where("image_id = ?", img.ID).Delete(&db.ImageEmbedding{}).Error; err != nil {
+			return false, err
+		}
+		if err := util.DeleteThumbs(prev.SHA256); err != nil {
+			return false, err
+		}
+		if prev.BlurID != nil {
+			if err := util.DeleteThumbs(*prev.BlurID); err != nil {
+				return false, err
+			}
+		}
+		img.BlurID = prev.BlurID
+	} else if err := tx.Create(&img).Error; err != nil {
+		return false, err
+	} else if err := tx.Model(&db.Image{}).Select("blur_id").Where("id = ?", img.ID).Row().Scan(&img.BlurID); err != nil {
+		// The blur id is assigned by an insert trigger
 		return false, err
 	}
 	if len(loraAssocs) > 0 {
@@ -480,9 +586,29 @@ func processFile(tx *gorm.DB, root, path, ext string) (bool, error) {
 			return false, err
 		}
 	}
+	// Apply the user's tagging rules to the new or refreshed image
+	if err := j.RunRules(tx, img.ID); err != nil {
+		return false, err
+	}
+	// Pre-generate the grid thumbnail in the background, and the blurred
+	// variant for NSFW images
+	util.EnqueueThumb(sha, path)
+	if img.NSFW && img.BlurID != nil {
+		util.EnqueueBlurThumb(*img.BlurID, sha, path)
+	}
 	return true, nil
 }
 
+// fileColumns are the image columns derived from the file itself, refreshed
+// when a file's content changes.
+var fileColumns = []string{
+	"file_name", "ext", "size_bytes", "sha256", "width", "height", "created_time",
+	"source_app", "model_id", "prompt", "negative_prompt", "sampler", "steps",
+	"cfg_scale", "seed", "scheduler", "clip_skip", "variation_seed",
+	"variation_seed_strength", "aspect_ratio", "refiner_control_percentage",
+	"refiner_upscale", "refiner_upscale_method", "raw_metadata", "blur_hash",
+}
+
 // getImageDimensions returns width and height for supported formats.
 func getImageDimensions(path, ext string) (int, int) {
 	f, err := os.Open(path)
@@ -914,18 +1040,23 @@ func extractModels(meta map[string]string) (string, []db.Lora, []db.Embedding) {
 	return modelHash, loras, embeds
 }
 
-// checkNSFW applies a simple keyword heuristic on prompts.
-func checkNSFW(meta map[string]string) bool {
-	keywords := []string{"nude", "naked", "sex", "fuck", "topless", "bottomless", "pubic", "cum", "porn", "erotic", "pussy", "cock", "penis", "vagina", "boob", "panties"}
-	if p, ok := meta["prompt"]; ok {
-		text := strings.ToLower(p)
-		for _, k := range keywords {
-			if strings.Contains(text, k) {
-				return true
-			}
-		}
+// checkNSFW classifies an image being imported with the saved NSFW policy,
+// then with the local classifier. Rules run once the image is stored.
+func checkNSFW(tx *gorm.DB, j *NSFWJudge, meta map[string]string, model *db.Model, loras []string) (bool, error) {
+	name := meta["model"]
+	if model != nil {
+		name = model.Name
+	}
+	return j.Classify(tx, meta["prompt"], meta["negative prompt"], name, loras)
+}
+
+// refreshClassifier trains the classifier on changes since the last import
+// so new hand-set flags count. Failures only cost accuracy.
+func refreshClassifier(gdb *gorm.DB) {
+	if err := classify.Refresh(gdb); err != nil {
+		log := logger.With().Str("component", "scan").Str("event", "classify").Logger()
+		log.Warn().Err(err).Msg("")
 	}
-	return false
 }
 
 // dName returns base name of path
@@ -1,6 +1,18 @@
 package scan
 
-import "testing"
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gen-library/backend/db"
+	"gen-library/backend/util"
+)
 
 func TestParseLoraWeights(t *testing.T) {
 	w := parseLoraWeights("[\"0.8\",\"0.7\"]")
@@ -28,3 +40,127 @@ func TestExtractPromptLoras(t *testing.T) {
                 t.Fatalf("unexpected second lora %+v", res[1])
         }
 }
+
+func TestScanFileContentChange(t *testing.T) {
+	gdb := newTestDB(t)
+	root := t.TempDir()
+	path := filepath.Join(root, "changed.png")
+	createPNG(t, path)
+
+	added, err := ScanFile(gdb, root, path)
+	require.NoError(t, err)
+	require.True(t, added)
+
+	var before db.Image
+	require.NoError(t, gdb.First(&before, "path = ?", "changed.png").Error)
+	require.NoError(t, gdb.Model(&before).Updates(map[string]any{"rating": 4, "blur_hash": "stale"}).Error)
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, 3, 2))))
+	require.NoError(t, f.Close())
+
+	added, err = ScanFile(gdb, root, path)
+	require.NoError(t, err)
+	require.True(t, added)
+
+	var after db.Image
+	require.NoError(t, gdb.First(&after, before.ID).Error)
+	require.NotEqual(t, before.SHA256, after.SHA256)
+	require.Equal(t, 3, *after.Width)
+	require.Equal(t, 4, after.Rating)
+	require.Nil(t, after.BlurHash)
+	require.Equal(t, before.Version+1, after.Version)
+}
+
+func TestScanFileAppliesRules(t *testing.T) {
+	gdb := newTestDB(t)
+	root := t.TempDir()
+	require.NoError(t, gdb.Create(&db.Rule{
+		Name: "portraits", Enabled: true,
+		Conditions: []byte(`{"folder":"portraits","maxWidth":10}`),
+		Actions:    []byte(`{"addTags":["project:book-cover/chapter-3"],"favorite":true}`),
+	}).Error)
+
+	require.NoError(t, os.Mkdir(filepath.Join(root, "portraits"), 0o755))
+	createPNG(t, filepath.Join(root, "portraits", "a.png"))
+	// A second, larger file so the two hashes differ.
+	f, err := os.Create(filepath.Join(root, "b.png"))
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, 20, 20))))
+	require.NoError(t, f.Close())
+	for _, p := range []string{"portraits/a.png", "b.png"} {
+		_, err := ScanFile(gdb, root, filepath.Join(root, p))
+		require.NoError(t, err)
+	}
+
+	var a, b db.Image
+	require.NoError(t, gdb.Preload("Tags").First(&a, "path = ?", "portraits/a.png").Error)
+	require.NoError(t, gdb.Preload("Tags").First(&b, "path = ?", "b.png").Error)
+	require.True(t, a.Favorite)
+	require.Len(t, a.Tags, 1)
+	require.Equal(t, "project:book-cover/chapter-3", a.Tags[0].Name)
+	require.False(t, b.Favorite)
+	require.Empty(t, b.Tags)
+}
+
+func TestScanFileRestoresTrashed(t *testing.T) {
+	gdb := newTestDB(t)
+	root := t.TempDir()
+	path := filepath.Join(root, "back.png")
+	createPNG(t, path)
+	_, err := ScanFile(gdb, root, path)
+	require.NoError(t, err)
+
+	// Trash the image by hand, then bring the same file back.
+	trashed := filepath.Join(t.TempDir(), "1_back.png")
+	require.NoError(t, os.Rename(path, trashed))
+	require.NoError(t, gdb.Model(&db.Image{}).Where("path = ?", "back.png").
+		Updates(map[string]any{"path": trashed, "original_path": "back.png", "deleted_at": time.Now()}).Error)
+	createPNG(t, path)
+
+	added, err := ScanFile(gdb, root, path)
+	require.NoError(t, err)
+	require.True(t, added)
+	var img db.Image
+	require.NoError(t, gdb.First(&img).Error)
+	require.Equal(t, "back.png", img.Path)
+	require.Nil(t, img.DeletedAt)
+	require.NoFileExists(t, trashed)
+}
+
+func TestScanSkipsTrash(t *testing.T) {
+	gdb := newTestDB(t)
+	root := t.TempDir()
+	trash := filepath.Join(root, "trash")
+	require.NoError(t, os.Mkdir(trash, 0o755))
+	inTrash := filepath.Join(trash, "1_a.png")
+	createPNG(t, inTrash)
+	sha, err := util.HashFileSHA256(inTrash)
+	require.NoError(t, err)
+	orig, now := "a.png", time.Now()
+	require.NoError(t, gdb.Create(&db.Image{Path: inTrash, FileName: "a.png", Ext: "png", SizeBytes: 1, SHA256: sha,
+		OriginalPath: &orig, DeletedAt: &now}).Error)
+
+	// Even without a known trash folder, the copy never restores onto itself.
+	added, err := ScanFile(gdb, root, inTrash)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	// Nor is anything else in the trash folder imported.
+	f, err := os.Create(filepath.Join(trash, "2_b.png"))
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, 5, 5))))
+	require.NoError(t, f.Close())
+	TrashDir = func() (string, error) { return trash, nil }
+	t.Cleanup(func() { TrashDir = nil })
+	n, err := ScanFolder(gdb, root)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	var img db.Image
+	require.NoError(t, gdb.First(&img).Error)
+	require.NotNil(t, img.DeletedAt)
+	require.Equal(t, inTrash, img.Path)
+	require.FileExists(t, inTrash)
+}
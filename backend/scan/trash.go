@@ -0,0 +1,58 @@
+package scan
+
+import (
+	"path/filepath"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// TrashDir returns the folder trashed files are moved to. It is set at
+// startup so scans and the watcher leave the trash alone; nil means no
+// trash folder is configured.
+var TrashDir func() (string, error)
+
+// trashDirs returns the folders trashed files live in: the configured trash
+// folder and any folder images were trashed into before it changed.
+func trashDirs(gdb *gorm.DB) ([]string, error) {
+	var dirs []string
+	if err := gdb.Table("images").Distinct("trash_dir").Where("trash_dir IS NOT NULL").Pluck("trash_dir", &dirs).Error; err != nil {
+		return nil, err
+	}
+	if TrashDir != nil {
+		dir, err := TrashDir()
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	for i, d := range dirs {
+		dirs[i] = resolve(d)
+	}
+	return dirs, nil
+}
+
+// inDirs reports whether p is one of dirs or lies below one.
+func inDirs(p string, dirs []string) bool {
+	p = resolve(p)
+	for _, d := range dirs {
+		rel, err := filepath.Rel(d, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the absolute form of p with symlinks followed where it
+// exists.
+func resolve(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+	if r, err := filepath.EvalSymlinks(abs); err == nil {
+		return r
+	}
+	return abs
+}
@@ -63,12 +63,21 @@ func runWatcher(ctx context.Context, root string, gdb *gorm.DB) {
 	}
 	defer watcher.Close()
 
-	// Recursively register existing directories
+	// Recursively register existing directories, leaving out the trash.
+	skip, err := trashDirs(gdb)
+	if err != nil {
+		log := logger.With().Str("component", "scan").Str("event", "watcher").Logger()
+		log.Error().Err(err).Msg("")
+		return
+	}
 	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
 		if d.IsDir() {
+			if inDirs(path, skip) {
+				return filepath.SkipDir
+			}
 			if werr := watcher.Add(path); werr != nil {
 				log := logger.With().Str("component", "scan").Str("event", "watcher_add").Str("path", path).Logger()
 				log.Warn().Err(werr).Msg("")
@@ -88,6 +97,9 @@ func runWatcher(ctx context.Context, root string, gdb *gorm.DB) {
 			if event.Op&(fsnotify.Create|fsnotify.Write) != 0 {
 				fi, err := os.Stat(event.Name)
 				if err == nil && fi.IsDir() {
+					if skip, err := trashDirs(gdb); err != nil || inDirs(event.Name, skip) {
+						continue
+					}
 					if werr := watcher.Add(event.Name); werr != nil {
 						log := logger.With().Str("component", "scan").Str("event", "watcher_add").Str("path", event.Name).Logger()
 						log.Warn().Err(werr).Msg("")
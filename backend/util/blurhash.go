@@ -0,0 +1,124 @@
+package util
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// BlurHash component counts; 4x3 suits the mostly portrait and landscape
+// generations in a library while keeping hashes around 28 characters.
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// blurHashSample is the width images are reduced to before hashing. BlurHash
+// only keeps a few low frequency components, so more pixels add nothing.
+const blurHashSample = 32
+
+// OnBlurHash, when set, receives the BlurHash computed for an image whenever
+// its default thumbnail is generated.
+var OnBlurHash func(sha, hash string)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash encodes img as a BlurHash string (https://blurha.sh).
+func BlurHash(img image.Image) string {
+	small := imaging.Resize(img, blurHashSample, 0, imaging.Box)
+	b := small.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+
+	var factors [blurHashX * blurHashY][3]float64
+	for j := 0; j < blurHashY; j++ {
+		for i := 0; i < blurHashX; i++ {
+			var r, g, bl float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					o := small.PixOffset(x, y)
+					r += basis * srgbToLinear(small.Pix[o])
+					g += basis * srgbToLinear(small.Pix[o+1])
+					bl += basis * srgbToLinear(small.Pix[o+2])
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors[j*blurHashX+i] = [3]float64{r * scale, g * scale, bl * scale}
+		}
+	}
+
+	var sb strings.Builder
+	writeBase83(&sb, (blurHashX-1)+(blurHashY-1)*9, 1)
+
+	ac := factors[1:]
+	maxValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		writeBase83(&sb, quantisedMax, 1)
+	} else {
+		writeBase83(&sb, 0, 1)
+	}
+
+	dc := factors[0]
+	writeBase83(&sb, linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		writeBase83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String()
+}
+
+// BlurHashFile computes the BlurHash of the image stored at path.
+func BlurHashFile(path string) (string, error) {
+	img, err := imaging.Open(path, imaging.AutoOrientation(true))
+	if err != nil {
+		return "", err
+	}
+	return BlurHash(img), nil
+}
+
+func writeBase83(sb *strings.Builder, v, length int) {
+	for i := 1; i <= length; i++ {
+		digit := (v / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlurHashSolidColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{R: 255, A: 255}}, image.Point{}, draw.Src)
+
+	h := BlurHash(img)
+	// Size flag, max AC, 4 char DC and 11 two char AC components.
+	require.Len(t, h, 1+1+4+11*2)
+	require.Equal(t, "L", h[:1])
+	// The DC component carries the average colour, 0xFF0000 for pure red.
+	require.Equal(t, "TI:j", h[2:6])
+}
+
+func TestBlurHashDiffersWithContent(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	b := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 32; y++ {
+			b.Set(x, y, color.White)
+		}
+	}
+	require.NotEqual(t, BlurHash(a), BlurHash(b))
+}
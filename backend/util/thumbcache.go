@@ -0,0 +1,191 @@
+package util
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	thumbHits   atomic.Int64
+	thumbMisses atomic.Int64
+)
+
+// touchInterval limits how often a cache hit refreshes a file's mtime, which
+// the size cap uses as its least-recently-used clock.
+const touchInterval = time.Hour
+
+// ThumbCacheStats summarizes the thumbnail cache.
+type ThumbCacheStats struct {
+	Files  int   `json:"files"`
+	Bytes  int64 `json:"bytes"`
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// ThumbCached reports whether the thumbnail exists, marking it as recently
+// used if so.
+func ThumbCached(sha string, width int, format string) bool {
+	return cached(ThumbPathFormat(sha, width, format))
+}
+
+// BlurThumbCached is like ThumbCached for the blurred variant.
+func BlurThumbCached(blurID string, width int, format string) bool {
+	return cached(BlurThumbPathFormat(blurID, width, format))
+}
+
+// ThumbFileCached is like ThumbCached for a file name below ThumbDir.
+func ThumbFileCached(name string) bool {
+	return cached(filepath.Join(ThumbDir, name))
+}
+
+func cached(p string) bool {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	if now := time.Now(); now.Sub(fi.ModTime()) > touchInterval {
+		_ = os.Chtimes(p, now, now)
+	}
+	return true
+}
+
+// CountThumbLookup records a served thumbnail request as a cache hit or
+// miss. Only the handlers that serve thumbnails call it, so listing links
+// and background generation do not skew the counters.
+func CountThumbLookup(hit bool) {
+	if hit {
+		thumbHits.Add(1)
+	} else {
+		thumbMisses.Add(1)
+	}
+}
+
+// ThumbStats walks the cache directory and returns its size together with
+// the hit and miss counters since startup.
+func ThumbStats() (ThumbCacheStats, error) {
+	st := ThumbCacheStats{Hits: thumbHits.Load(), Misses: thumbMisses.Load()}
+	files, err := cacheFiles()
+	for _, f := range files {
+		st.Files++
+		st.Bytes += f.size
+	}
+	return st, err
+}
+
+// cacheFile is a file in the thumbnail cache.
+type cacheFile struct {
+	path  string
+	sha   string
+	size  int64
+	mtime time.Time
+}
+
+// cacheFiles lists every file below ThumbDir. The owning image's sha is the
+// file name prefix before the first underscore, or the first directory below
+// ThumbDir for nested caches.
+func cacheFiles() ([]cacheFile, error) {
+	var files []cacheFile
+	err := filepath.WalkDir(ThumbDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(ThumbDir, path)
+		if err != nil {
+			return nil
+		}
+		first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+		sha, _, _ := strings.Cut(first, "_")
+		files = append(files, cacheFile{path: path, sha: sha, size: fi.Size(), mtime: fi.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// GCThumbs deletes cached files whose image sha is not kept. It returns the
+// number of files removed and the bytes freed.
+func GCThumbs(keep func(sha string) bool) (int, int64, error) {
+	files, err := cacheFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		removed int
+		freed   int64
+	)
+	for _, f := range files {
+		if keep(f.sha) {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		removed++
+		freed += f.size
+	}
+	removeEmptyDirs(ThumbDir)
+	return removed, freed, nil
+}
+
+// EnforceThumbCacheLimit deletes the least recently used cached files until
+// the cache is no larger than maxBytes. A non-positive limit disables the cap.
+func EnforceThumbCacheLimit(maxBytes int64) (int, int64, error) {
+	if maxBytes <= 0 {
+		return 0, 0, nil
+	}
+	files, err := cacheFiles()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].mtime.Before(files[b].mtime) })
+	var (
+		removed int
+		freed   int64
+	)
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		total -= f.size
+		removed++
+		freed += f.size
+	}
+	removeEmptyDirs(ThumbDir)
+	return removed, freed, nil
+}
+
+// removeEmptyDirs deletes empty directories below root, keeping root itself.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Deepest first so parents empty out after their children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
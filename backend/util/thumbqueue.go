@@ -0,0 +1,145 @@
+package util
+
+import (
+	"sync"
+
+	"gen-library/backend/logger"
+)
+
+// thumbJob asks for the default thumbnail of an image, or its blurred
+// variant, to be generated.
+type thumbJob struct {
+	sha    string
+	src    string
+	blurID string // set for the blurred variant
+}
+
+var (
+	thumbMu      sync.Mutex
+	thumbJobs    chan thumbJob
+	thumbSem     chan struct{}
+	thumbFlights = map[string]*thumbFlight{}
+)
+
+// thumbFlight tracks a thumbnail being generated so concurrent requests for
+// the same file wait for a single encode.
+type thumbFlight struct {
+	done chan struct{}
+	path string
+	err  error
+}
+
+// thumbQueueSize bounds how many pending jobs the scanner can queue before
+// further requests are dropped and left to on-demand generation.
+const thumbQueueSize = 4096
+
+// StartThumbWorkers starts n background workers that generate default
+// thumbnails queued by EnqueueThumb. It is a no-op if already started.
+func StartThumbWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	thumbMu.Lock()
+	defer thumbMu.Unlock()
+	if thumbJobs != nil {
+		return
+	}
+	thumbJobs = make(chan thumbJob, thumbQueueSize)
+	thumbSem = make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		go func(jobs <-chan thumbJob) {
+			for j := range jobs {
+				var err error
+				if j.blurID != "" {
+					_, err = GenerateBlurThumb(j.blurID, j.sha, j.src, DefaultThumbWidth, FormatJPEG)
+				} else {
+					_, err = GenerateThumb(j.sha, j.src, DefaultThumbWidth, FormatJPEG)
+				}
+				if err != nil {
+					log := logger.With().Str("component", "thumbs").Str("event", "generate").Str("path", j.src).Logger()
+					log.Warn().Err(err).Msg("")
+				}
+			}
+		}(thumbJobs)
+	}
+}
+
+// EnqueueThumb queues background generation of the default thumbnail. It
+// never blocks and returns false if the workers are not running or the queue
+// is full.
+func EnqueueThumb(sha, src string) bool {
+	return enqueue(thumbJob{sha: sha, src: src})
+}
+
+// EnqueueBlurThumb is like EnqueueThumb for the blurred variant, cached under
+// the image's blur id.
+func EnqueueBlurThumb(blurID, sha, src string) bool {
+	return enqueue(thumbJob{sha: sha, src: src, blurID: blurID})
+}
+
+func enqueue(j thumbJob) bool {
+	thumbMu.Lock()
+	jobs := thumbJobs
+	thumbMu.Unlock()
+	if jobs == nil {
+		return false
+	}
+	select {
+	case jobs <- j:
+		return true
+	default:
+		return false
+	}
+}
+
+// GenerateThumb returns the path of a thumbnail, generating it if needed.
+// Concurrent calls for the same thumbnail share one encode, and the number of
+// simultaneous encodes is bounded by the worker count.
+func GenerateThumb(sha, src string, width int, format string) (string, error) {
+	if format == FormatWebP && !WebPSupported() {
+		format = FormatJPEG
+	}
+	return generateOnce(ThumbPathFormat(sha, width, format), func() (string, error) {
+		return EnsureThumbFormat(sha, src, width, format)
+	})
+}
+
+// GenerateBlurThumb is like GenerateThumb for the blurred variant, cached
+// under the image's blur id.
+func GenerateBlurThumb(blurID, sha, src string, width int, format string) (string, error) {
+	if format == FormatWebP && !WebPSupported() {
+		format = FormatJPEG
+	}
+	return generateOnce(BlurThumbPathFormat(blurID, width, format), func() (string, error) {
+		return EnsureBlurThumbFormat(blurID, sha, src, width, format)
+	})
+}
+
+// generateOnce runs encode for the thumbnail at key, sharing the result with
+// concurrent calls for the same key.
+func generateOnce(key string, encode func() (string, error)) (string, error) {
+	thumbMu.Lock()
+	if f, ok := thumbFlights[key]; ok {
+		thumbMu.Unlock()
+		<-f.done
+		return f.path, f.err
+	}
+	f := &thumbFlight{done: make(chan struct{})}
+	thumbFlights[key] = f
+	sem := thumbSem
+	thumbMu.Unlock()
+
+	if sem != nil {
+		sem <- struct{}{}
+	}
+	f.path, f.err = encode()
+	if sem != nil {
+		<-sem
+	}
+
+	thumbMu.Lock()
+	delete(thumbFlights, key)
+	thumbMu.Unlock()
+	close(f.done)
+	return f.path, f.err
+}
@@ -2,6 +2,8 @@ package util
 
 import (
 	"fmt"
+	"image"
+	"io"
 	"os"
 	"path/filepath"
 
@@ -9,41 +11,165 @@ import (
 	_ "golang.org/x/image/webp" // register webp decoder
 )
 
+// ThumbDir is where generated thumbnails are cached.
+const ThumbDir = ".cache/thumbs"
+
+// DefaultThumbWidth is the width used by the gallery grid.
+const DefaultThumbWidth = 400
+
+// blurBlocks is how many blocks across a blurred thumbnail is pixelated to
+// before it is smoothed.
+const blurBlocks = 12
+
+// ThumbSizes are the widths thumbnails are generated at, including 2x
+// variants for HiDPI screens. Other widths are rounded up to the next size so
+// the cache stays bounded.
+var ThumbSizes = []int{200, 400, 800, 1600}
+
+// Thumbnail output formats.
+const (
+	FormatJPEG = "jpg"
+	FormatWebP = "webp"
+)
+
+// WebPEncoder encodes thumbnails as WebP when set. The standard library and
+// x/image only ship a WebP decoder, so the encoder is set by cgo builds (see
+// webp_cgo.go); builds without cgo fall back to JPEG thumbnails.
+var WebPEncoder func(w io.Writer, img image.Image) error
+
+// WebPSupported reports whether WebP thumbnails can be generated.
+func WebPSupported() bool { return WebPEncoder != nil }
+
+// ThumbWidth snaps a requested width to one of ThumbSizes.
+func ThumbWidth(w int) int {
+	if w <= 0 {
+		return DefaultThumbWidth
+	}
+	for _, s := range ThumbSizes {
+		if w <= s {
+			return s
+		}
+	}
+	return ThumbSizes[len(ThumbSizes)-1]
+}
+
 func ThumbPath(sha string, width int) string {
-	return filepath.ToSlash(fmt.Sprintf(".cache/thumbs/%s_%d.jpg", sha, width))
+	return ThumbPathFormat(sha, width, FormatJPEG)
+}
+
+// ThumbPathFormat returns the cache path of a thumbnail in the given format.
+func ThumbPathFormat(sha string, width int, format string) string {
+	return filepath.ToSlash(fmt.Sprintf("%s/%s_%d.%s", ThumbDir, sha, width, format))
+}
+
+// BlurThumbPathFormat returns the cache path of the blurred variant of a
+// thumbnail. It is named by the image's blur id rather than its sha so the
+// name does not lead to the plain thumbnail.
+func BlurThumbPathFormat(blurID string, width int, format string) string {
+	return filepath.ToSlash(fmt.Sprintf("%s/%s_%db.%s", ThumbDir, blurID, width, format))
 }
 
 // EnsureThumb ensures a resized thumbnail exists for the given image.
 // It lazily generates the thumbnail if missing and returns the path.
 func EnsureThumb(sha string, srcPath string, width int) (string, error) {
-	p := ThumbPath(sha, width)
-	if _, err := os.Stat(p); err == nil {
+	return EnsureThumbFormat(sha, srcPath, width, FormatJPEG)
+}
+
+// EnsureThumbFormat is like EnsureThumb but encodes the thumbnail in the given
+// format. The source is rotated according to its EXIF orientation and is
+// never upscaled.
+func EnsureThumbFormat(sha string, srcPath string, width int, format string) (string, error) {
+	if format == FormatWebP && !WebPSupported() {
+		format = FormatJPEG
+	}
+	p := ThumbPathFormat(sha, width, format)
+	if ThumbCached(sha, width, format) {
 		return p, nil
 	}
 	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
 		return "", err
 	}
-	img, err := imaging.Open(srcPath)
+	img, err := imaging.Open(srcPath, imaging.AutoOrientation(true))
+	if err != nil {
+		return "", err
+	}
+	thumb := img
+	if img.Bounds().Dx() > width {
+		thumb = imaging.Resize(img, width, 0, imaging.Lanczos)
+	}
+	if err := writeThumb(p, thumb, format); err != nil {
+		return "", err
+	}
+	if OnBlurHash != nil {
+		OnBlurHash(sha, BlurHash(thumb))
+	}
+	return p, nil
+}
+
+// EnsureBlurThumbFormat ensures the blurred variant of a thumbnail exists and
+// returns its path. It is made from the regular thumbnail, pixelated and
+// then smoothed so no detail of the original survives.
+func EnsureBlurThumbFormat(blurID, sha string, srcPath string, width int, format string) (string, error) {
+	if format == FormatWebP && !WebPSupported() {
+		format = FormatJPEG
+	}
+	p := BlurThumbPathFormat(blurID, width, format)
+	if BlurThumbCached(blurID, width, format) {
+		return p, nil
+	}
+	plain, err := EnsureThumbFormat(sha, srcPath, width, format)
 	if err != nil {
 		return "", err
 	}
-	thumb := imaging.Resize(img, width, 0, imaging.Lanczos)
-	if err := imaging.Save(thumb, p); err != nil {
+	img, err := imaging.Open(plain)
+	if err != nil {
+		return "", err
+	}
+	b := img.Bounds()
+	blocks := imaging.Resize(img, min(blurBlocks, b.Dx()), 0, imaging.Box)
+	out := imaging.Resize(blocks, b.Dx(), b.Dy(), imaging.NearestNeighbor)
+	out = imaging.Blur(out, float64(b.Dx())/blurBlocks/4)
+	if err := writeThumb(p, out, format); err != nil {
 		return "", err
 	}
 	return p, nil
 }
 
-// DeleteThumbs removes any cached thumbnails associated with the given sha.
+// writeThumb encodes img to p. It writes to a temporary file first so
+// concurrent readers never see a partially written thumbnail.
+func writeThumb(p string, img image.Image, format string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	switch format {
+	case FormatWebP:
+		err = WebPEncoder(tmp, img)
+	default:
+		err = imaging.Encode(tmp, img, imaging.JPEG)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// DeleteThumbs removes any cached thumbnails associated with the given sha,
+// or with a blur id for the blurred variants.
 // It silently ignores missing files.
 func DeleteThumbs(sha string) error {
-	pattern := filepath.ToSlash(fmt.Sprintf(".cache/thumbs/%s_*.jpg", sha))
+	pattern := filepath.ToSlash(fmt.Sprintf("%s/%s_*", ThumbDir, sha))
 	matches, err := filepath.Glob(pattern)
 	if err != nil {
 		return err
 	}
 	for _, m := range matches {
-		if err := os.Remove(m); err != nil && !os.IsNotExist(err) {
+		// RemoveAll also covers the deep zoom tile directory.
+		if err := os.RemoveAll(m); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,209 @@
+package util
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Deep zoom tiling parameters, following the DZI conventions used by viewers
+// such as OpenSeadragon.
+const (
+	TileSize    = 256
+	TileOverlap = 1
+	TileFormat  = FormatJPEG
+)
+
+// maxTileBuilds bounds how many pyramids are generated at once; each build
+// holds a fully decoded source image in memory.
+const maxTileBuilds = 2
+
+var (
+	tileMu     sync.Mutex
+	tileSem    = make(chan struct{}, maxTileBuilds)
+	tileBuilds = map[string]*tileBuild{}
+)
+
+// tileBuild tracks a pyramid being generated. ready is closed once levels
+// is known, levels[i] once the tiles of level i are on disk, and done when the
+// build ends; err may only be read after done.
+type tileBuild struct {
+	ready  chan struct{}
+	levels []chan struct{}
+	done   chan struct{}
+	err    error
+}
+
+// TileDir returns the cache directory holding an image's tile pyramid.
+func TileDir(sha string) string {
+	return filepath.ToSlash(fmt.Sprintf("%s/%s_tiles", ThumbDir, sha))
+}
+
+// TilePath returns the cache path of a single tile.
+func TilePath(sha string, level, col, row int) string {
+	return filepath.ToSlash(fmt.Sprintf("%s/%d/%d_%d.%s", TileDir(sha), level, col, row, TileFormat))
+}
+
+// MaxTileLevel returns the highest pyramid level for an image; level 0 is
+// 1x1 and each level doubles until the full resolution is reached.
+func MaxTileLevel(width, height int) int {
+	m := max(width, height)
+	if m <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(float64(m))))
+}
+
+// TileLevelSize returns the dimensions of the image at a pyramid level.
+func TileLevelSize(width, height, level int) (int, int) {
+	scale := math.Pow(2, float64(MaxTileLevel(width, height)-level))
+	return max(1, int(math.Ceil(float64(width)/scale))), max(1, int(math.Ceil(float64(height)/scale)))
+}
+
+// OrientedSize returns the display dimensions of an image after applying its
+// EXIF orientation, given the stored pixel dimensions.
+func OrientedSize(path string, width, height int) (int, int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return width, height
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return width, height
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return width, height
+	}
+	if o, err := tag.Int(0); err == nil && o >= 5 && o <= 8 {
+		return height, width
+	}
+	return width, height
+}
+
+// EnsureTile returns the path of a tile, generating the image's pyramid in
+// the background if needed and waiting only until the requested level is
+// ready. Low levels are produced first so a viewer can start immediately.
+func EnsureTile(sha, src string, level, col, row int) (string, error) {
+	p := TilePath(sha, level, col, row)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+
+	tileMu.Lock()
+	b, ok := tileBuilds[sha]
+	if !ok {
+		b = &tileBuild{ready: make(chan struct{}), done: make(chan struct{})}
+		tileBuilds[sha] = b
+		go b.run(sha, src)
+	}
+	tileMu.Unlock()
+
+	<-b.ready
+	if level < 0 || level >= len(b.levels) {
+		if b.levels == nil {
+			<-b.done
+			return "", b.err
+		}
+		return "", os.ErrNotExist
+	}
+	select {
+	case <-b.levels[level]:
+	case <-b.done:
+	}
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	<-b.done
+	if b.err != nil {
+		return "", b.err
+	}
+	return "", os.ErrNotExist
+}
+
+// run decodes the source once and writes every pyramid level, smallest
+// first.
+func (b *tileBuild) run(sha, src string) {
+	defer func() {
+		tileMu.Lock()
+		delete(tileBuilds, sha)
+		tileMu.Unlock()
+		close(b.done)
+	}()
+
+	tileSem <- struct{}{}
+	defer func() { <-tileSem }()
+
+	img, err := imaging.Open(src, imaging.AutoOrientation(true))
+	if err != nil {
+		b.err = err
+		close(b.ready)
+		return
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	b.levels = make([]chan struct{}, MaxTileLevel(w, h)+1)
+	for i := range b.levels {
+		b.levels[i] = make(chan struct{})
+	}
+	close(b.ready)
+
+	for level := range b.levels {
+		lw, lh := TileLevelSize(w, h, level)
+		li := img
+		if lw != w || lh != h {
+			li = imaging.Resize(img, lw, lh, imaging.Lanczos)
+		}
+		if err := writeTiles(sha, level, li); err != nil {
+			b.err = err
+			return
+		}
+		close(b.levels[level])
+	}
+}
+
+// writeTiles cuts a level image into overlapping tiles.
+func writeTiles(sha string, level int, img image.Image) error {
+	dir := filepath.Join(TileDir(sha), fmt.Sprint(level))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	for row := 0; row*TileSize < h; row++ {
+		for col := 0; col*TileSize < w; col++ {
+			x0 := max(0, col*TileSize-TileOverlap)
+			y0 := max(0, row*TileSize-TileOverlap)
+			x1 := min(w, (col+1)*TileSize+TileOverlap)
+			y1 := min(h, (row+1)*TileSize+TileOverlap)
+			tile := imaging.Crop(img, image.Rect(x0, y0, x1, y1))
+			if err := saveTile(tile, TilePath(sha, level, col, row)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveTile writes a tile through a temporary file so concurrent readers never
+// see a partial JPEG.
+func saveTile(img image.Image, p string) error {
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = imaging.Encode(f, img, imaging.JPEG, imaging.JPEGQuality(90))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
@@ -0,0 +1,20 @@
+//go:build cgo
+
+package util
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// webpQuality is the lossy quality WebP thumbnails are encoded at.
+const webpQuality = 80
+
+// cgo builds encode WebP with the libwebp bundled by chai2010/webp.
+func init() {
+	WebPEncoder = func(w io.Writer, img image.Image) error {
+		return webp.Encode(w, img, &webp.Options{Quality: webpQuality})
+	}
+}